@@ -0,0 +1,205 @@
+package kpmenulib
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Actions of the access log
+const (
+	AccessCopy     = "copy"     // A field was copied into the clipboard
+	AccessAutotype = "autotype" // Fields were typed
+	AccessOutput   = "output"   // Fields were printed to the client, by the echo typer
+	AccessOTP      = "otp"      // An OTP was generated
+	AccessCommand  = "command"  // Fields were given to the command of a custom key
+	AccessQR       = "qr"       // A field was shown as a QR code
+)
+
+// otpField names generated OTPs in the access log, as the autotype token
+const otpField = "TOTP"
+
+// accessLogBackups is the number of rotated access logs kept, named <log>.1 (the newest) to <log>.5
+const accessLogBackups = 5
+
+// AccessClient identifies the process which requested a secret: the parent of the kpmenu client,
+// e.g. the window manager binding or the script running kpmenu
+type AccessClient struct {
+	Pid int    // Process id, 0 if unknown
+	Exe string // Path of the executable, if known
+}
+
+// AccessRecord is a line of the access log, values are never logged
+type AccessRecord struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	Database string    `json:"database"`
+	UUID     string    `json:"uuid"`
+	Title    string    `json:"title"`
+	Field    string    `json:"field,omitempty"`
+	Pid      int       `json:"pid,omitempty"`
+	Exe      string    `json:"exe,omitempty"`
+}
+
+// requestClient returns the parent of this process
+func requestClient() AccessClient {
+	client := AccessClient{Pid: os.Getppid()}
+	// Only available with procfs
+	client.Exe, _ = os.Readlink(fmt.Sprintf("/proc/%d/exe", client.Pid))
+	return client
+}
+
+// logAccess appends a record to the access log, if enabled, and records the uses of the entries
+func (m *Menu) logAccess(action string, entry *Entry, field string) {
+	switch action {
+	case AccessCopy, AccessAutotype, AccessOutput:
+		m.recordUsage(entry)
+	}
+	name := m.Configuration.General.AccessLog
+	if name == "" || entry == nil {
+		return
+	}
+	record := AccessRecord{
+		Time:   time.Now(),
+		Action: action,
+		UUID:   fmt.Sprintf("%x", entry.UUID[:]),
+		Title:  entry.FullEntry.GetTitle(),
+		Field:  field,
+		Pid:    m.client.Pid,
+		Exe:    m.client.Exe,
+	}
+	if entry.Database != nil {
+		record.Database = entry.Database.Name()
+	}
+	if err := AppendAccessLog(name, int64(m.Configuration.General.AccessLogMaxSize), record); err != nil {
+		log.Printf("failed to write access log: %s", err)
+	}
+}
+
+// AppendAccessLog appends the record to the log as a line of JSON. The log is only opened
+// for appending, it is rotated first if the record would make it larger than maxSize.
+func AppendAccessLog(name string, maxSize int64, record AccessRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if info, err := os.Stat(name); err == nil && maxSize > 0 && info.Size()+int64(len(line)) > maxSize {
+		if err := rotateAccessLog(name); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	// A single write, so that the records of concurrent processes aren't mixed
+	if _, err := file.Write(line); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// rotateAccessLog renames the log to <log>.1, shifting the older ones and dropping the oldest
+func rotateAccessLog(name string) error {
+	for i := accessLogBackups - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", name, i), fmt.Sprintf("%s.%d", name, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(name, name+".1")
+}
+
+// AccessFilter selects records of the access log
+type AccessFilter struct {
+	Entry string    // UUID, or part of the title ignoring the case
+	Since time.Time // Only the records after this time
+}
+
+func (f AccessFilter) match(r AccessRecord) bool {
+	if !f.Since.IsZero() && r.Time.Before(f.Since) {
+		return false
+	}
+	if f.Entry != "" && !strings.EqualFold(r.UUID, f.Entry) && !strings.Contains(strings.ToLower(r.Title), strings.ToLower(f.Entry)) {
+		return false
+	}
+	return true
+}
+
+// ReadAccessLog returns the records of the log and its rotated logs matching the filter, the oldest first
+func ReadAccessLog(name string, filter AccessFilter) ([]AccessRecord, error) {
+	var records []AccessRecord
+	names := []string{}
+	for i := accessLogBackups; i >= 1; i-- {
+		names = append(names, fmt.Sprintf("%s.%d", name, i))
+	}
+	names = append(names, name)
+	for _, n := range names {
+		file, err := os.Open(n)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		for line := 1; scanner.Scan(); line++ {
+			var record AccessRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("%s:%d: %v", n, line, err)
+			}
+			if filter.match(record) {
+				records = append(records, record)
+			}
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// ParseSince parses the start of the records to show: a duration before now (e.g. 24h),
+// a date (2006-01-02) or a time (RFC 3339)
+func ParseSince(value string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected a duration, a date or an RFC 3339 time", value)
+}
+
+// WriteAccessRecords writes the records for humans
+func WriteAccessRecords(w io.Writer, records []AccessRecord) error {
+	for _, r := range records {
+		client := ""
+		if r.Pid != 0 {
+			client = fmt.Sprintf("pid %d %s", r.Pid, r.Exe)
+		}
+		if _, err := fmt.Fprintf(w, "%s  %-8s  %s: %s  %s  %s\n", r.Time.Local().Format("2006-01-02 15:04:05"),
+			r.Action, r.Database, r.Title, r.Field, strings.TrimSpace(client)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
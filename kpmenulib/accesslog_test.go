@@ -0,0 +1,80 @@
+package kpmenulib
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLog(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "log", "access.log")
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	titles := []string{"GitHub", "Mail", "Bank"}
+	for i := 0; i < 30; i++ {
+		record := AccessRecord{
+			Time:   start.Add(time.Duration(i) * time.Hour),
+			Action: AccessCopy,
+			UUID:   strings.Repeat("0", 31) + string(rune('a'+i%3)),
+			Title:  titles[i%3],
+			Field:  "Password",
+			Pid:    42,
+		}
+		// Small enough to rotate a few times
+		if err := AppendAccessLog(name, 1000, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(name + ".1"); err != nil {
+		t.Errorf("expected a rotated log: %v", err)
+	}
+	if info, err := os.Stat(name); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected a private log, got %v (%v)", info.Mode(), err)
+	}
+
+	records, err := ReadAccessLog(name, AccessFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 30 || !records[0].Time.Equal(start) {
+		t.Fatalf("expected the 30 records in order, got %d", len(records))
+	}
+
+	records, err = ReadAccessLog(name, AccessFilter{Entry: "github", Since: start.Add(12 * time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 6 {
+		t.Errorf("expected 6 records, got %d", len(records))
+	}
+	for _, r := range records {
+		if r.Title != "GitHub" || r.Time.Before(start.Add(12*time.Hour)) {
+			t.Errorf("unexpected record %+v", r)
+		}
+	}
+	records, _ = ReadAccessLog(name, AccessFilter{Entry: strings.Repeat("0", 31) + "B"})
+	if len(records) != 10 {
+		t.Errorf("expected 10 records by UUID, got %d", len(records))
+	}
+
+	var out bytes.Buffer
+	WriteAccessRecords(&out, records[:1])
+	if !strings.Contains(out.String(), "copy") || !strings.Contains(out.String(), "Mail") {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	if since, err := ParseSince("24h", now); err != nil || !since.Equal(now.Add(-24*time.Hour)) {
+		t.Errorf("unexpected %s (%v)", since, err)
+	}
+	if since, err := ParseSince("2024-05-01", now); err != nil || since.Day() != 1 || since.Month() != time.May {
+		t.Errorf("unexpected %s (%v)", since, err)
+	}
+	if _, err := ParseSince("yesterday", now); err == nil {
+		t.Error("expected an error")
+	}
+}
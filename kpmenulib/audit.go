@@ -0,0 +1,473 @@
+package kpmenulib
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+// Kinds of audit issues, in decreasing order of severity
+const (
+	IssueBreached   = "breached"    // The password is in the breached passwords file
+	IssueWeak       = "weak"        // The password is easy to guess
+	IssueReused     = "reused"      // Other entries have the same password
+	IssueExpired    = "expired"     // The entry expired
+	IssueOld        = "old"         // The password wasn't changed for auditMaxAge
+	IssueNoUserName = "no-username" // The entry has a password but no user name
+	IssueNoURL      = "no-url"      // The entry has a password but no URL
+)
+
+// issueScores weights the issues to sort the findings
+var issueScores = map[string]int{
+	IssueBreached:   6,
+	IssueWeak:       5,
+	IssueReused:     4,
+	IssueExpired:    3,
+	IssueOld:        2,
+	IssueNoUserName: 1,
+	IssueNoURL:      1,
+}
+
+// maxAuditFindings is the number of worst findings listed by the menu
+const maxAuditFindings = 20
+
+// AuditOptions are the thresholds of the audit
+type AuditOptions struct {
+	MinEntropy float64            // Passwords with less bits are weak
+	MaxAge     time.Duration      // Passwords unchanged for longer are old, 0 disables the check
+	Breached   *BreachedPasswords // Breached passwords to look up, nil disables the check
+}
+
+// AuditIssue is a problem of an entry
+type AuditIssue struct {
+	Kind   string `json:"kind"`
+	Detail string `json:"detail"`
+	Group  int    `json:"group,omitempty"` // Entries with the same reused password have the same group
+}
+
+// AuditFinding lists the issues of an entry
+type AuditFinding struct {
+	Database string       `json:"database"`
+	UUID     string       `json:"uuid"`
+	Title    string       `json:"title"`
+	UserName string       `json:"username,omitempty"`
+	Score    int          `json:"score"`
+	Issues   []AuditIssue `json:"issues"`
+	Entry    Entry        `json:"-"`
+}
+
+// AuditReport is the result of Audit, findings are sorted from the worst
+type AuditReport struct {
+	Entries  int            `json:"entries"`
+	Counts   map[string]int `json:"counts"`
+	Findings []AuditFinding `json:"findings"`
+}
+
+// Audit checks the passwords of the entries, the values are never part of the report
+func Audit(entries []Entry, options AuditOptions, now time.Time) (AuditReport, error) {
+	report := AuditReport{Entries: len(entries), Counts: map[string]int{}}
+
+	// Group the entries by hash of their password
+	reused := map[[sha256.Size]byte][]int{}
+	for i, e := range entries {
+		if password := e.FullEntry.GetPassword(); password != "" {
+			hash := sha256.Sum256([]byte(password))
+			reused[hash] = append(reused[hash], i)
+		}
+	}
+	var groups [][]int
+	for _, group := range reused {
+		if len(group) > 1 {
+			groups = append(groups, group)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i][0] < groups[j][0] })
+	reuseGroup := map[int]int{}
+	for g, group := range groups {
+		for _, i := range group {
+			reuseGroup[i] = g + 1
+		}
+	}
+
+	for i, e := range entries {
+		finding := AuditFinding{
+			Database: e.Database.Name(),
+			UUID:     fmt.Sprintf("%x", e.UUID[:]),
+			Title:    e.FullEntry.GetTitle(),
+			UserName: e.FullEntry.GetContent("UserName"),
+			Entry:    e,
+		}
+		add := func(kind, detail string) {
+			finding.Issues = append(finding.Issues, AuditIssue{Kind: kind, Detail: detail})
+		}
+
+		if password := e.FullEntry.GetPassword(); password != "" {
+			if options.Breached != nil {
+				count, err := options.Breached.Count(password)
+				if err != nil {
+					return report, fmt.Errorf("failed to look up breached passwords: %v", err)
+				}
+				if count > 0 {
+					add(IssueBreached, fmt.Sprintf("seen %d times in breaches", count))
+				}
+			}
+			if bits := PasswordEntropy(password); bits < options.MinEntropy {
+				add(IssueWeak, fmt.Sprintf("~%.0f bits", bits))
+			}
+			if g := reuseGroup[i]; g != 0 {
+				var others []string
+				for _, j := range groups[g-1] {
+					if j != i {
+						others = append(others, entries[j].FullEntry.GetTitle())
+					}
+				}
+				finding.Issues = append(finding.Issues, AuditIssue{
+					Kind:   IssueReused,
+					Detail: "same password as " + strings.Join(others, ", "),
+					Group:  g,
+				})
+			}
+			if options.MaxAge > 0 {
+				if changed := passwordChanged(e.FullEntry); !changed.IsZero() && now.Sub(changed) > options.MaxAge {
+					add(IssueOld, fmt.Sprintf("unchanged since %s", changed.Format("2006-01-02")))
+				}
+			}
+			if e.FullEntry.GetContent("UserName") == "" {
+				add(IssueNoUserName, "no user name")
+			}
+			if e.FullEntry.GetContent("URL") == "" {
+				add(IssueNoURL, "no URL")
+			}
+		}
+		if times := e.FullEntry.Times; times.Expires.Bool {
+			if expiry := timeOf(times.ExpiryTime); !expiry.IsZero() && expiry.Before(now) {
+				add(IssueExpired, fmt.Sprintf("expired on %s", expiry.Format("2006-01-02")))
+			}
+		}
+
+		if len(finding.Issues) == 0 {
+			continue
+		}
+		for _, issue := range finding.Issues {
+			finding.Score += issueScores[issue.Kind]
+			report.Counts[issue.Kind]++
+		}
+		report.Findings = append(report.Findings, finding)
+	}
+
+	sort.SliceStable(report.Findings, func(i, j int) bool {
+		a, b := report.Findings[i], report.Findings[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		return strings.ToLower(a.Title) < strings.ToLower(b.Title)
+	})
+	return report, nil
+}
+
+// Audit checks the entries of the loaded databases with the thresholds of the configuration
+func (m *Menu) Audit() (AuditReport, error) {
+	options := AuditOptions{
+		MinEntropy: float64(m.Configuration.General.AuditMinEntropy),
+		MaxAge:     m.Configuration.General.AuditMaxAge,
+	}
+	if name := m.Configuration.General.Breached; name != "" {
+		breached, err := OpenBreachedPasswords(name)
+		if err != nil {
+			return AuditReport{}, err
+		}
+		defer breached.Close()
+		if !breached.Indexed() {
+			log.Printf("%s has no index, build it with --breachedIndex for faster checks", name)
+		}
+		options.Breached = breached
+	}
+	return Audit(m.Entries(m.Configuration.Flags.Tag), options, time.Now())
+}
+
+// passwordChanged returns when the current password of the entry was set, looking into its history
+func passwordChanged(entry gokeepasslib.Entry) time.Time {
+	changed := timeOf(entry.Times.LastModificationTime)
+	password := entry.GetPassword()
+	for _, history := range entry.Histories {
+		for i := len(history.Entries) - 1; i >= 0; i-- {
+			if history.Entries[i].GetPassword() != password {
+				return changed
+			}
+			if t := timeOf(history.Entries[i].Times.LastModificationTime); !t.IsZero() {
+				changed = t
+			}
+		}
+	}
+	return changed
+}
+
+// Summary lists the kinds of issues of the finding, e.g. "weak, reused"
+func (f AuditFinding) Summary() string {
+	kinds := make([]string, len(f.Issues))
+	for i, issue := range f.Issues {
+		kinds[i] = issue.Kind
+	}
+	return strings.Join(kinds, ", ")
+}
+
+// WriteText writes the report for humans
+func (r AuditReport) WriteText(w io.Writer) error {
+	var counts []string
+	for _, kind := range []string{IssueBreached, IssueWeak, IssueReused, IssueExpired, IssueOld, IssueNoUserName, IssueNoURL} {
+		if n := r.Counts[kind]; n > 0 {
+			counts = append(counts, fmt.Sprintf("%d %s", n, kind))
+		}
+	}
+	if _, err := fmt.Fprintf(w, "%d entries, %d with issues", r.Entries, len(r.Findings)); err != nil {
+		return err
+	}
+	if len(counts) > 0 {
+		fmt.Fprintf(w, ": %s", strings.Join(counts, ", "))
+	}
+	fmt.Fprintln(w)
+	for _, f := range r.Findings {
+		fmt.Fprintf(w, "\n%s: %s", f.Database, f.Title)
+		if f.UserName != "" {
+			fmt.Fprintf(w, " (%s)", f.UserName)
+		}
+		fmt.Fprintln(w)
+		for _, issue := range f.Issues {
+			if _, err := fmt.Fprintf(w, "  %-12s %s\n", issue.Kind, issue.Detail); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WriteJSON writes the report as JSON
+func (r AuditReport) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// Character pools of the entropy estimate
+const (
+	poolLower   = 26
+	poolUpper   = 26
+	poolDigits  = 10
+	poolSymbols = 33
+	poolOther   = 100
+)
+
+// Patterns of the entropy estimate
+var (
+	keyboardRows = []string{"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm", "qwertzuiop", "azertyuiop", "yxcvbnm"}
+	leetSpeak    = map[rune]rune{'0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't', '@': 'a', '$': 's', '!': 'i'}
+	// Most common passwords, ordered by frequency
+	commonPasswords = []string{
+		"password", "qwerty", "iloveyou", "admin", "welcome", "monkey", "dragon", "letmein", "login",
+		"master", "sunshine", "princess", "football", "baseball", "shadow", "superman", "trustno",
+		"abc", "secret", "hello", "freedom", "whatever", "starwars", "batman", "charlie", "michael",
+		"jordan", "hunter", "pass", "test", "love", "changeme", "default", "root", "azerty", "passwort",
+	}
+	dictionary     map[string]float64
+	dictionaryMax  int
+	dictionaryOnce sync.Once
+)
+
+// PasswordEntropy estimates the entropy in bits of a password, as an attacker guessing
+// human patterns would see it. The password is split into the cheapest sequence of
+// patterns: common passwords and dictionary words (even with leet speak), repetitions,
+// sequences of the alphabet or of keyboard rows, years, and random characters of the
+// classes used by the password.
+func PasswordEntropy(password string) float64 {
+	runes := []rune(password)
+	if len(runes) == 0 {
+		return 0
+	}
+	dictionaryOnce.Do(loadDictionary)
+	charBits := math.Log2(float64(characterPool(runes)))
+	lower := []rune(strings.ToLower(password))
+	if len(lower) != len(runes) {
+		lower = runes
+	}
+
+	// best[i] is the cost of the cheapest split of the first i characters
+	best := make([]float64, len(runes)+1)
+	for i := 1; i <= len(runes); i++ {
+		best[i] = math.Inf(1)
+	}
+	for i := 0; i < len(runes); i++ {
+		relax := func(length int, bits float64) {
+			if best[i]+bits < best[i+length] {
+				best[i+length] = best[i] + bits
+			}
+		}
+		relax(1, charBits)
+
+		// Repetition of the same character
+		n := 1
+		for i+n < len(runes) && runes[i+n] == runes[i] {
+			n++
+		}
+		for l := 3; l <= n; l++ {
+			relax(l, charBits+math.Log2(float64(l)))
+		}
+
+		// Sequence with a constant step of 1, e.g. abc, 987
+		if i+1 < len(runes) {
+			if step := runes[i+1] - runes[i]; step == 1 || step == -1 {
+				n := 2
+				for i+n < len(runes) && runes[i+n]-runes[i+n-1] == step {
+					n++
+				}
+				for l := 3; l <= n; l++ {
+					relax(l, charBits+math.Log2(float64(l))+1)
+				}
+			}
+		}
+
+		// Keyboard rows, forwards or backwards
+		for l := 3; i+l <= len(runes); l++ {
+			s := string(lower[i : i+l])
+			if !onKeyboardRow(s) {
+				break
+			}
+			relax(l, math.Log2(float64(len(keyboardRows)*10))+math.Log2(float64(l))+1)
+		}
+
+		// Years 1900-2099
+		if i+4 <= len(runes) {
+			if s := string(runes[i : i+4]); (strings.HasPrefix(s, "19") || strings.HasPrefix(s, "20")) && isDigits(s) {
+				relax(4, math.Log2(200))
+			}
+		}
+
+		// Words, with capitalization and leet speak
+		for l := 3; l <= dictionaryMax && i+l <= len(runes); l++ {
+			word, leet := unleet(lower[i : i+l])
+			bits, ok := dictionary[word]
+			if !ok {
+				continue
+			}
+			if leet {
+				bits++
+			}
+			bits += capitalizationBits(runes[i : i+l])
+			relax(l, bits)
+		}
+	}
+	return best[len(runes)]
+}
+
+// loadDictionary builds the dictionary of words and common passwords, with their cost in bits
+func loadDictionary() {
+	dictionary = map[string]float64{}
+	wordBits := math.Log2(float64(len(words())))
+	for _, w := range words() {
+		if len(w) >= 4 {
+			dictionary[w] = wordBits
+		}
+	}
+	for rank, w := range commonPasswords {
+		dictionary[w] = math.Log2(float64(rank + 2))
+	}
+	for w := range dictionary {
+		if len(w) > dictionaryMax {
+			dictionaryMax = len(w)
+		}
+	}
+}
+
+// characterPool returns the number of characters of the classes used by the password
+func characterPool(runes []rune) int {
+	var lower, upper, digits, symbols, other bool
+	for _, r := range runes {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digits = true
+		case r < unicode.MaxASCII:
+			symbols = true
+		default:
+			other = true
+		}
+	}
+	pool := 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{lower, poolLower}, {upper, poolUpper}, {digits, poolDigits}, {symbols, poolSymbols}, {other, poolOther}} {
+		if class.used {
+			pool += class.size
+		}
+	}
+	return pool
+}
+
+func onKeyboardRow(s string) bool {
+	for _, row := range keyboardRows {
+		if strings.Contains(row, s) || strings.Contains(row, reverse(s)) {
+			return true
+		}
+	}
+	return false
+}
+
+func reverse(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// unleet replaces leet speak characters, leet tells if any was replaced
+func unleet(runes []rune) (word string, leet bool) {
+	var b strings.Builder
+	for _, r := range runes {
+		if l, ok := leetSpeak[r]; ok {
+			r, leet = l, true
+		}
+		b.WriteRune(r)
+	}
+	return b.String(), leet
+}
+
+// capitalizationBits is the cost of the case of a word: none when lower case,
+// one bit when capitalized or upper case, one bit per letter otherwise
+func capitalizationBits(runes []rune) float64 {
+	upper := 0
+	for _, r := range runes {
+		if unicode.IsUpper(r) {
+			upper++
+		}
+	}
+	switch {
+	case upper == 0:
+		return 0
+	case upper == len(runes), upper == 1 && unicode.IsUpper(runes[0]):
+		return 1
+	}
+	return float64(len(runes))
+}
@@ -0,0 +1,112 @@
+package kpmenulib
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tobischo/gokeepasslib/v3"
+	w "github.com/tobischo/gokeepasslib/v3/wrappers"
+)
+
+func TestPasswordEntropy(t *testing.T) {
+	for _, test := range []struct {
+		password string
+		min, max float64
+	}{
+		{"", 0, 0},
+		{"password", 0, 2},
+		{"P4ssw0rd", 0, 5},
+		{"qwerty123", 0, 16},
+		{"aaaaaaaaaaaa", 0, 10},
+		{"abcdefgh2019", 0, 20},
+		{"correct horse battery staple", 60, 100},
+		{"x7#Kp9!qL2$vN4@r", 95, 110},
+	} {
+		if bits := PasswordEntropy(test.password); bits < test.min || bits > test.max {
+			t.Errorf("%q: expected %.0f-%.0f bits, got %.1f", test.password, test.min, test.max, bits)
+		}
+	}
+}
+
+func newAuditEntry(db *Database, title, username, url, password string) Entry {
+	entry := gokeepasslib.NewEntry()
+	entry.Values = append(entry.Values,
+		gokeepasslib.ValueData{Key: "Title", Value: gokeepasslib.V{Content: title}},
+		gokeepasslib.ValueData{Key: "UserName", Value: gokeepasslib.V{Content: username}},
+		gokeepasslib.ValueData{Key: "URL", Value: gokeepasslib.V{Content: url}},
+		gokeepasslib.ValueData{Key: "Password", Value: gokeepasslib.V{Content: password}},
+	)
+	return Entry{UUID: entry.UUID, FullEntry: entry, Database: db}
+}
+
+func TestAudit(t *testing.T) {
+	db := NewDatabase(DatabaseSource{Database: "test.kdbx"})
+	strong := "x7#Kp9!qL2$vN4@rT8&m"
+	entries := []Entry{
+		newAuditEntry(db, "good", "user", "https://good.example", "Zq3!vW8#nB5$kL1@pR7&"),
+		newAuditEntry(db, "weak", "user", "https://weak.example", "password1"),
+		newAuditEntry(db, "shared", "user", "https://a.example", strong),
+		newAuditEntry(db, "shared too", "user", "https://b.example", strong),
+		newAuditEntry(db, "incomplete", "", "", "Hq2@rT6!mZ9#xC4$vB1&"),
+		newAuditEntry(db, "note", "", "", ""),
+	}
+
+	// The password of old didn't change since its first version
+	old := newAuditEntry(db, "old", "user", "https://old.example", "Lp4!sD8#fG2$hJ6@kW9&")
+	previous := old.FullEntry.Clone()
+	setModified(&previous, -3*365*24*time.Hour)
+	setModified(&old.FullEntry, -24*time.Hour)
+	old.FullEntry.Histories = []gokeepasslib.History{{Entries: []gokeepasslib.Entry{previous}}}
+	entries = append(entries, old)
+
+	expired := newAuditEntry(db, "expired", "user", "https://expired.example", "Mn5!bV7#cX3$zA8@sD2&")
+	yesterday := w.Now()
+	yesterday.Time = yesterday.Time.Add(-24 * time.Hour)
+	expired.FullEntry.Times.Expires = w.NewBoolWrapper(true)
+	expired.FullEntry.Times.ExpiryTime = &yesterday
+	entries = append(entries, expired)
+
+	report, err := Audit(entries, AuditOptions{MinEntropy: 60, MaxAge: 365 * 24 * time.Hour}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	issues := map[string]string{}
+	for _, f := range report.Findings {
+		issues[f.Title] = f.Summary()
+	}
+	expected := map[string]string{
+		"weak":       "weak",
+		"shared":     "reused",
+		"shared too": "reused",
+		"incomplete": "no-username, no-url",
+		"old":        "old",
+		"expired":    "expired",
+	}
+	if len(issues) != len(expected) {
+		t.Errorf("expected %d findings, got %v", len(expected), issues)
+	}
+	for title, summary := range expected {
+		if issues[title] != summary {
+			t.Errorf("%s: expected %q, got %q", title, summary, issues[title])
+		}
+	}
+	if report.Findings[0].Title != "weak" {
+		t.Errorf("expected the weak password first, got %s", report.Findings[0].Title)
+	}
+
+	// Passwords are never reported
+	var out bytes.Buffer
+	if err := report.WriteJSON(&out); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), strong) || strings.Contains(out.String(), "password1") {
+		t.Errorf("the report contains a password: %s", out.String())
+	}
+	var decoded AuditReport
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil || decoded.Counts[IssueReused] != 2 {
+		t.Errorf("unexpected JSON report %s (%v)", out.String(), err)
+	}
+}
@@ -0,0 +1,249 @@
+package kpmenulib
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/google/shlex"
+)
+
+// PromptCapabilities are the features of a prompt backend, prompts only use the supported ones
+type PromptCapabilities struct {
+	Password   bool // Hides the typed text
+	CustomKeys int  // Number of custom keys, reported by the exit codes 10 and more
+	Message    bool // Shows a message above the items
+	Markup     bool // Renders Pango markup in the items and the message
+	Icons      bool // Shows icons of the items, given as rofi does: item\0icon\x1fname
+	Index      bool // Outputs the index of the selected item instead of its text
+	Preview    bool // Shows the preview of the selected entry, given as item\tpreview\totp period
+}
+
+// String lists the supported features
+func (c PromptCapabilities) String() string {
+	var features []string
+	for _, f := range []struct {
+		supported bool
+		name      string
+	}{
+		{c.Password, "password"},
+		{c.CustomKeys > 0, fmt.Sprintf("%d custom keys", c.CustomKeys)},
+		{c.Message, "message"},
+		{c.Markup, "markup"},
+		{c.Icons, "icons"},
+		{c.Index, "index"},
+		{c.Preview, "preview"},
+	} {
+		if f.supported {
+			features = append(features, f.name)
+		}
+	}
+	if len(features) == 0 {
+		return "none"
+	}
+	return strings.Join(features, ", ")
+}
+
+// PromptRequest describes a prompt, options not supported by the backend are ignored
+type PromptRequest struct {
+	Label    string // Prompt label
+	Password bool   // Hide the typed text
+	Message  string // Message shown above the items
+	Markup   bool   // Items and message contain Pango markup
+	Icons    bool   // Items have icons
+	Index    bool   // Output the index of the selected item
+	Preview  bool   // Items have a preview, see entryPreview
+	Custom   string // Command of the custom backend
+}
+
+// PromptBackend is a menu program used for the prompts
+type PromptBackend interface {
+	// Executable returns the program which must be installed, empty if none
+	Executable() string
+	// Capabilities returns the supported features
+	Capabilities() PromptCapabilities
+	// Command returns the argv of a prompt
+	Command(config *Configuration, request PromptRequest) ([]string, error)
+}
+
+var promptBackends = map[string]PromptBackend{
+	PromptDmenu:    dmenuBackend{},
+	PromptRofi:     rofiBackend{},
+	PromptWofi:     wofiBackend{},
+	PromptBemenu:   bemenuBackend{},
+	PromptFuzzel:   fuzzelBackend{},
+	PromptTofi:     tofiBackend{},
+	PromptTerminal: terminalBackend{},
+	PromptCustom:   customBackend{},
+}
+
+// PromptBackends returns the sorted names of the prompt backends
+func PromptBackends() []string {
+	names := make([]string, 0, len(promptBackends))
+	for name := range promptBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// promptBackend returns the backend of the configured menu
+func promptBackend(config *Configuration) (PromptBackend, error) {
+	backend, ok := promptBackends[config.General.Menu]
+	if !ok {
+		return nil, fmt.Errorf("invalid menu option %q, supported: %s", config.General.Menu, strings.Join(PromptBackends(), ", "))
+	}
+	return backend, nil
+}
+
+// backendSupports tells if the configured backend has the capability
+func backendSupports(menu *Menu, capability func(PromptCapabilities) bool) bool {
+	backend, err := promptBackend(menu.Configuration)
+	return err == nil && capability(backend.Capabilities())
+}
+
+// commandExists tells if the executable is in the PATH
+func commandExists(name string) bool {
+	return exec.Command("which", name).Run() == nil
+}
+
+type dmenuBackend struct{}
+
+func (dmenuBackend) Executable() string { return "dmenu" }
+
+// Capabilities of dmenu, the password is only hidden by the colors
+func (dmenuBackend) Capabilities() PromptCapabilities { return PromptCapabilities{} }
+
+func (dmenuBackend) Command(config *Configuration, r PromptRequest) ([]string, error) {
+	command := []string{"dmenu", "-i", "-p", r.Label}
+	if r.Password {
+		command = append(command,
+			"-nb", config.Style.PasswordBackground,
+			"-nf", config.Style.PasswordBackground,
+		)
+	}
+	return command, nil
+}
+
+type rofiBackend struct{}
+
+func (rofiBackend) Executable() string { return "rofi" }
+
+func (rofiBackend) Capabilities() PromptCapabilities {
+	return PromptCapabilities{Password: true, CustomKeys: 19, Message: true, Markup: true, Icons: true, Index: true}
+}
+
+func (rofiBackend) Command(config *Configuration, r PromptRequest) ([]string, error) {
+	command := []string{"rofi", "-i", "-dmenu", "-p", r.Label}
+	if r.Message != "" {
+		command = append(command, "-mesg", r.Message)
+	}
+	if r.Password {
+		command = append(command, "-password")
+	}
+	if r.Markup {
+		command = append(command, "-markup-rows")
+	}
+	if r.Icons {
+		command = append(command, "-show-icons")
+	}
+	if r.Index {
+		command = append(command, "-format", "i")
+	}
+	return command, nil
+}
+
+type wofiBackend struct{}
+
+func (wofiBackend) Executable() string { return "wofi" }
+
+func (wofiBackend) Capabilities() PromptCapabilities {
+	return PromptCapabilities{Password: true, Markup: true}
+}
+
+func (wofiBackend) Command(config *Configuration, r PromptRequest) ([]string, error) {
+	command := []string{"wofi", "-i", "-d", "-p", r.Label}
+	if r.Password {
+		command = append(command, "--password")
+	}
+	if r.Markup {
+		command = append(command, "--allow-markup")
+	}
+	return command, nil
+}
+
+type bemenuBackend struct{}
+
+func (bemenuBackend) Executable() string { return "bemenu" }
+
+func (bemenuBackend) Capabilities() PromptCapabilities {
+	return PromptCapabilities{Password: true}
+}
+
+func (bemenuBackend) Command(config *Configuration, r PromptRequest) ([]string, error) {
+	command := []string{"bemenu", "-i", "-p", r.Label}
+	if r.Password {
+		command = append(command, "-x")
+	}
+	return command, nil
+}
+
+type fuzzelBackend struct{}
+
+func (fuzzelBackend) Executable() string { return "fuzzel" }
+
+// Capabilities of fuzzel, the custom keys are bound by custom-1 to custom-19 in fuzzel.ini
+func (fuzzelBackend) Capabilities() PromptCapabilities {
+	return PromptCapabilities{Password: true, CustomKeys: 19, Icons: true, Index: true}
+}
+
+func (fuzzelBackend) Command(config *Configuration, r PromptRequest) ([]string, error) {
+	command := []string{"fuzzel", "--dmenu", "--prompt", r.Label + " "}
+	if r.Password {
+		command = append(command, "--password")
+	}
+	if r.Index {
+		command = append(command, "--index")
+	}
+	if !r.Icons {
+		command = append(command, "--no-icons")
+	}
+	return command, nil
+}
+
+type tofiBackend struct{}
+
+func (tofiBackend) Executable() string { return "tofi" }
+
+func (tofiBackend) Capabilities() PromptCapabilities {
+	return PromptCapabilities{Password: true}
+}
+
+func (tofiBackend) Command(config *Configuration, r PromptRequest) ([]string, error) {
+	// Free text must be accepted too, e.g. for new values
+	command := []string{"tofi", "--prompt-text", r.Label + " ", "--require-match=false"}
+	if r.Password {
+		command = append(command, "--hide-input=true")
+	}
+	return command, nil
+}
+
+// customBackend runs the configured command of the prompt, which is responsible for the
+// options. The custom keys of the exit codes 10 to 14 are kept as before the backends.
+type customBackend struct{}
+
+func (customBackend) Executable() string { return "" }
+
+func (customBackend) Capabilities() PromptCapabilities {
+	return PromptCapabilities{Password: true, CustomKeys: 5}
+}
+
+func (customBackend) Command(config *Configuration, r PromptRequest) ([]string, error) {
+	command, err := shlex.Split(r.Custom)
+	if err != nil {
+		return nil, errors.New("failed to parse custom prompt, exiting")
+	}
+	return command, nil
+}
@@ -0,0 +1,51 @@
+package kpmenulib
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGetCommand(t *testing.T) {
+	menu := &Menu{Configuration: NewConfiguration()}
+	request := PromptRequest{Label: "Entry", Message: "help", Index: true, Icons: true}
+	for _, test := range []struct {
+		menu     string
+		expected string
+	}{
+		// Message, icons and index are dropped when not supported
+		{PromptDmenu, "dmenu -i -p Entry"},
+		{PromptRofi, "rofi -i -dmenu -p Entry -mesg help -show-icons -format i"},
+		{PromptWofi, "wofi -i -d -p Entry"},
+		{PromptBemenu, "bemenu -i -p Entry"},
+		{PromptFuzzel, "fuzzel --dmenu --prompt Entry  --index"},
+		{PromptTofi, "tofi --prompt-text Entry  --require-match=false"},
+	} {
+		menu.Configuration.General.Menu = test.menu
+		command, err := getCommand(menu, request)
+		if err.Error != nil {
+			t.Fatalf("%s: %s", test.menu, err.Error)
+		}
+		if s := strings.Join(command, " "); s != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.menu, test.expected, s)
+		}
+	}
+
+	// Each backend hides the password its own way
+	for name, backend := range promptBackends {
+		menu.Configuration.General.Menu = name
+		plain, _ := getCommand(menu, PromptRequest{Label: "Password", Custom: "custom"})
+		hidden, _ := getCommand(menu, PromptRequest{Label: "Password", Password: true, Custom: "custom"})
+		// The terminal reads the password itself, see TestTerminalSelector
+		if name != PromptCustom && name != PromptTerminal && len(hidden) <= len(plain) {
+			t.Errorf("%s: the password isn't hidden: %v", name, hidden)
+		}
+		if backend.Capabilities().String() == "" {
+			t.Errorf("%s: no capabilities description", name)
+		}
+	}
+
+	menu.Configuration.General.Menu = "unknown"
+	if _, err := getCommand(menu, request); err.Error == nil || !err.Cancelled {
+		t.Error("expected an error for an unknown menu")
+	}
+}
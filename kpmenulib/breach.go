@@ -0,0 +1,254 @@
+package kpmenulib
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// BreachIndexSuffix is appended to the name of the breached passwords file to name its index
+const BreachIndexSuffix = ".kpidx"
+
+// The index has the offset of the first line of every prefix of 20 bits of the hashes,
+// as the ranges of the Have I Been Pwned API
+const (
+	breachIndexMagic  = "KPMHIBP1"
+	breachIndexBits   = 20
+	breachIndexRanges = 1 << breachIndexBits
+	breachMaxLine     = 256
+)
+
+// ErrBreachFileFormat is returned when the file isn't a HIBP file ordered by hash
+var ErrBreachFileFormat = errors.New("not a SHA-1 pwned passwords file ordered by hash")
+
+// BreachedPasswords looks up passwords in the pwned passwords file of Have I Been Pwned,
+// the SHA-1 version ordered by hash. Each line is the upper case hex hash and the number of
+// times it was seen in breaches, e.g.
+//
+//	000000005AD76BD555C1D6D771DE417A4B87E4B4:10
+//
+// The file is binary searched, the index narrows the search to the lines of a range.
+type BreachedPasswords struct {
+	file  *os.File
+	size  int64
+	index []int64 // Offsets of the ranges, nil without index
+}
+
+// OpenBreachedPasswords opens the file, with its index if it exists and is up to date
+func OpenBreachedPasswords(name string) (*BreachedPasswords, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	b := &BreachedPasswords{file: file, size: info.Size()}
+	if index, err := readBreachIndex(name+BreachIndexSuffix, info.Size()); err == nil {
+		b.index = index
+	} else if !errors.Is(err, os.ErrNotExist) {
+		file.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// Close closes the file
+func (b *BreachedPasswords) Close() error {
+	return b.file.Close()
+}
+
+// Indexed tells if the index is used
+func (b *BreachedPasswords) Indexed() bool {
+	return b.index != nil
+}
+
+// Count returns how many times the password was seen in breaches, 0 if never
+func (b *BreachedPasswords) Count(password string) (int, error) {
+	hash := sha1.Sum([]byte(password))
+	return b.CountHash(hash)
+}
+
+// CountHash returns how many times the SHA-1 hash of a password was seen in breaches
+func (b *BreachedPasswords) CountHash(hash [sha1.Size]byte) (int, error) {
+	target := []byte(fmt.Sprintf("%X", hash[:]))
+	lo, hi := int64(0), b.size
+	if b.index != nil {
+		r := breachRange(hash)
+		lo, hi = b.index[r], b.index[r+1]
+	}
+
+	// The line of the hash, if any, starts in [lo, hi) and lo is the start of a line
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		start, err := b.nextLine(mid)
+		if err != nil {
+			return 0, err
+		}
+		if start >= hi {
+			hi = mid
+			continue
+		}
+		line, err := b.readLine(start)
+		if err != nil {
+			return 0, err
+		}
+		lineHash, count, err := parseBreachLine(line)
+		if err != nil {
+			return 0, err
+		}
+		switch bytes.Compare(lineHash, target) {
+		case 0:
+			return count, nil
+		case -1:
+			lo = start + int64(len(line)) + 1
+		default:
+			hi = mid
+		}
+	}
+	return 0, nil
+}
+
+// nextLine returns the offset of the first line starting at or after offset
+func (b *BreachedPasswords) nextLine(offset int64) (int64, error) {
+	if offset == 0 {
+		return 0, nil
+	}
+	buffer := make([]byte, breachMaxLine)
+	n, err := b.file.ReadAt(buffer, offset-1)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	i := bytes.IndexByte(buffer[:n], '\n')
+	if i == -1 {
+		if err == io.EOF {
+			return b.size, nil
+		}
+		return 0, ErrBreachFileFormat
+	}
+	return offset + int64(i), nil
+}
+
+// readLine returns the line starting at offset, without the newline
+func (b *BreachedPasswords) readLine(offset int64) ([]byte, error) {
+	buffer := make([]byte, breachMaxLine)
+	n, err := b.file.ReadAt(buffer, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if i := bytes.IndexByte(buffer[:n], '\n'); i != -1 {
+		return buffer[:i], nil
+	}
+	if err == io.EOF {
+		return buffer[:n], nil
+	}
+	return nil, ErrBreachFileFormat
+}
+
+// parseBreachLine returns the upper case hash and the count of a line
+func parseBreachLine(line []byte) ([]byte, int, error) {
+	line = bytes.TrimRight(line, "\r")
+	hash, count, found := bytes.Cut(line, []byte(":"))
+	if !found || len(hash) != 2*sha1.Size {
+		return nil, 0, ErrBreachFileFormat
+	}
+	n, err := strconv.Atoi(string(count))
+	if err != nil {
+		return nil, 0, ErrBreachFileFormat
+	}
+	return bytes.ToUpper(hash), n, nil
+}
+
+// breachRange returns the range of the hash in the index
+func breachRange(hash [sha1.Size]byte) int {
+	return int(hash[0])<<12 | int(hash[1])<<4 | int(hash[2])>>4
+}
+
+// BuildBreachIndex reads the whole file and writes its index next to it, so that later
+// lookups only search the lines of the range of the hash
+func BuildBreachIndex(name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	index := make([]int64, breachIndexRanges+1)
+	reader := bufio.NewReaderSize(file, 1<<20)
+	var offset int64
+	next := 0 // First range without offset
+	for {
+		line, err := reader.ReadSlice('\n')
+		if len(line) > 0 {
+			hash, _, errLine := parseBreachLine(bytes.TrimRight(line, "\n"))
+			if errLine != nil {
+				return fmt.Errorf("%s at offset %d: %w", name, offset, errLine)
+			}
+			var prefix [sha1.Size]byte
+			if _, errLine := hex.Decode(prefix[:3], hash[:6]); errLine != nil {
+				return fmt.Errorf("%s at offset %d: %w", name, offset, ErrBreachFileFormat)
+			}
+			r := breachRange(prefix)
+			if r < next-1 {
+				return fmt.Errorf("%s at offset %d: %w", name, offset, ErrBreachFileFormat)
+			}
+			for ; next <= r; next++ {
+				index[next] = offset
+			}
+			offset += int64(len(line))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for ; next <= breachIndexRanges; next++ {
+		index[next] = offset
+	}
+
+	var data bytes.Buffer
+	data.WriteString(breachIndexMagic)
+	binary.Write(&data, binary.BigEndian, info.Size())
+	binary.Write(&data, binary.BigEndian, index)
+	return writeFileAtomic(name+BreachIndexSuffix, data.Bytes())
+}
+
+// readBreachIndex reads the index, it must be built from a file of the given size
+func readBreachIndex(name string, size int64) ([]int64, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	reader := bytes.NewReader(data)
+	magic := make([]byte, len(breachIndexMagic))
+	var indexed int64
+	index := make([]int64, breachIndexRanges+1)
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != breachIndexMagic {
+		return nil, fmt.Errorf("%s: invalid index", name)
+	}
+	if err := binary.Read(reader, binary.BigEndian, &indexed); err != nil {
+		return nil, fmt.Errorf("%s: invalid index", name)
+	}
+	if indexed != size {
+		return nil, fmt.Errorf("%s: the index is out of date, build it again", name)
+	}
+	if err := binary.Read(reader, binary.BigEndian, index); err != nil {
+		return nil, fmt.Errorf("%s: invalid index", name)
+	}
+	return index, nil
+}
@@ -0,0 +1,104 @@
+package kpmenulib
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newBreachFile writes a pwned passwords file with the passwords pw0 to pw<n-1>,
+// each one seen i+1 times
+func newBreachFile(t *testing.T, n int) string {
+	t.Helper()
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("%X:%d\r\n", sha1.Sum([]byte(fmt.Sprintf("pw%d", i))), i+1)
+	}
+	sort.Strings(lines)
+	name := filepath.Join(t.TempDir(), "pwned-passwords-sha1-ordered-by-hash.txt")
+	if err := os.WriteFile(name, []byte(strings.Join(lines, "")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestBreachedPasswords(t *testing.T) {
+	const n = 2000
+	name := newBreachFile(t, n)
+
+	check := func() {
+		t.Helper()
+		breached, err := OpenBreachedPasswords(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer breached.Close()
+		for i := 0; i < n; i++ {
+			if count, err := breached.Count(fmt.Sprintf("pw%d", i)); count != i+1 || err != nil {
+				t.Fatalf("pw%d: expected %d, got %d (%v)", i, i+1, count, err)
+			}
+		}
+		for _, password := range []string{"", "missing", "pw2000"} {
+			if count, err := breached.Count(password); count != 0 || err != nil {
+				t.Errorf("%q: expected 0, got %d (%v)", password, count, err)
+			}
+		}
+	}
+	check()
+
+	if err := BuildBreachIndex(name); err != nil {
+		t.Fatal(err)
+	}
+	breached, err := OpenBreachedPasswords(name)
+	if err != nil || !breached.Indexed() {
+		t.Fatalf("expected the index to be used (%v)", err)
+	}
+	breached.Close()
+	check()
+
+	// The index of another file is refused
+	if err := os.WriteFile(name, []byte("0000000000000000000000000000000000000000:1\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenBreachedPasswords(name); err == nil {
+		t.Error("expected an out of date index error")
+	}
+}
+
+func TestBuildBreachIndexUnordered(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "unordered.txt")
+	data := "F000000000000000000000000000000000000000:1\r\n0000000000000000000000000000000000000000:1\r\n"
+	if err := os.WriteFile(name, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := BuildBreachIndex(name); !errors.Is(err, ErrBreachFileFormat) {
+		t.Errorf("expected %v, got %v", ErrBreachFileFormat, err)
+	}
+}
+
+func TestAuditBreached(t *testing.T) {
+	breached, err := OpenBreachedPasswords(newBreachFile(t, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer breached.Close()
+
+	db := NewDatabase(DatabaseSource{Database: "test.kdbx"})
+	entries := []Entry{newAuditEntry(db, "breached", "user", "https://example.com", "pw42")}
+	report, err := Audit(entries, AuditOptions{Breached: breached}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Findings) != 1 || report.Findings[0].Issues[0].Kind != IssueBreached {
+		t.Fatalf("expected a breached finding, got %+v", report.Findings)
+	}
+	if detail := report.Findings[0].Issues[0].Detail; detail != "seen 43 times in breaches" {
+		t.Errorf("unexpected detail %q", detail)
+	}
+}
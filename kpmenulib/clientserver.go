@@ -14,6 +14,7 @@ import (
 // Packet is the data sent by the client to the server listener
 type Packet struct {
 	CliArguments []string
+	Client       AccessClient // Process which ran the client
 }
 type PacketResp struct {
 	Output string
@@ -34,7 +35,7 @@ func StartClient() error {
 
 	// Send the packet
 	enc := gob.NewEncoder(conn)
-	enc.Encode(Packet{CliArguments: os.Args[1:]})
+	enc.Encode(Packet{CliArguments: os.Args[1:], Client: requestClient()})
 	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
 	dec := gob.NewDecoder(conn)
 	out := PacketResp{}
@@ -49,32 +50,20 @@ func StartServer(m *Menu) (err error) {
 		log.Printf("Executing as daemon")
 	}
 
+	// Keep the cached secrets out of reach of other processes
+	m.protection = hardenProcess()
+	m.client = requestClient()
+
 	if m.Configuration.General.NoCache && !m.Configuration.Flags.Daemon {
 		// Directly execute kpmenu
 		var out PacketResp
 		fatal := m.Execute(&out)
+		m.LockAll()
 		if fatal {
 			os.Exit(1) // Set exit code to 1 and exit
 		}
 		fmt.Fprintf(os.Stdout, "%s", out.Output)
 	} else {
-		// Handle packet request
-		handlePacket := func(packet Packet, out *PacketResp) (fatal bool) {
-			log.Printf("received a client call with args \"%v\"", packet.CliArguments)
-			m.Configuration.Flags.Autotype = false
-			m.CliArguments = packet.CliArguments
-			cc := InitializeFlags(packet.CliArguments)
-			clientConfig := NewConfiguration()
-			if err := LoadConfig(cc, clientConfig); err != nil {
-				log.Fatalf("loading client config: %s", err)
-				return false
-			}
-			m.Configuration = clientConfig
-			defer m.ReloadConfig()
-
-			return m.Show(out)
-		}
-
 		// Execute kpmenu for the first time, if not a daemon
 		exit := false
 		var out PacketResp
@@ -88,12 +77,44 @@ func StartServer(m *Menu) (err error) {
 
 		// If exit is false (cache on) listen for client calls
 		if !exit {
-			err = setupListener(m, handlePacket)
+			err = setupListener(m, m.handlePacket)
 		}
+
+		// Quit or cache timeout
+		m.LockAll()
 	}
 	return
 }
 
+// handlePacket shows the menu with the configuration of the client request
+func (m *Menu) handlePacket(packet Packet, out *PacketResp) (fatal bool) {
+	log.Printf("received a client call with args \"%v\"", packet.CliArguments)
+	m.Configuration.Flags.Autotype = false
+	m.CliArguments = packet.CliArguments
+	m.client = packet.Client
+	cc := InitializeFlags(packet.CliArguments)
+	clientConfig := NewConfiguration()
+	if err := LoadConfig(cc, clientConfig); err != nil {
+		log.Fatalf("loading client config: %s", err)
+		return false
+	}
+	m.Configuration = clientConfig
+	if err := m.useDatabases(clientConfig); err != nil {
+		log.Printf("loading client databases: %s", err)
+		return false
+	}
+	m.takePassword(clientConfig)
+	defer m.ReloadConfig()
+
+	// The prompts would be in the terminal of the daemon
+	if clientConfig.General.Menu == PromptTerminal {
+		out.Output = "the terminal menu can't be used by the daemon, run kpmenu --menu terminal without it\n"
+		return false
+	}
+
+	return m.Show(out)
+}
+
 func setupListener(m *Menu, handlePacket func(Packet, *PacketResp) bool) error {
 	// Listen for client calls
 	listener, err := net.Listen("tcp", ":0")
@@ -0,0 +1,77 @@
+package kpmenulib
+
+import (
+	"testing"
+)
+
+func TestHandlePacketForgetsPassword(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	cfg, _ := newTestDatabase(t)
+	args := []string{
+		"--daemon", "--nowatch", "-d", cfg.Database.Database, "-p", "secret",
+		"--menu", PromptCustom, "--customPromptMenu", "sh -c 'exit 1'",
+	}
+	config := NewConfiguration()
+	if err := LoadConfig(InitializeFlags(args), config); err != nil {
+		t.Fatal(err)
+	}
+	// NewMenu without checking the tools installed
+	db := NewDatabase(DatabaseSource{Database: config.Database.Database})
+	menu := &Menu{Configuration: config, Database: db, Databases: []*Database{db}}
+	menu.takePassword(config)
+	// As main does, the configuration of the daemon is loaded again after every request
+	menu.ReloadConfig = func() error {
+		err := LoadConfig(InitializeFlags(args), config)
+		config.Database.Password = ""
+		return err
+	}
+	if config.Database.Password != "" {
+		t.Error("expected the menu to take the password of the configuration")
+	}
+
+	for i := 0; i < 2; i++ {
+		var out PacketResp
+		if fatal := menu.handlePacket(Packet{CliArguments: args}, &out); fatal {
+			t.Fatalf("request %d: unexpected fatal error", i)
+		}
+		if !menu.Database.Loaded {
+			t.Fatalf("request %d: expected the database to be unlocked", i)
+		}
+		if menu.Configuration.Database.Password != "" || config.Database.Password != "" || menu.password != "" {
+			t.Errorf("request %d: expected the password to be forgotten", i)
+		}
+	}
+}
+
+func TestHandlePacketDatabases(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	first, _ := newTestDatabase(t)
+	second, _ := newTestDatabase(t)
+	args := func(cfg *Configuration) []string {
+		return []string{
+			"--daemon", "--nowatch", "-d", cfg.Database.Database, "-p", "secret",
+			"--menu", PromptCustom, "--customPromptMenu", "sh -c 'exit 1'",
+		}
+	}
+	config := NewConfiguration()
+	if err := LoadConfig(InitializeFlags(args(first)), config); err != nil {
+		t.Fatal(err)
+	}
+	db := NewDatabase(DatabaseSource{Database: config.Database.Database})
+	menu := &Menu{Configuration: config, Database: db, Databases: []*Database{db}}
+	menu.ReloadConfig = func() error { return nil }
+
+	var out PacketResp
+	menu.handlePacket(Packet{CliArguments: args(first)}, &out)
+	if !db.Loaded {
+		t.Fatal("expected the database to be unlocked")
+	}
+	// A client selecting another database is served with it
+	menu.handlePacket(Packet{CliArguments: args(second)}, &out)
+	if menu.Database.Source.Database != second.Database.Database || !menu.Database.Loaded {
+		t.Errorf("expected %s to be unlocked, got %s", second.Database.Database, menu.Database.Source.Database)
+	}
+	if db.Loaded || len(menu.Databases) != 1 {
+		t.Errorf("expected the previous database to be locked and replaced")
+	}
+}
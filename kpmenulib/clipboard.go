@@ -2,6 +2,7 @@ package kpmenulib
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"errors"
 	"log"
 	"os/exec"
@@ -80,6 +81,9 @@ func GetClipboard(menu *Menu) (string, error) {
 // CleanClipboard cleans the clipboard, if not changed
 func CleanClipboard(menu *Menu, text string) {
 	if menu.Configuration.General.ClipboardTimeout > 0 {
+		// Only keep the hash, not a copy of the text
+		digest := sha256.Sum256([]byte(text))
+
 		// Goroutine
 		// Its async so any error will be printed
 		menu.WaitGroup.Add(1)
@@ -93,7 +97,7 @@ func CleanClipboard(menu *Menu, text string) {
 			currentClipboard, err := GetClipboard(menu)
 
 			if err == nil {
-				if text == currentClipboard {
+				if sha256.Sum256([]byte(currentClipboard)) == digest {
 					var cmd *exec.Cmd
 					// Execute clean clipboard
 					switch menu.Configuration.General.ClipboardTool {
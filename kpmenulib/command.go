@@ -0,0 +1,224 @@
+package kpmenulib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Commands executed directly, without a menu or a daemon
+const (
+	CommandGenerate = "generate"
+	CommandMerge    = "merge"
+	CommandLock     = "lock"
+	CommandAudit    = "audit"
+	CommandLog      = "log"
+	CommandFrecency = "frecency"
+)
+
+var commands = []string{CommandGenerate, CommandMerge, CommandLock, CommandAudit, CommandLog, CommandFrecency}
+
+// SplitCommand separates the command (if any) and its positional arguments from the flags.
+// A command is the first argument, its positional arguments are the ones before the first flag.
+func SplitCommand(args []string) (command string, commandArgs []string, flags []string) {
+	if len(args) == 0 || !contains(commands, args[0]) {
+		return "", nil, args
+	}
+	command = args[0]
+	i := 1
+	for ; i < len(args) && !strings.HasPrefix(args[i], "-"); i++ {
+		commandArgs = append(commandArgs, args[i])
+	}
+	return command, commandArgs, args[i:]
+}
+
+// RunCommand executes a command
+func RunCommand(config *Configuration, command string, args []string) error {
+	switch command {
+	case CommandGenerate:
+		return generateCommand(config, args)
+	case CommandMerge:
+		return mergeCommand(config, args)
+	case CommandLock:
+		return lockCommand(config, args)
+	case CommandAudit:
+		return auditCommand(config, args)
+	case CommandLog:
+		return logCommand(config, args)
+	case CommandFrecency:
+		return frecencyCommand(config, args)
+	}
+	return fmt.Errorf("unknown command %s", command)
+}
+
+// generateCommand generates a password into the clipboard.
+// The only argument is either a profile name or profile options, the default profile is used otherwise.
+func generateCommand(config *Configuration, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: kpmenu generate [profile|options]")
+	}
+	profiles, err := PasswordProfiles(config)
+	if err != nil {
+		return err
+	}
+	profile := profiles[0]
+	if len(args) == 1 {
+		found := false
+		for _, p := range profiles {
+			if p.Name == args[0] {
+				profile, found = p, true
+				break
+			}
+		}
+		if !found {
+			if profile, err = ParsePasswordProfile("custom", args[0]); err != nil {
+				return err
+			}
+		}
+	}
+
+	password, err := profile.Generate()
+	if err != nil {
+		return err
+	}
+
+	// Only the clipboard is used, so the database is not needed
+	menu := &Menu{
+		Configuration: config,
+		WaitGroup:     new(sync.WaitGroup),
+	}
+	if err := CopyToClipboard(menu, password); err != nil {
+		return fmt.Errorf("failed to use clipboard manager to update clipboard: %s", err)
+	}
+	log.Printf("copied generated password into the clipboard: %s", profile)
+	CleanClipboard(menu, password)
+	menu.WaitGroup.Wait()
+	return nil
+}
+
+// mergeCommand merges other database files, e.g. sync conflict copies, into the main database.
+// The files must be unlocked by the same credentials of the main database.
+func mergeCommand(config *Configuration, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: kpmenu merge <database>...")
+	}
+	menu, err := NewMenu(config)
+	if err != nil {
+		return err
+	}
+	if err := menu.OpenDatabase(); err != nil {
+		return errors.New(err.String())
+	}
+	for _, name := range args {
+		summary, err := menu.Database.MergeFile(name)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: %s\n", name, summary)
+	}
+	return nil
+}
+
+// lockCommand removes the session keys of the databases from the kernel keyring,
+// the next processes must unlock them again
+func lockCommand(config *Configuration, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("usage: kpmenu lock")
+	}
+	menu, err := NewMenu(config)
+	if err != nil {
+		return err
+	}
+	for _, db := range menu.Databases {
+		found, err := forgetSessionKey(menu, db)
+		if err != nil {
+			return fmt.Errorf("failed to remove the session key of %s: %v", db.Name(), err)
+		}
+		if found {
+			log.Printf("removed the session key of %s", db.Name())
+		}
+	}
+	return nil
+}
+
+// auditCommand prints the password health of the entries of every database, as JSON with --json.
+// With --breachedIndex the index of the breached passwords file is built first.
+func auditCommand(config *Configuration, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("usage: kpmenu audit [--json] [--breached file [--breachedIndex]]")
+	}
+	if config.Flags.BreachedIndex {
+		if config.General.Breached == "" {
+			return errors.New("--breachedIndex needs the breached passwords file given by --breached")
+		}
+		log.Printf("indexing %s", config.General.Breached)
+		if err := BuildBreachIndex(config.General.Breached); err != nil {
+			return fmt.Errorf("failed to index breached passwords: %v", err)
+		}
+	}
+	menu, err := NewMenu(config)
+	if err != nil {
+		return err
+	}
+	if err := menu.OpenDatabase(); err != nil {
+		return errors.New(err.String())
+	}
+	menu.UnlockAll()
+	report, err := menu.Audit()
+	if err != nil {
+		return err
+	}
+	if config.Flags.Json {
+		return report.WriteJSON(os.Stdout)
+	}
+	return report.WriteText(os.Stdout)
+}
+
+// logCommand prints the access log, filtered by --entry and --since, as JSON lines with --json
+func logCommand(config *Configuration, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("usage: kpmenu log [--entry uuid|title] [--since time] [--json]")
+	}
+	if config.General.AccessLog == "" {
+		return errors.New("the access log is disabled, set accessLog")
+	}
+	filter := AccessFilter{Entry: config.Flags.Entry}
+	if config.Flags.Since != "" {
+		since, err := ParseSince(config.Flags.Since, time.Now())
+		if err != nil {
+			return err
+		}
+		filter.Since = since
+	}
+	records, err := ReadAccessLog(config.General.AccessLog, filter)
+	if err != nil {
+		return err
+	}
+	if config.Flags.Json {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, r := range records {
+			if err := encoder.Encode(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return WriteAccessRecords(os.Stdout, records)
+}
+
+// frecencyCommand resets the usage store sorting the entries
+func frecencyCommand(config *Configuration, args []string) error {
+	if len(args) != 1 || args[0] != "reset" {
+		return fmt.Errorf("usage: kpmenu frecency reset")
+	}
+	if err := ResetUsage(usageStorePath()); err != nil {
+		return err
+	}
+	log.Printf("removed the usage store")
+	return nil
+}
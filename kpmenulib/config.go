@@ -7,6 +7,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/google/shlex"
 	"ser1.net/clapconf"
 
 	"ser1.net/claptrap/v4"
@@ -23,17 +24,29 @@ type Configuration struct {
 
 // ConfigurationGeneral is the sub-structure of the configuration related to general kpmenu settings
 type ConfigurationGeneral struct {
-	Menu             string        // Which menu to use
-	ClipboardTool    string        // Clipboard tool to use
-	ClipboardTimeout time.Duration // Clipboard timeout before clean it
-	NoCache          bool          // Flag to do not cache master password
-	CacheOneTime     bool          // Cache the password only the first time you write it
-	CacheTimeout     time.Duration // Timeout of cache
-	NoOTP            bool          // Flag to do not handle OTPs
-	DisableAutotype  bool          // Disable autotype
-	AutotypeConfirm  bool          // User must always confirm
-	AutotypeNoAuto   bool          // Always prompt user to select the entry to autotype
-	AutotypeSequence string        // auto type sequence demo:{USERNAME}{PASSWORD}
+	Menu              string        // Which menu to use
+	ClipboardTool     string        // Clipboard tool to use
+	ClipboardTimeout  time.Duration // Clipboard timeout before clean it
+	NoCache           bool          // Flag to do not cache master password
+	CacheOneTime      bool          // Cache the password only the first time you write it
+	CacheTimeout      time.Duration // Timeout of cache
+	NoWatch           bool          // Flag to do not reload the cached database when its file changes
+	AutoMerge         bool          // Merge sync conflict copies of the database file
+	NoOTP             bool          // Flag to do not handle OTPs
+	DisableAutotype   bool          // Disable autotype
+	AutotypeConfirm   bool          // User must always confirm
+	AutotypeNoAuto    bool          // Always prompt user to select the entry to autotype
+	AutotypeSequence  string        // auto type sequence demo:{USERNAME}{PASSWORD}
+	GeneratorDefault  string        // Options of the default password generator profile
+	GeneratorProfiles string        // Named password generator profiles, name:options separated by ;
+	AuditMinEntropy   int           // Passwords with less bits of entropy are weak
+	AuditMaxAge       time.Duration // Passwords unchanged for longer are old
+	Breached          string        // SHA-1 pwned passwords file of Have I Been Pwned, ordered by hash
+	AccessLog         string        // Log of the secrets released, empty to disable it
+	AccessLogMaxSize  int           // Size in bytes of the access log before it is rotated
+	CustomKeys        string        // Actions of the custom keys, action:argument separated by ;
+	EntryActions      string        // Actions of the menu of the selected entry, empty to copy a field
+	Frecency          bool          // Sort the entries by how often and recently they are used
 }
 
 // ConfigurationExecutable is the sub-structure of the configuration related to tools executed by kpmenu
@@ -42,11 +55,13 @@ type ConfigurationExecutable struct {
 	CustomPromptMenu       string // Custom executable for prompt menu
 	CustomPromptEntries    string // Custom executable for prompt entries
 	CustomPromptFields     string // Custom executable for prompt fields
+	CustomPromptInput      string // Custom executable for prompt of values to write
 	CustomClipboardCopy    string // Custom executable for clipboard copy
 	CustomClipboardPaste   string // Custom executable for clipboard paste
 	CustomClipboardClean   string // Custom executable for clipboard clean
 	CustomAutotypeWindowID string // Custom executable for fetching title of active window
 	CustomAutotypeTyper    string // Custom executable for typing results
+	CustomQRViewer         string // Image viewer of the QR codes, it must exit when closed
 }
 
 // ConfigurationStyle is the sub-structure of the configuration related to style of dmenu
@@ -61,32 +76,55 @@ type ConfigurationStyle struct {
 	ArgsMenu           string
 	ArgsEntry          string
 	ArgsField          string
+	NoIcons            bool
 }
 
 // ConfigurationDatabase is the sub-structure of the configuration related to database settings
 type ConfigurationDatabase struct {
-	Database        string
-	KeyFile         string
-	KeyFileData     string
-	Password        string
-	FieldOrder      string
-	FillOtherFields bool
-	FillBlacklist   string
+	Database            string
+	DatabaseLabel       string
+	Databases           string
+	KeyFile             string
+	KeyFileData         string
+	Password            string
+	PasswordCommand     string
+	CredentialProviders string
+	SessionTimeout      time.Duration
+	FieldOrder          string
+	FillOtherFields     bool
+	FillBlacklist       string
+}
+
+// DatabaseSource identifies a database file and how to unlock it
+type DatabaseSource struct {
+	Label       string // Prefix of the entries of the database, when more databases are used
+	Database    string // Path to the database
+	KeyFile     string // Path to the keyfile
+	KeyFileData string // Command or file retrieving the key data
 }
 
 // Flags is the sub-structure of the configuration used to handle flags that aren't into the config file
 type Flags struct {
-	Daemon   bool
-	Version  bool
-	Autotype bool
+	Daemon        bool
+	Version       bool
+	Autotype      bool
+	Tag           string // Only list the entries with this tag
+	Json          bool   // Print the output of commands as JSON
+	BreachedIndex bool   // Build the index of the breached passwords file
+	Entry         string // Only print the log records of this entry
+	Since         string // Only print the log records after this time
 }
 
 // Menu tools used for prompts
 const (
-	PromptDmenu  = "dmenu"
-	PromptRofi   = "rofi"
-	PromptWofi   = "wofi"
-	PromptCustom = "custom"
+	PromptDmenu    = "dmenu"
+	PromptRofi     = "rofi"
+	PromptWofi     = "wofi"
+	PromptBemenu   = "bemenu"
+	PromptFuzzel   = "fuzzel"
+	PromptTofi     = "tofi"
+	PromptTerminal = "terminal"
+	PromptCustom   = "custom"
 )
 
 // Clipboard tools used for clipboard manager
@@ -96,12 +134,18 @@ const (
 	ClipboardToolCustom      = "custom"
 )
 
+// DefaultGeneratorOptions are the options of the default password generator profile
+const DefaultGeneratorOptions = "length=20,classes=ulds,require=uld"
+
 // Autotype default helpers
 const (
 	AutotypeWindowIdentifier = ""
 	AutotypeTyper            = ""
 )
 
+// QRViewer is the default image viewer of the QR codes
+const QRViewer = "feh"
+
 // NewConfiguration initializes a new Configuration pointer
 func NewConfiguration() *Configuration {
 	return &Configuration{
@@ -110,6 +154,11 @@ func NewConfiguration() *Configuration {
 			ClipboardTool:    ClipboardToolXsel,
 			ClipboardTimeout: 15 * time.Second,
 			CacheTimeout:     60 * time.Second,
+			GeneratorDefault: DefaultGeneratorOptions,
+			AuditMinEntropy:  60,
+			AuditMaxAge:      365 * 24 * time.Hour,
+			AccessLogMaxSize: 1 << 20,
+			CustomKeys:       DefaultKeyActions,
 		},
 		Style: ConfigurationStyle{
 			PasswordBackground: "black",
@@ -120,12 +169,14 @@ func NewConfiguration() *Configuration {
 			FormatEntry:        "{Title} - {UserName}",
 		},
 		Database: ConfigurationDatabase{
-			FieldOrder:      "Password UserName URL",
-			FillOtherFields: true,
+			CredentialProviders: DefaultCredentialProviders,
+			FieldOrder:          "Password UserName URL",
+			FillOtherFields:     true,
 		},
 		Executable: ConfigurationExecutable{
 			CustomAutotypeWindowID: AutotypeWindowIdentifier,
 			CustomAutotypeTyper:    AutotypeTyper,
+			CustomQRViewer:         QRViewer,
 		},
 	}
 }
@@ -156,31 +207,50 @@ func InitializeFlags(args []string) *claptrap.CommandConfig {
 	reg.Add("--daemon", false, "Start kpmenu directly as daemon")
 	reg.Add("--version", "-v", false, "Show kpmenu version")
 	reg.Add("--autotype", false, "Initiate autotype")
+	reg.Add("--tag", "", "Only list the entries with this tag")
+	reg.Add("--json", false, "Print the output of commands as JSON")
+	reg.Add("--breachedIndex", false, "Build the index of the breached passwords file, for faster audits")
+	reg.Add("--entry", "", "Only print the access log records of this entry (UUID or part of the title)")
+	reg.Add("--since", "", "Only print the access log records after this time (e.g. 24h, 2024-01-31)")
 	reg.Add("--quit", "-q", "Exit the daemon if it is running")
 	reg.Add("--help", "-h", "Print help and exit")
 
 	// General
-	reg.Add("--menu", "-m", PromptDmenu, "Choose which menu to use")                                                   // &c.General.Menu
-	reg.Add("--clipboardTool", ClipboardToolXsel, "Choose which clipboard tool to use")                                // &c.General.ClipboardTool
-	reg.Add("--clipboardTimeout", "-c", 15*time.Second, "Timeout of clipboard in seconds (0 = no timeout)")            // &c.General.ClipboardTimeout
-	reg.Add("--nocache", "-n", false, "Disable caching of database")                                                   // &c.General.NoCache
-	reg.Add("--cacheOneTime", false, "Cache the database only the first time")                                         // &c.General.CacheOneTime
-	reg.Add("--cacheTimeout", 60*time.Second, "Timeout of cache in seconds")                                           // &c.General.CacheTimeout
-	reg.Add("--nootp", false, "Disable OTP handling")                                                                  // &c.General.NoOTP
-	reg.Add("--noautotype", false, "Disable autotype handling")                                                        // &c.General.DisableAutotype
-	reg.Add("--autotypeConfirm", false, "Always confirm autotype, even when there's only 1 selection")                 // &c.General.AutotypeConfirm
-	reg.Add("--autotypeNoAuto", false, "Prompt for autotype entry instead of trying to detect by active window title") // &c.General.AutotypeNoAuto
-	reg.Add("--autotypeSequence", "", "auto type sequence demo:{USERNAME}{PASSWORD}")                                  // &c.General.AutotypeSequence
+	reg.Add("--menu", "-m", PromptDmenu, "Choose which menu to use: dmenu, rofi, wofi, bemenu, fuzzel, tofi, terminal, custom")  // &c.General.Menu
+	reg.Add("--clipboardTool", ClipboardToolXsel, "Choose which clipboard tool to use")                                          // &c.General.ClipboardTool
+	reg.Add("--clipboardTimeout", "-c", 15*time.Second, "Timeout of clipboard in seconds (0 = no timeout)")                      // &c.General.ClipboardTimeout
+	reg.Add("--nocache", "-n", false, "Disable caching of database")                                                             // &c.General.NoCache
+	reg.Add("--cacheOneTime", false, "Cache the database only the first time")                                                   // &c.General.CacheOneTime
+	reg.Add("--cacheTimeout", 60*time.Second, "Timeout of cache in seconds")                                                     // &c.General.CacheTimeout
+	reg.Add("--nowatch", false, "Disable reloading the cached database when its file changes")                                   // &c.General.NoWatch
+	reg.Add("--autoMerge", false, "Merge sync conflict copies of the database into it when they appear")                         // &c.General.AutoMerge
+	reg.Add("--nootp", false, "Disable OTP handling")                                                                            // &c.General.NoOTP
+	reg.Add("--noautotype", false, "Disable autotype handling")                                                                  // &c.General.DisableAutotype
+	reg.Add("--autotypeConfirm", false, "Always confirm autotype, even when there's only 1 selection")                           // &c.General.AutotypeConfirm
+	reg.Add("--autotypeNoAuto", false, "Prompt for autotype entry instead of trying to detect by active window title")           // &c.General.AutotypeNoAuto
+	reg.Add("--autotypeSequence", "", "auto type sequence demo:{USERNAME}{PASSWORD}")                                            // &c.General.AutotypeSequence
+	reg.Add("--generatorDefault", DefaultGeneratorOptions, "Options of the default password generator profile")                  // &c.General.GeneratorDefault
+	reg.Add("--generatorProfiles", "", "Password generator profiles, e.g. pin:length=6,classes=d;phrase:words=6")                // &c.General.GeneratorProfiles
+	reg.Add("--auditMinEntropy", 60, "Passwords with less bits of entropy are reported as weak by the audit")                    // &c.General.AuditMinEntropy
+	reg.Add("--auditMaxAge", 365*24*time.Hour, "Passwords unchanged for longer are reported as old by the audit (0 = no limit)") // &c.General.AuditMaxAge
+	reg.Add("--breached", "", "Pwned passwords file (SHA-1, ordered by hash) checked by the audit")                              // &c.General.Breached
+	reg.Add("--accessLog", "", "Log the copies, autotypes and OTPs of entries into this file (never the values)")                // &c.General.AccessLog
+	reg.Add("--accessLogMaxSize", 1<<20, "Size in bytes of the access log before it is rotated")                                 // &c.General.AccessLogMaxSize
+	reg.Add("--customKeys", DefaultKeyActions, "Custom key actions, ; separated (\\; escaped): copy:Field, type:{SEQ}, command") // &c.General.CustomKeys
+	reg.Add("--entryActions", "", "Menu of actions of the selected entry, e.g. fields;autotype;url;notes")                       // &c.General.EntryActions
+	reg.Add("--frecency", false, "Sort the entries by use, the most frequent and recent first")                                  // &c.General.Frecency
 
 	// Executable
 	reg.Add("--customPromptPassword", "", "Custom executable for prompt password")                                                // &c.Executable.CustomPromptPassword
 	reg.Add("--customPromptMenu", "", "Custom executable for prompt menu")                                                        // &c.Executable.CustomPromptMenu
 	reg.Add("--customPromptEntries", "", "Custom executable for prompt entries")                                                  // &c.Executable.CustomPromptEntries
 	reg.Add("--customPromptFields", "", "Custom executable for prompt fields")                                                    // &c.Executable.CustomPromptFields
+	reg.Add("--customPromptInput", "", "Custom executable for prompt of values to write (default customPromptFields)")            // &c.Executable.CustomPromptInput
 	reg.Add("--customClipboardCopy", "", "Custom executable for clipboard copy")                                                  // &c.Executable.CustomClipboardCopy
 	reg.Add("--customClipboardPaste", "", "Custom executable for clipboard paste")                                                // &c.Executable.CustomClipboardPaste
 	reg.Add("--customAutotypeWindowID", AutotypeWindowIdentifier, "Custom executable for identifying active window for autotype") // &c.Executable.CustomAutotypeWindowID
 	reg.Add("--customAutotypeTyper", AutotypeTyper, "Custom executable for autotype typer")                                       // &c.Executable.CustomAutotypeTyper
+	reg.Add("--customQRViewer", QRViewer, "Image viewer of QR codes, the image is deleted when it exits")                         // &c.Executable.CustomQRViewer
 	reg.Add("--customClipboardClean", "", "Custom executable for clipboard clean")                                                // &c.Executable.CustomClipboardClean
 
 	// Style
@@ -193,13 +263,19 @@ func InitializeFlags(args []string) *claptrap.CommandConfig {
 	reg.Add("--argsMenu", "", "Additional arguments for dmenu at menu selection, separated by a space")                                 // &c.Style.ArgsMenu
 	reg.Add("--argsEntry", "", "Additional arguments for dmenu at entry selection, separated by a space")                               // &c.Style.ArgsEntry
 	reg.Add("--argsField", "", "Additional arguments for dmenu at field selection, separated by a space")                               // &c.Style.ArgsField
-	reg.Add("--formatEntry", "{Title} - {UserName}", "Template for the entry list")
+	reg.Add("--formatEntry", "{Title} - {UserName}", "Template of the entries, e.g. {Title:30} {UserName|-}{?OTP} [2FA]{/}")
+	reg.Add("--noIcons", false, "Hide the icons of the entries in the menus supporting them (rofi, fuzzel)") // &c.Style.NoIcons
 
 	// Database
 	reg.Add("--database", "-d", "", "Path to the KeePass database")                                                                                                                           // &c.Database.Database
+	reg.Add("--databaseLabel", "", "Label of the database, shown before its entries when more databases are used")                                                                            // &c.Database.DatabaseLabel
+	reg.Add("--databases", "", "Additional databases, separated by ; or newlines, e.g. label=work database=work.kdbx keyFile=work.key keyFileData='ykchalresp -2 -H %salt'")                  // &c.Database.Databases
 	reg.Add("--keyFileData", "-y", "", "Retrieve key file data from the specified command. The output of this command must be in hexadecimal format, for example: ykchalresp -x -2 -H %salt") // &c.Database.KeyFileData
 	reg.Add("--keyFile", "-k", "", "Path to the database keyfile")                                                                                                                            // &c.Database.KeyFile
 	reg.Add("--password", "-p", "", "Password of the database")                                                                                                                               // &c.Database.Password
+	reg.Add("--passwordCommand", "", "Command printing the password of the databases, %database and %name are replaced by their path and name, e.g. pass show %name")                         // &c.Database.PasswordCommand
+	reg.Add("--credentialProviders", DefaultCredentialProviders, "Sources of the credentials tried in order: config, command, keyring, systemd-creds, fd, prompt, session")                   // &c.Database.CredentialProviders
+	reg.Add("--sessionTimeout", time.Duration(0), "Keep the key of unlocked databases in the kernel session keyring for this time (0 = disabled)")                                            // &c.Database.SessionTimeout
 	reg.Add("--fieldOrder", "Password UserName URL", "String order of fields to show on field selection")                                                                                     // &c.Database.FieldOrder
 	reg.Add("--fillOtherFields", false, "Enable fill of remaining fields")                                                                                                                    // &c.Database.FillOtherFields
 	reg.Add("--fillBlacklist", "", "String of blacklisted fields that won't be shown")                                                                                                        // &c.Database.FillBlacklist
@@ -207,6 +283,81 @@ func InitializeFlags(args []string) *claptrap.CommandConfig {
 	return reg
 }
 
+// DatabaseSources returns the main database followed by the additional ones.
+// Every additional database is written as space separated key=value options
+// (label, database, keyFile, keyFileData), quoted like a shell command.
+func (c *Configuration) DatabaseSources() ([]DatabaseSource, error) {
+	var sources []DatabaseSource
+	if c.Database.Database != "" {
+		sources = append(sources, DatabaseSource{
+			Label:       c.Database.DatabaseLabel,
+			Database:    c.Database.Database,
+			KeyFile:     c.Database.KeyFile,
+			KeyFileData: c.Database.KeyFileData,
+		})
+	}
+
+	for _, spec := range splitDatabases(c.Database.Databases) {
+		options, err := shlex.Split(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid database %q: %v", spec, err)
+		}
+		if len(options) == 0 {
+			continue
+		}
+		var source DatabaseSource
+		for _, option := range options {
+			key, value, _ := strings.Cut(option, "=")
+			switch strings.ToLower(key) {
+			case "label":
+				source.Label = value
+			case "database":
+				source.Database = value
+			case "keyfile":
+				source.KeyFile = value
+			case "keyfiledata":
+				source.KeyFileData = value
+			default:
+				return nil, fmt.Errorf("invalid database %q: unknown option %q", spec, key)
+			}
+		}
+		if source.Database == "" {
+			return nil, fmt.Errorf("invalid database %q: database path is missing", spec)
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// splitDatabases splits the databases on the semicolons and the newlines, unless quoted or escaped
+// as shlex would parse them, so that a quoted path may contain a semicolon
+func splitDatabases(databases string) []string {
+	var specs []string
+	var spec strings.Builder
+	var quote rune
+	escaped := false
+	for _, r := range databases {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == ';' || r == '\n':
+			specs = append(specs, spec.String())
+			spec.Reset()
+			continue
+		}
+		spec.WriteRune(r)
+	}
+	return append(specs, spec.String())
+}
+
 // LoadConfig loads the configuration into Configuration
 func LoadConfig(reg *claptrap.CommandConfig, conf *Configuration) error {
 	// FIXME might have to manually load the config, b/c of the differences in config serialization
@@ -0,0 +1,41 @@
+package kpmenulib
+
+import "testing"
+
+func TestDatabaseSources(t *testing.T) {
+	cfg := NewConfiguration()
+	cfg.Database.Database = "main.kdbx"
+	cfg.Database.KeyFile = "main.key"
+	cfg.Database.Databases = `label=work database=work.kdbx keyFileData='ykchalresp -2 -H %salt'
+		database=home.kdbx keyFile=home.key; label="two words" database=other.kdbx
+		database="a;b.kdbx"; database=c\;d.kdbx keyFileData='cmd; %salt'`
+
+	sources, err := cfg.DatabaseSources()
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	expected := []DatabaseSource{
+		{Database: "main.kdbx", KeyFile: "main.key"},
+		{Label: "work", Database: "work.kdbx", KeyFileData: "ykchalresp -2 -H %salt"},
+		{Database: "home.kdbx", KeyFile: "home.key"},
+		{Label: "two words", Database: "other.kdbx"},
+		// Quoted or escaped semicolons are part of the options
+		{Database: "a;b.kdbx"},
+		{Database: "c;d.kdbx", KeyFileData: "cmd; %salt"},
+	}
+	if len(sources) != len(expected) {
+		t.Fatalf("expected %d databases, got %v", len(expected), sources)
+	}
+	for i := range expected {
+		if sources[i] != expected[i] {
+			t.Errorf("expected %#v, got %#v", expected[i], sources[i])
+		}
+	}
+
+	for _, spec := range []string{"label=x", "database=x unknown=y", "database='x"} {
+		cfg.Database.Databases = spec
+		if _, err := cfg.DatabaseSources(); err == nil {
+			t.Errorf("expected an error for %q", spec)
+		}
+	}
+}
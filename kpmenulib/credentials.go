@@ -0,0 +1,251 @@
+package kpmenulib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Credential providers, tried in the order of credentialProviders until one unlocks the database
+const (
+	ProviderConfig  = "config"        // --password, for the main database only
+	ProviderCommand = "command"       // Output of passwordCommand
+	ProviderKeyring = "keyring"       // User keys of the kernel keyring
+	ProviderSystemd = "systemd-creds" // Credentials of the systemd service, in $CREDENTIALS_DIRECTORY
+	ProviderFD      = "fd"            // File descriptor given by $KPMENU_PASSWORD_FD, read once
+	ProviderPrompt  = "prompt"        // Password prompt
+	ProviderSession = "session"       // Key stored in the session keyring by a previous unlock, see sessionTimeout
+)
+
+// DefaultCredentialProviders keeps the password of the configuration before the prompt
+const DefaultCredentialProviders = ProviderConfig + " " + ProviderPrompt
+
+// PasswordFDVariable is the environment variable with the file descriptor read by the fd provider
+const PasswordFDVariable = "KPMENU_PASSWORD_FD"
+
+// Kinds of credentials, see credentialName
+const (
+	credentialPassword = "password"
+	credentialKeyFile  = "keyfile"
+	credentialKeyData  = "keydata"
+)
+
+// ErrNoCredentials is returned by providers without credentials for a database
+var ErrNoCredentials = errors.New("no credentials available")
+
+// errCredentialsCancelled stops the provider chain when the user cancels the prompt
+var errCredentialsCancelled = errors.New("user cancelled password prompt")
+
+// Credentials are the secrets unlocking a database.
+// Missing key file and key data are taken from the database configuration.
+type Credentials struct {
+	Password string
+	KeyFile  []byte // Content of the key file
+	KeyData  []byte // Key data, as output by keyFileData
+	Key      []byte // Composite key material, replacing any other credential
+	BaseKey  []byte // Composite key material of the password and the key file, the key data is added
+}
+
+type credentialProvider func(m *Menu, db *Database) (Credentials, error)
+
+var credentialProviders = map[string]credentialProvider{
+	ProviderConfig:  configCredentials,
+	ProviderCommand: commandCredentials,
+	ProviderKeyring: keyringCredentials,
+	ProviderSystemd: systemdCredentials,
+	ProviderFD:      fdCredentials,
+	ProviderPrompt:  promptCredentials,
+	ProviderSession: sessionCredentials,
+}
+
+// validateCredentialProviders checks the names of the providers of the chain
+func validateCredentialProviders(providers string) error {
+	names := strings.Fields(providers)
+	if len(names) == 0 {
+		return errors.New("at least a credential provider is needed")
+	}
+	for _, name := range names {
+		if _, ok := credentialProviders[name]; !ok {
+			return fmt.Errorf("unknown credential provider %q", name)
+		}
+	}
+	return nil
+}
+
+// credentialChain returns the providers to try, the session key comes first when sessionTimeout
+// is set unless its position is given
+func credentialChain(config *Configuration) []string {
+	names := strings.Fields(config.Database.CredentialProviders)
+	if config.Database.SessionTimeout > 0 && !contains(names, ProviderSession) {
+		names = append([]string{ProviderSession}, names...)
+	}
+	return names
+}
+
+// credentialName names the credentials of a kind for the database: kpmenu-<kind> for the
+// main database, kpmenu-<kind>-<name> for the other ones, where name is the label or file name.
+func credentialName(m *Menu, db *Database, kind string) string {
+	if db == m.Database {
+		return "kpmenu-" + kind
+	}
+	return fmt.Sprintf("kpmenu-%s-%s", kind, db.Name())
+}
+
+// sessionKeyName names the session key of the database after its absolute path: the key of a
+// database never unlocks another one, whichever is the main database
+func sessionKeyName(db *Database) string {
+	path, err := filepath.Abs(db.Source.Database)
+	if err != nil {
+		path = db.Source.Database
+	}
+	hash := sha256.Sum256([]byte(path))
+	return "kpmenu-session-" + hex.EncodeToString(hash[:8])
+}
+
+func configCredentials(m *Menu, db *Database) (Credentials, error) {
+	if db != m.Database || m.password == "" {
+		return Credentials{}, ErrNoCredentials
+	}
+	return Credentials{Password: m.password}, nil
+}
+
+// commandCredentials runs passwordCommand, %database is replaced by the path of the database
+// and %name by its name. The last newline of the output is removed.
+func commandCredentials(m *Menu, db *Database) (Credentials, error) {
+	if m.Configuration.Database.PasswordCommand == "" {
+		return Credentials{}, ErrNoCredentials
+	}
+	cmd := strings.ReplaceAll(m.Configuration.Database.PasswordCommand, "%database", db.Source.Database)
+	cmd = strings.ReplaceAll(cmd, "%name", db.Name())
+	output, err := run("sh", "", "-c", cmd)
+	defer wipe(output)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("password command failed: %v", err)
+	}
+	password := strings.TrimSuffix(string(output), "\n")
+	if password == "" {
+		return Credentials{}, errors.New("password command returned an empty password")
+	}
+	return Credentials{Password: password}, nil
+}
+
+// keyringCredentials reads the user keys named as credentialName, e.g. added with
+//
+//	keyctl padd user kpmenu-password @u
+func keyringCredentials(m *Menu, db *Database) (Credentials, error) {
+	return lookupCredentials(m, db, func(name string) ([]byte, error) {
+		id, err := keyringSearch(name)
+		if err != nil {
+			return nil, nil
+		}
+		return keyringRead(id)
+	})
+}
+
+// systemdCredentials reads the credentials named as credentialName, passed to the service by
+// LoadCredential= or LoadCredentialEncrypted= (see systemd-creds)
+func systemdCredentials(m *Menu, db *Database) (Credentials, error) {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return Credentials{}, ErrNoCredentials
+	}
+	return lookupCredentials(m, db, func(name string) ([]byte, error) {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return data, err
+	})
+}
+
+// lookupCredentials gets every kind of credentials with lookup, which returns nil if missing
+func lookupCredentials(m *Menu, db *Database, lookup func(name string) ([]byte, error)) (Credentials, error) {
+	var credentials Credentials
+	password, err := lookup(credentialName(m, db, credentialPassword))
+	if err != nil {
+		return credentials, err
+	}
+	credentials.Password = strings.TrimSuffix(string(password), "\n")
+	wipe(password)
+	if credentials.KeyFile, err = lookup(credentialName(m, db, credentialKeyFile)); err != nil {
+		return credentials, err
+	}
+	if credentials.KeyData, err = lookup(credentialName(m, db, credentialKeyData)); err != nil {
+		return credentials, err
+	}
+	if credentials.Password == "" && credentials.KeyFile == nil && credentials.KeyData == nil {
+		return credentials, ErrNoCredentials
+	}
+	return credentials, nil
+}
+
+// fdCredentials reads the password from the file descriptor of $KPMENU_PASSWORD_FD,
+// the variable is removed so that it is read only once
+func fdCredentials(m *Menu, db *Database) (Credentials, error) {
+	value := os.Getenv(PasswordFDVariable)
+	if value == "" {
+		return Credentials{}, ErrNoCredentials
+	}
+	os.Unsetenv(PasswordFDVariable)
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("invalid %s: %v", PasswordFDVariable, err)
+	}
+	file := os.NewFile(uintptr(fd), "password")
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	defer wipe(data)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("failed to read password from %s: %v", PasswordFDVariable, err)
+	}
+	return Credentials{Password: strings.TrimSuffix(string(data), "\n")}, nil
+}
+
+func promptCredentials(m *Menu, db *Database) (Credentials, error) {
+	password, err := PromptPassword(m, db)
+	if err.Cancelled {
+		return Credentials{}, errCredentialsCancelled
+	}
+	if err.Error != nil {
+		return Credentials{}, fmt.Errorf("failed to get password from dmenu: %v", err.Error)
+	}
+	return Credentials{Password: password}, nil
+}
+
+// sessionCredentials reads the key stored by storeSessionKey
+func sessionCredentials(m *Menu, db *Database) (Credentials, error) {
+	id, err := keyringSearch(sessionKeyName(db))
+	if err != nil {
+		return Credentials{}, ErrNoCredentials
+	}
+	key, err := keyringRead(id)
+	if err != nil {
+		return Credentials{}, err
+	}
+	return Credentials{Key: key}, nil
+}
+
+// storeSessionKey stores the composite key material of the unlocked database in the session
+// keyring, so that the next processes of the session unlock it without credentials until the
+// kernel removes the key after sessionTimeout
+func storeSessionKey(m *Menu, db *Database) error {
+	if db.key == nil {
+		return errors.New("the database is not unlocked")
+	}
+	return keyringAdd(sessionKeyName(db), db.key.Bytes(), m.Configuration.Database.SessionTimeout)
+}
+
+// forgetSessionKey removes the session key of the database, it returns false if there was none
+func forgetSessionKey(m *Menu, db *Database) (bool, error) {
+	id, err := keyringSearch(sessionKeyName(db))
+	if err != nil {
+		return false, nil
+	}
+	return true, keyringRemove(id)
+}
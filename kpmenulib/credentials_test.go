@@ -0,0 +1,135 @@
+package kpmenulib
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCredentialProviders(t *testing.T) {
+	cfg, _ := newTestDatabase(t)
+	cfg.General.NoWatch = true
+	dir := t.TempDir()
+	t.Setenv("CREDENTIALS_DIRECTORY", dir)
+	if err := os.WriteFile(filepath.Join(dir, "kpmenu-password"), []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// A wrong password falls through to the next provider
+	cfg.Database.PasswordCommand = "echo wrong"
+	cfg.Database.CredentialProviders = "config command systemd-creds"
+	db := NewDatabase(DatabaseSource{Database: cfg.Database.Database})
+	menu := &Menu{Configuration: cfg, Database: db, Databases: []*Database{db}}
+	if err := menu.UnlockDatabase(db); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if !db.Loaded || db.Provider != ProviderSystemd || len(db.Entries) != 1 {
+		t.Errorf("expected the database to be unlocked by %s, got %q", ProviderSystemd, db.Provider)
+	}
+	// mlock may not be allowed, the report follows the key
+	if locked := menu.MemoryProtection().KeyLocked; locked != db.key.locked {
+		t.Errorf("expected mlock %t to be reported, got %t", db.key.locked, locked)
+	}
+	db.Lock()
+	if menu.MemoryProtection().KeyLocked {
+		t.Error("expected no key locked in memory without unlocked database")
+	}
+}
+
+func TestFDCredentials(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteString("secret\n")
+	w.Close()
+	// The descriptor is closed once read
+	fd, err := syscall.Dup(int(r.Fd()))
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(PasswordFDVariable, strconv.Itoa(fd))
+
+	credentials, err := fdCredentials(nil, nil)
+	if err != nil || credentials.Password != "secret" {
+		t.Errorf("expected password %q, got %q (%v)", "secret", credentials.Password, err)
+	}
+	// Read only once
+	if _, err := fdCredentials(nil, nil); err != ErrNoCredentials {
+		t.Errorf("expected %v, got %v", ErrNoCredentials, err)
+	}
+}
+
+func TestSessionKey(t *testing.T) {
+	cfg, _ := newTestDatabase(t)
+	cfg.General.NoWatch = true
+	dir := t.TempDir()
+	t.Setenv("CREDENTIALS_DIRECTORY", dir)
+	// Not the main database, so that the key is named after the label
+	label := "test-" + strconv.Itoa(os.Getpid())
+	if err := os.WriteFile(filepath.Join(dir, "kpmenu-password-"+label), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Database.CredentialProviders = ProviderSystemd
+	cfg.Database.SessionTimeout = time.Minute
+	db := NewDatabase(DatabaseSource{Label: label, Database: cfg.Database.Database})
+	menu := &Menu{Configuration: cfg, Database: NewDatabase(DatabaseSource{}), Databases: []*Database{db}}
+	if err := menu.UnlockDatabase(db); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if _, err := keyringSearch(sessionKeyName(db)); err != nil {
+		t.Skipf("session keyring not available: %v", err)
+	}
+	defer forgetSessionKey(menu, db)
+
+	// The next unlock only needs the session key
+	db.Lock()
+	t.Setenv("CREDENTIALS_DIRECTORY", "")
+	if err := menu.UnlockDatabase(db); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if db.Provider != ProviderSession || len(db.Entries) != 1 {
+		t.Errorf("expected the database to be unlocked by %s, got %q", ProviderSession, db.Provider)
+	}
+
+	if found, err := forgetSessionKey(menu, db); !found || err != nil {
+		t.Errorf("expected the session key to be removed, got %v %v", found, err)
+	}
+	if _, err := sessionCredentials(menu, db); err != ErrNoCredentials {
+		t.Errorf("expected %v, got %v", ErrNoCredentials, err)
+	}
+}
+
+func TestSessionKeyName(t *testing.T) {
+	wd, _ := os.Getwd()
+	relative := NewDatabase(DatabaseSource{Database: "test.kdbx"})
+	absolute := NewDatabase(DatabaseSource{Label: "test", Database: filepath.Join(wd, "test.kdbx")})
+	other := NewDatabase(DatabaseSource{Database: "other.kdbx"})
+	// Named after the file, whichever database is the main one
+	if sessionKeyName(relative) != sessionKeyName(absolute) {
+		t.Errorf("expected the same key for the same file, got %s and %s", sessionKeyName(relative), sessionKeyName(absolute))
+	}
+	if sessionKeyName(relative) == sessionKeyName(other) {
+		t.Errorf("expected another key for another file, got %s", sessionKeyName(other))
+	}
+}
+
+func TestSessionTimeoutSeconds(t *testing.T) {
+	cfg := NewConfiguration()
+	cfg.Database.Database = "test.kdbx"
+	cfg.Database.SessionTimeout = 500 * time.Millisecond
+	// The kernel would never expire the key
+	if err := validateConfig(cfg); err == nil || !strings.Contains(err.Error(), "session timeout") {
+		t.Errorf("expected a timeout of less than a second to be refused, got %v", err)
+	}
+	cfg.Database.SessionTimeout = time.Second
+	if err := validateConfig(cfg); err != nil && strings.Contains(err.Error(), "session timeout") {
+		t.Errorf("expected a timeout of a second to be accepted, got %v", err)
+	}
+}
@@ -1,110 +1,572 @@
 package kpmenulib
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/tobischo/gokeepasslib/v3"
+	w "github.com/tobischo/gokeepasslib/v3/wrappers"
 )
 
+// ErrDatabaseChanged is returned when saving a database whose file was modified after it was loaded
+var ErrDatabaseChanged = errors.New("the database file changed on disk since it was loaded, reload it and retry")
+
 // Database contains the KeePass database and its entry list
 type Database struct {
-	Loaded  bool
-	Keepass *gokeepasslib.Database
-	Entries []Entry
+	Loaded    bool
+	Source    DatabaseSource
+	Keepass   *gokeepasslib.Database
+	Entries   []Entry
+	Provider  string            // Credential provider which unlocked the database
+	digest    [sha256.Size]byte // Hash of the file content the database was decoded from
+	stopWatch func()            // Stops watching the database file, nil if not watching
+	key       *secretBuffer     // Composite key material of the credentials
+	values    []byte            // Protected values of the entries, see protectValues
 }
 
 // Entry is a container for keepass entry
 type Entry struct {
 	UUID      gokeepasslib.UUID
 	FullEntry gokeepasslib.Entry
+	Database  *Database // Database containing the entry
+	Group     string    // Path of the group containing the entry, e.g. Root/Work
+}
+
+// Tags returns the tags of the entry.
+// KeePass separates tags with ;, KeePassXC accepts , too
+func (e Entry) Tags() []string {
+	var tags []string
+	for _, tag := range strings.FieldsFunc(e.FullEntry.Tags, func(r rune) bool { return r == ';' || r == ',' }) {
+		if tag = strings.TrimSpace(tag); tag != "" && !containsFold(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// HasTag tells if the entry has the tag, ignoring the case
+func (e Entry) HasTag(tag string) bool {
+	return containsFold(e.Tags(), tag)
 }
 
 // NewDatabase initializes the Database struct
-func NewDatabase() *Database {
+func NewDatabase(source DatabaseSource) *Database {
 	return &Database{
 		Loaded:  false,
+		Source:  source,
 		Keepass: gokeepasslib.NewDatabase(),
 	}
 }
 
+// Name returns the label of the database, or its file name if not labelled
+func (db *Database) Name() string {
+	if db.Source.Label != "" {
+		return db.Source.Label
+	}
+	return filepath.Base(db.Source.Database)
+}
+
 // AddCredentialsToDatabase adds credentials into gokeepasslib credentials struct
-func (db *Database) AddCredentialsToDatabase(cfg *Configuration, password string, challenge []byte) (err error) {
-	var keyData []byte
-	if cfg.Database.KeyFile != "" {
-		keyData, err = gokeepasslib.ParseKeyFile(cfg.Database.KeyFile)
-	}
-
-	// Get credentials
-	if password != "" && keyData != nil {
-		// Both password & keyfile
-		db.Keepass.Credentials, _ = gokeepasslib.NewPasswordAndKeyDataCredentials(password, keyData)
-		log.Printf("credentials: password + keyfile")
-	} else if password != "" {
-		// Only password
-		db.Keepass.Credentials = gokeepasslib.NewPasswordCredentials(password)
-		log.Printf("credentials: password")
-	} else if keyData != nil {
-		// Only keyfile
-		// db.Keepass.Credentials, _ = gokeepasslib.NewKeyCredentials(cfg.Database.KeyFile)
-		db.Keepass.Credentials, _ = gokeepasslib.NewKeyDataCredentials(keyData)
-		log.Printf("credentials: keyfile ")
-	}
-	if cfg.Database.KeyFileData != "" {
-		if fileExists(cfg.Database.KeyFileData) {
-			keyFileData, _ := gokeepasslib.ParseKeyFile(cfg.Database.KeyFileData)
-			db.Keepass.Credentials.Windows, _ = gokeepasslib.ParseKeyData(keyFileData)
+func (db *Database) AddCredentialsToDatabase(password string, challenge []byte) error {
+	return db.AddCredentials(Credentials{Password: password}, challenge)
+}
+
+// AddCredentials adds credentials into gokeepasslib credentials struct.
+// The key file and the key data of the configuration are used unless provided.
+func (db *Database) AddCredentials(c Credentials, challenge []byte) error {
+	// The composite key material already includes every credential, it is wiped by protectCredentials
+	if c.Key != nil {
+		db.Keepass.Credentials = &gokeepasslib.DBCredentials{Passphrase: c.Key}
+		log.Printf("credentials: session key")
+		return nil
+	}
+
+	credentials := &gokeepasslib.DBCredentials{}
+	var used []string
+	if c.BaseKey != nil {
+		credentials.Passphrase = c.BaseKey
+		used = append(used, "composite key")
+	}
+	if c.Password != "" {
+		hash := sha256.Sum256([]byte(c.Password))
+		credentials.Passphrase = hash[:]
+		used = append(used, "password")
+	}
+	if c.KeyFile != nil {
+		key, format, err := ParseKeyData(c.KeyFile)
+		if err != nil {
+			return &KeyFileError{Path: "provided key file", Format: format, Err: err}
+		}
+		credentials.Key = key
+		used = append(used, fmt.Sprintf("keyfile (%s)", format))
+	} else if db.Source.KeyFile != "" {
+		key, format, err := ReadKeyFile(db.Source.KeyFile)
+		if err != nil {
+			return err
+		}
+		credentials.Key = key
+		used = append(used, fmt.Sprintf("keyfile (%s)", format))
+	}
+	if c.KeyData != nil {
+		key, _, err := ParseKeyData(c.KeyData)
+		if err != nil {
+			return fmt.Errorf("provided key data: %v", err)
+		}
+		credentials.Windows = key
+		used = append(used, "key data")
+	} else if db.Source.KeyFileData != "" {
+		var data []byte
+		if !db.challengeResponse() {
+			key, format, err := ReadKeyFile(db.Source.KeyFileData)
+			if err != nil {
+				return err
+			}
+			data = key
+			used = append(used, fmt.Sprintf("key data file (%s)", format))
 		} else {
-			cmd := strings.ReplaceAll(cfg.Database.KeyFileData, "%salt", hex.EncodeToString(challenge))
-			cmd = strings.ReplaceAll(cmd, "%database", cfg.Database.Database)
-			cmd = strings.ReplaceAll(cmd, "%password", password)
+			cmd := strings.ReplaceAll(db.Source.KeyFileData, "%salt", hex.EncodeToString(challenge))
+			cmd = strings.ReplaceAll(cmd, "%database", db.Source.Database)
+			cmd = strings.ReplaceAll(cmd, "%password", c.Password)
 			// ykchalresp -x -2 -H %salt
-			keyFileData, err := run("sh", "", "-c", cmd)
+			output, err := run("sh", "", "-c", cmd)
 			if err != nil {
-				log.Printf("credentials: keyFileData: %v", err)
-				return err
+				return fmt.Errorf("key data command failed: %v", err)
+			}
+			response, err := hex.DecodeString(strings.TrimSpace(string(output)))
+			if err != nil {
+				return fmt.Errorf("key data command output is not hexadecimal: %v", err)
+			}
+			if data, _, err = ParseKeyData(response); err != nil {
+				return fmt.Errorf("key data command output: %v", err)
 			}
-			keyFileData, _ = hex.DecodeString(string(keyFileData))
-			db.Keepass.Credentials.Windows, _ = gokeepasslib.ParseKeyData(keyFileData)
+			used = append(used, "key data command")
 		}
+		credentials.Windows = data
+	}
+	if len(used) == 0 {
+		return errors.New("no credentials, set a password, a key file or key data")
+	}
+
+	db.Keepass.Credentials = credentials
+	log.Printf("credentials: %s", strings.Join(used, " + "))
+	return nil
+}
+
+// challengeResponse tells if the key data is the output of a command answering the challenge of the file
+func (db *Database) challengeResponse() bool {
+	return db.Source.KeyFileData != "" && !fileExists(db.Source.KeyFileData)
+}
+
+// challenge returns the challenge of challenge-response key data (e.g. a YubiKey):
+// the KDF salt of KDBX 4 databases, the master seed of older ones
+func (db *Database) challenge() []byte {
+	headers := db.Keepass.Header.FileHeaders
+	if headers == nil {
+		return nil
+	}
+	if headers.KdfParameters != nil {
+		return headers.KdfParameters.Salt[:]
 	}
-	return
+	return headers.MasterSeed
 }
-func (db *Database) DeocdeDatabase(cfg *Configuration) error {
+
+// protectCredentials replaces the credentials with their composite key material, held in a
+// locked buffer until the database is locked. The composite key is the SHA-256 of the
+// concatenated hashes of passphrase, key file and key data, so the concatenation is kept
+// as the only component and the plaintext values are not needed anymore.
+// The key derived from it by the KDF is not kept: the decoder of gokeepasslib always derives it,
+// and the KDF salt changes at every save of the file.
+func (db *Database) protectCredentials() error {
+	c := db.Keepass.Credentials
+	if c == nil {
+		return nil
+	}
+	key, err := newSecretBuffer(len(c.Passphrase) + len(c.Key) + len(c.Windows))
+	if err != nil {
+		return err
+	}
+	n := copy(key.Bytes(), c.Passphrase)
+	n += copy(key.Bytes()[n:], c.Key)
+	copy(key.Bytes()[n:], c.Windows)
+	wipe(c.Passphrase)
+	wipe(c.Key)
+	wipe(c.Windows)
+
+	db.key.Destroy()
+	db.key = key
+	db.Keepass.Credentials = &gokeepasslib.DBCredentials{Passphrase: key.Bytes()}
+	return nil
+}
+
+// protectValues moves the protected values of the entries into the buffer of the database,
+// the values of the previous buffer were replaced and are wiped
+func (db *Database) protectValues() {
+	previous := db.values
+	db.values = protectValues(db.Keepass.Content.Root.Groups)
+	wipe(previous)
+}
+
+// Lock wipes the protected values of the entries and the credentials, the database must be unlocked again
+func (db *Database) Lock() {
+	wipe(db.values)
+	db.values = nil
+	db.Loaded = false
+	db.Provider = ""
+	db.Keepass = gokeepasslib.NewDatabase()
+	db.Entries = nil
+	db.digest = [sha256.Size]byte{}
+	db.key.Destroy()
+	db.key = nil
+}
+
+func (db *Database) DeocdeDatabase() error {
 	// Open database file
-	file, err := os.Open(cfg.Database.Database)
+	file, err := os.Open(db.Source.Database)
 	if err == nil {
 		err = gokeepasslib.NewDecoder(file).Decode(db.Keepass)
 	}
 	return err
 }
 
-// OpenDatabase decodes the database with the given configuration
-func (db *Database) OpenDatabase(cfg *Configuration) error {
-	// Open database file
-	file, err := os.Open(cfg.Database.Database)
+// OpenDatabase decodes the database with the added credentials
+func (db *Database) OpenDatabase() error {
+	// Read database file, keeping its hash to detect changes before saving
+	data, err := os.ReadFile(db.Source.Database)
 	if err == nil {
-		err = gokeepasslib.NewDecoder(file).Decode(db.Keepass)
+		err = decodeDatabase(db.Keepass, data)
 		if err == nil {
+			db.digest = sha256.Sum256(data)
 			err = db.Keepass.UnlockProtectedEntries()
 		}
 	}
+	if err == nil {
+		db.protectValues()
+	}
 	return err
 }
 
+// SaveDatabase encodes the database and atomically replaces the database file.
+// It returns ErrDatabaseChanged if the file was modified since it was loaded.
+func (db *Database) SaveDatabase() error {
+	var buf bytes.Buffer
+
+	// The encoder expects locked protected values, unlock them again once done
+	if err := db.Keepass.LockProtectedEntries(); err != nil {
+		return err
+	}
+	err := gokeepasslib.NewEncoder(&buf).Encode(db.Keepass)
+	if errUnlock := db.Keepass.UnlockProtectedEntries(); err == nil {
+		err = errUnlock
+	}
+	db.protectValues()
+	if err != nil {
+		return fmt.Errorf("failed to encode database: %v", err)
+	}
+
+	// Refuse to overwrite changes made by someone else
+	current, err := os.ReadFile(db.Source.Database)
+	if err != nil {
+		return err
+	}
+	if sha256.Sum256(current) != db.digest {
+		return ErrDatabaseChanged
+	}
+
+	if err := writeFileAtomic(db.Source.Database, buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write database: %v", err)
+	}
+	db.digest = sha256.Sum256(buf.Bytes())
+	return nil
+}
+
+// SetEntryField changes the value of a field of the entry identified by uuid and saves the database.
+// The previous state of the entry is kept in its history.
+// If saving fails, the entry is restored.
+func (db *Database) SetEntryField(uuid gokeepasslib.UUID, key, value string) error {
+	entry := db.findEntry(uuid)
+	if entry == nil {
+		return errors.New("entry not found in database")
+	}
+	original := *entry
+
+	// Previous state, histories are not nested
+	previous := original
+	previous.Histories = nil
+
+	// Copy values so that the original (and history) ones are untouched
+	entry.Values = append([]gokeepasslib.ValueData(nil), original.Values...)
+	if i := entry.GetIndex(key); i != -1 {
+		entry.Values[i].Value.Content = value
+	} else {
+		entry.Values = append(entry.Values, gokeepasslib.ValueData{
+			Key: key,
+			Value: gokeepasslib.V{
+				Content:   value,
+				Protected: w.NewBoolWrapper(key == "Password"),
+			},
+		})
+	}
+	db.addHistory(entry, previous)
+	now := w.Now()
+	entry.Times.LastModificationTime = &now
+
+	if err := db.SaveDatabase(); err != nil {
+		*entry = original
+		return err
+	}
+
+	// Refresh the entry list
+	db.IterateDatabase()
+	return nil
+}
+
+// AddEntry adds entry into the group identified by the slash separated groupPath and saves the database.
+// Missing groups are created, a path not starting with a top level group is relative to the first one.
+// Returns the entry added to the entry list.
+func (db *Database) AddEntry(groupPath string, entry gokeepasslib.Entry) (*Entry, error) {
+	groups := &db.Keepass.Content.Root.Groups
+	if len(*groups) == 0 {
+		return nil, errors.New("the database has no root group")
+	}
+	names := splitGroupPath(groupPath)
+	if len(names) == 0 || indexGroup(*groups, names[0]) == -1 {
+		names = append([]string{(*groups)[0].Name}, names...)
+	}
+
+	// undo reverts the first change made to the tree
+	var undo func()
+	var group *gokeepasslib.Group
+	for _, name := range names {
+		i := indexGroup(*groups, name)
+		if i == -1 {
+			if undo == nil {
+				parent, n := groups, len(*groups)
+				undo = func() { *parent = (*parent)[:n] }
+			}
+			newGroup := gokeepasslib.NewGroup()
+			newGroup.Name = name
+			*groups = append(*groups, newGroup)
+			i = len(*groups) - 1
+		}
+		group = &(*groups)[i]
+		groups = &group.Groups
+	}
+	if undo == nil {
+		n := len(group.Entries)
+		undo = func() { group.Entries = group.Entries[:n] }
+	}
+	group.Entries = append(group.Entries, entry)
+
+	if err := db.SaveDatabase(); err != nil {
+		undo()
+		return nil, err
+	}
+
+	// Make it available without iterating the whole database
+	if entry.AutoType.DefaultSequence == "" {
+		entry.AutoType.DefaultSequence = group.DefaultAutoTypeSequence
+	}
+	db.Entries = append(db.Entries, Entry{
+		UUID:      entry.UUID,
+		FullEntry: entry,
+		Database:  db,
+		Group:     strings.Join(names, "/"),
+	})
+	return &db.Entries[len(db.Entries)-1], nil
+}
+
+// GroupPaths returns the slash separated path of every group of the database
+func (db *Database) GroupPaths() []string {
+	var paths []string
+	var walk func(prefix string, groups []gokeepasslib.Group)
+	walk = func(prefix string, groups []gokeepasslib.Group) {
+		for _, g := range groups {
+			path := prefix + g.Name
+			paths = append(paths, path)
+			walk(path+"/", g.Groups)
+		}
+	}
+	walk("", db.Keepass.Content.Root.Groups)
+	return paths
+}
+
+func splitGroupPath(path string) []string {
+	var names []string
+	for _, name := range strings.Split(path, "/") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func indexGroup(groups []gokeepasslib.Group, name string) int {
+	for i := range groups {
+		if groups[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// addHistory pushes previous into the history of entry, honouring the history size of the database
+func (db *Database) addHistory(entry *gokeepasslib.Entry, previous gokeepasslib.Entry) {
+	// Copy the histories, they are shared with previous
+	if len(entry.Histories) == 0 {
+		entry.Histories = []gokeepasslib.History{{}}
+	} else {
+		entry.Histories = append([]gokeepasslib.History(nil), entry.Histories...)
+	}
+	history := &entry.Histories[0]
+	history.Entries = append(append([]gokeepasslib.Entry(nil), history.Entries...), previous)
+
+	// A negative maximum means unlimited history
+	max := db.Keepass.Content.Meta.HistoryMaxItems
+	if max >= 0 && int64(len(history.Entries)) > max {
+		history.Entries = history.Entries[int64(len(history.Entries))-max:]
+	}
+}
+
+// findEntry returns a pointer to the entry identified by uuid into the database tree
+func (db *Database) findEntry(uuid gokeepasslib.UUID) *gokeepasslib.Entry {
+	var find func(groups []gokeepasslib.Group) *gokeepasslib.Entry
+	find = func(groups []gokeepasslib.Group) *gokeepasslib.Entry {
+		for i := range groups {
+			for j := range groups[i].Entries {
+				if groups[i].Entries[j].UUID.Compare(uuid) {
+					return &groups[i].Entries[j]
+				}
+			}
+			if e := find(groups[i].Groups); e != nil {
+				return e
+			}
+		}
+		return nil
+	}
+	return find(db.Keepass.Content.Root.Groups)
+}
+
+// writeFileAtomic writes data into a temporary file next to name, syncs it and
+// renames it over name, so that name is never left partially written
+func writeFileAtomic(name string, data []byte) (err error) {
+	// Replace the target of a symlink, not the symlink itself
+	if target, err := filepath.EvalSymlinks(name); err == nil {
+		name = target
+	}
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(name); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	dir := filepath.Dir(name)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = tmp.Write(data); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(mode); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), name); err != nil {
+		return err
+	}
+
+	// Persist the rename
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Reload decodes the database file again with the current credentials and swaps in its entries.
+// If the file did not change nothing is done, if it can't be decoded the loaded database is kept.
+func (db *Database) Reload() error {
+	data, err := os.ReadFile(db.Source.Database)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(data)
+	if digest == db.digest {
+		return nil
+	}
+
+	keepass := gokeepasslib.NewDatabase()
+	keepass.Credentials = db.Keepass.Credentials
+	if err := decodeDatabase(keepass, data); err != nil {
+		return err
+	}
+	if err := keepass.UnlockProtectedEntries(); err != nil {
+		return err
+	}
+
+	// Nothing refers to the previous values anymore
+	previous := db.values
+	db.values = protectValues(keepass.Content.Root.Groups)
+	db.Keepass = keepass
+	db.Entries = db.iterate(keepass)
+	db.digest = digest
+	wipe(previous)
+	return nil
+}
+
+// ReadAgain decodes the database file again even if it did not change, discarding the changes
+// made in memory only
+func (db *Database) ReadAgain() error {
+	db.digest = [sha256.Size]byte{}
+	return db.Reload()
+}
+
+// decodeDatabase decodes data into keepass.
+// The decoder panics on some malformed files, e.g. truncated ones, the panic is returned as an error.
+func decodeDatabase(keepass *gokeepasslib.Database, data []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed database file: %v", r)
+		}
+	}()
+	return gokeepasslib.NewDecoder(bytes.NewReader(data)).Decode(keepass)
+}
+
 // IterateDatabase iterates the database and makes a list of entries
 func (db *Database) IterateDatabase() {
+	db.Entries = db.iterate(db.Keepass)
+}
+
+func (db *Database) iterate(keepass *gokeepasslib.Database) []Entry {
 	var entries []Entry
-	for _, sub := range db.Keepass.Content.Root.Groups {
-		entries = append(entries, iterateGroup(sub)...)
+	for _, sub := range keepass.Content.Root.Groups {
+		entries = append(entries, db.iterateGroup(sub, "")...)
 	}
-	db.Entries = entries
+	return entries
 }
 
-func iterateGroup(kpGroup gokeepasslib.Group) []Entry {
+func (db *Database) iterateGroup(kpGroup gokeepasslib.Group, prefix string) []Entry {
 	var entries []Entry
+	path := prefix + kpGroup.Name
 	// Get entries of the current group
 	for _, kpEntry := range kpGroup.Entries {
 		// Insert entry
@@ -115,13 +577,15 @@ func iterateGroup(kpGroup gokeepasslib.Group) []Entry {
 		entries = append(entries, Entry{
 			UUID:      kpEntry.UUID,
 			FullEntry: kpEntry,
+			Database:  db,
+			Group:     path,
 		})
 		//(*entries)[uuid] = Entry{FullEntry: kpEntry}
 	}
 
 	// Continue to iterate subgroups
 	for _, sub := range kpGroup.Groups {
-		entries = append(entries, iterateGroup(sub)...)
+		entries = append(entries, db.iterateGroup(sub, path+"/")...)
 	}
 	return entries
 }
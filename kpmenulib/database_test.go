@@ -0,0 +1,263 @@
+package kpmenulib
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tobischo/gokeepasslib/v3"
+	w "github.com/tobischo/gokeepasslib/v3/wrappers"
+)
+
+// newTestDatabase writes a password protected database with a single entry
+// and returns a configuration pointing to it
+func newTestDatabase(t *testing.T) (*Configuration, gokeepasslib.Entry) {
+	t.Helper()
+	entry := gokeepasslib.NewEntry()
+	entry.Values = append(entry.Values,
+		gokeepasslib.ValueData{Key: "Title", Value: gokeepasslib.V{Content: "github"}},
+		gokeepasslib.ValueData{Key: "UserName", Value: gokeepasslib.V{Content: "user"}},
+		gokeepasslib.ValueData{Key: "Password", Value: gokeepasslib.V{Content: "old", Protected: w.NewBoolWrapper(true)}},
+	)
+	group := gokeepasslib.NewGroup()
+	group.Name = "Root"
+	group.Entries = append(group.Entries, entry)
+
+	kp := gokeepasslib.NewDatabase()
+	kp.Credentials = gokeepasslib.NewPasswordCredentials("secret")
+	kp.Content.Root = &gokeepasslib.RootData{Groups: []gokeepasslib.Group{group}}
+	if err := kp.LockProtectedEntries(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := NewConfiguration()
+	cfg.Database.Database = filepath.Join(t.TempDir(), "test.kdbx")
+	file, err := os.Create(cfg.Database.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := gokeepasslib.NewEncoder(file).Encode(kp); err != nil {
+		t.Fatal(err)
+	}
+	return cfg, entry
+}
+
+func openTestDatabase(t *testing.T, cfg *Configuration) *Database {
+	t.Helper()
+	db := NewDatabase(DatabaseSource{Database: cfg.Database.Database})
+	db.Keepass.Credentials = gokeepasslib.NewPasswordCredentials("secret")
+	if err := db.OpenDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	db.IterateDatabase()
+	return db
+}
+
+func TestSetEntryField(t *testing.T) {
+	cfg, entry := newTestDatabase(t)
+	db := openTestDatabase(t, cfg)
+
+	if err := db.SetEntryField(entry.UUID, "Password", "new"); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if got := db.Entries[0].FullEntry.GetPassword(); got != "new" {
+		t.Errorf("expected %q, got %q", "new", got)
+	}
+
+	// Changes must be in the file
+	db = openTestDatabase(t, cfg)
+	e := db.Entries[0].FullEntry
+	if got := e.GetPassword(); got != "new" {
+		t.Errorf("expected %q, got %q", "new", got)
+	}
+	if len(e.Histories) != 1 || len(e.Histories[0].Entries) != 1 {
+		t.Fatalf("expected 1 history entry, got %v", e.Histories)
+	}
+	if got := e.Histories[0].Entries[0].GetPassword(); got != "old" {
+		t.Errorf("expected history password %q, got %q", "old", got)
+	}
+}
+
+func TestSaveDatabaseChanged(t *testing.T) {
+	cfg, entry := newTestDatabase(t)
+	db := openTestDatabase(t, cfg)
+
+	// Someone else writes the file
+	other := openTestDatabase(t, cfg)
+	if err := other.SetEntryField(entry.UUID, "UserName", "other"); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+
+	err := db.SetEntryField(entry.UUID, "Password", "new")
+	if !errors.Is(err, ErrDatabaseChanged) {
+		t.Fatalf("expected %v, got %v", ErrDatabaseChanged, err)
+	}
+	if got := db.Entries[0].FullEntry.GetPassword(); got != "old" {
+		t.Errorf("expected entry to be restored to %q, got %q", "old", got)
+	}
+}
+
+func TestAddEntry(t *testing.T) {
+	cfg, _ := newTestDatabase(t)
+	db := openTestDatabase(t, cfg)
+
+	entry := gokeepasslib.NewEntry()
+	entry.Values = append(entry.Values, gokeepasslib.ValueData{Key: "Title", Value: gokeepasslib.V{Content: "new"}})
+	added, err := db.AddEntry("Web/Mail", entry)
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if added.FullEntry.GetTitle() != "new" || len(db.Entries) != 2 {
+		t.Fatalf("expected the entry to be listed, got %v", db.Entries)
+	}
+	if added.Group != "Root/Web/Mail" {
+		t.Errorf("expected the entry in Root/Web/Mail, got %q", added.Group)
+	}
+
+	// Missing groups are created under the root group
+	db = openTestDatabase(t, cfg)
+	paths := db.GroupPaths()
+	if !contains(paths, "Root/Web/Mail") {
+		t.Errorf("expected group Root/Web/Mail, got %v", paths)
+	}
+	if len(db.Entries) != 2 {
+		t.Errorf("expected 2 entries, got %d", len(db.Entries))
+	}
+}
+
+func TestReload(t *testing.T) {
+	cfg, entry := newTestDatabase(t)
+	db := openTestDatabase(t, cfg)
+
+	other := openTestDatabase(t, cfg)
+	if err := other.SetEntryField(entry.UUID, "UserName", "other"); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if err := db.Reload(); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if got := db.Entries[0].FullEntry.GetContent("UserName"); got != "other" {
+		t.Errorf("expected %q, got %q", "other", got)
+	}
+
+	// A partially written file keeps the loaded database
+	data, err := os.ReadFile(cfg.Database.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cfg.Database.Database, data[:len(data)/2], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Reload(); err == nil {
+		t.Errorf("expected an error reloading a truncated file")
+	}
+	if got := db.Entries[0].FullEntry.GetContent("UserName"); got != "other" {
+		t.Errorf("expected %q, got %q", "other", got)
+	}
+}
+
+func TestWatchFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.kdbx")
+	if err := os.WriteFile(name, []byte("a"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	changes, stop, err := watchFile(name, nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	defer stop()
+
+	// Replace the file like sync tools do
+	if err := writeFileAtomic(name, []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a change to be notified")
+	}
+}
+
+func TestEntryTags(t *testing.T) {
+	e := Entry{FullEntry: gokeepasslib.NewEntry()}
+	e.FullEntry.Tags = "prod; shared,2fa;;Prod"
+	if got := e.Tags(); len(got) != 3 || got[0] != "prod" || got[1] != "shared" || got[2] != "2fa" {
+		t.Errorf("expected [prod shared 2fa], got %v", got)
+	}
+	if !e.HasTag("PROD") || e.HasTag("dev") {
+		t.Errorf("expected tag prod only, got %v", e.Tags())
+	}
+
+	// The --tag filter
+	db := &Database{Loaded: true, Entries: []Entry{e, {FullEntry: gokeepasslib.NewEntry()}}}
+	menu := &Menu{Configuration: NewConfiguration(), Databases: []*Database{db}}
+	if got := len(menu.Entries("")); got != 2 {
+		t.Errorf("expected 2 entries, got %d", got)
+	}
+	if got := len(menu.Entries("shared")); got != 1 {
+		t.Errorf("expected 1 entry, got %d", got)
+	}
+}
+
+func TestProtectCredentials(t *testing.T) {
+	cfg, entry := newTestDatabase(t)
+	db := NewDatabase(DatabaseSource{Database: cfg.Database.Database})
+	if err := db.AddCredentialsToDatabase("secret", nil); err != nil {
+		t.Fatal(err)
+	}
+	passphrase := db.Keepass.Credentials.Passphrase
+	if err := db.protectCredentials(); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if !bytes.Equal(passphrase, make([]byte, len(passphrase))) {
+		t.Errorf("expected the original passphrase hash to be wiped")
+	}
+
+	// The composite key still opens, reloads and saves the database
+	if err := db.OpenDatabase(); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	db.IterateDatabase()
+	if err := db.SetEntryField(entry.UUID, "UserName", "new"); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	openTestDatabase(t, cfg)
+
+	db.Lock()
+	if db.Loaded || db.key != nil || db.Entries != nil {
+		t.Errorf("expected the database to be locked")
+	}
+}
+
+func TestLockWipesSecrets(t *testing.T) {
+	cfg, entry := newTestDatabase(t)
+	db := openTestDatabase(t, cfg)
+	if err := db.protectCredentials(); err != nil {
+		t.Fatal(err)
+	}
+	password := db.Entries[0].FullEntry.GetPassword()
+
+	// Saving keeps the values in the buffer of the database
+	if err := db.SetEntryField(entry.UUID, "UserName", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if password != "\x00\x00\x00" {
+		t.Errorf("expected the previous values to be wiped, got %q", password)
+	}
+	password = db.Entries[0].FullEntry.GetPassword()
+	if password != "old" {
+		t.Fatalf("expected the password to be readable, got %q", password)
+	}
+
+	db.Lock()
+	if password != "\x00\x00\x00" {
+		t.Errorf("expected the password to be wiped, got %q", password)
+	}
+	if db.key != nil || db.Entries != nil {
+		t.Errorf("expected the key and the entries to be dropped")
+	}
+}
@@ -0,0 +1,256 @@
+package kpmenulib
+
+import (
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// EntryFormat is a compiled template of the entries in the menus. A template is text with tags:
+//
+//	{Field}              the value of a field, e.g. {Title}, {UserName} or {URL}
+//	{Field:20}           the value in a column of 20 characters, truncated and padded
+//	{Field:.20}          the value truncated to 20 characters, not padded
+//	{Field|text}         the text when the field is empty, with a width: {Field:20|text}
+//	{?Field}...{/}       the part only when the field is not empty, {!Field} when it is empty
+//
+// Besides the fields of the entry, {Group} is the path of its group, {Tags} its tags, {Database}
+// the name of its database, {Expires} the date it expires, {Expired} is set once it expired and
+// {OTP} when it has an OTP, e.g. {?OTP}[2FA]{/}. In a tag a backslash escapes the next character,
+// e.g. {Site\:Login} for the field "Site:Login". Malformed tags are kept as text, as are
+// unclosed conditional parts. Values are escaped for the menus rendering markup, the text of the
+// template is not.
+type EntryFormat struct {
+	spec  string
+	nodes []formatNode
+}
+
+// formatNode is a part of a template: literal text, a field or a conditional part
+type formatNode struct {
+	text     string       // Literal text, when there's no field nor condition
+	field    string       // Field of the value
+	width    int          // Width of the value, 0 for any width
+	pad      bool         // Pad the value to the width
+	fallback string       // Text when the field is empty
+	test     string       // Field of a conditional part
+	negate   bool         // The part is shown when the field is empty
+	children []formatNode // Nodes of a conditional part
+}
+
+// markupEscaper escapes the values for Pango markup
+var markupEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// CompileEntryFormat compiles the template of the entries
+func CompileEntryFormat(spec string) *EntryFormat {
+	nodes, _ := compileFormatNodes(spec, false)
+	return &EntryFormat{spec: spec, nodes: nodes}
+}
+
+// compileFormatNodes compiles the nodes of spec until its end, or the {/} closing a conditional
+// part: the rest of spec is returned then, from the {/}
+func compileFormatNodes(spec string, conditional bool) ([]formatNode, string) {
+	var nodes []formatNode
+	rest := spec
+	for rest != "" {
+		open := strings.IndexByte(rest, '{')
+		if open == -1 {
+			nodes = append(nodes, formatNode{text: rest})
+			break
+		}
+		if open > 0 {
+			nodes = append(nodes, formatNode{text: rest[:open]})
+		}
+		end := indexUnescaped(rest[open+1:], '}')
+		if end == -1 {
+			nodes = append(nodes, formatNode{text: rest[open:]})
+			break
+		}
+		literal := formatNode{text: rest[open : open+end+2]}
+		tag := rest[open+1 : open+end+1]
+		rest = rest[open+end+2:]
+
+		switch {
+		case tag == "/":
+			if conditional {
+				return nodes, "{/}" + rest
+			}
+			nodes = append(nodes, literal)
+		case strings.HasPrefix(tag, "?") || strings.HasPrefix(tag, "!"):
+			node := formatNode{test: unescapeTag(strings.TrimSpace(tag[1:])), negate: tag[0] == '!'}
+			children, after := compileFormatNodes(rest, true)
+			if node.test == "" || !strings.HasPrefix(after, "{/}") {
+				// The rest is compiled again without the tag
+				nodes = append(nodes, literal)
+				continue
+			}
+			node.children = children
+			nodes = append(nodes, node)
+			rest = strings.TrimPrefix(after, "{/}")
+		default:
+			if node, ok := compileFormatField(tag); ok {
+				nodes = append(nodes, node)
+			} else {
+				nodes = append(nodes, literal)
+			}
+		}
+	}
+	// The caller of a conditional part checks the {/}
+	return nodes, ""
+}
+
+// compileFormatField compiles a field tag: Field, Field:width or Field:.width, then |text
+func compileFormatField(tag string) (formatNode, bool) {
+	var node formatNode
+	spec, fallback, hasFallback := cutUnescaped(tag, '|')
+	if hasFallback {
+		node.fallback = unescapeTag(fallback)
+	}
+	field, width, hasWidth := cutUnescaped(spec, ':')
+	node.field = unescapeTag(strings.TrimSpace(field))
+	if node.field == "" {
+		return node, false
+	}
+	if hasWidth {
+		node.pad = !strings.HasPrefix(width, ".")
+		n, err := strconv.Atoi(strings.TrimPrefix(width, "."))
+		if err != nil || n < 1 {
+			return node, false
+		}
+		node.width = n
+	}
+	return node, true
+}
+
+// indexUnescaped returns the index of the first c of s not escaped by a backslash, or -1
+func indexUnescaped(s string, c byte) int {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case c:
+			return i
+		}
+	}
+	return -1
+}
+
+// cutUnescaped slices s around the first c not escaped by a backslash
+func cutUnescaped(s string, c byte) (before, after string, found bool) {
+	if i := indexUnescaped(s, c); i != -1 {
+		return s[:i], s[i+1:], true
+	}
+	return s, "", false
+}
+
+// unescapeTag removes the backslashes escaping the characters of a tag
+func unescapeTag(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var unescaped strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		unescaped.WriteByte(s[i])
+	}
+	return unescaped.String()
+}
+
+// Spec returns the template compiled
+func (f *EntryFormat) Spec() string {
+	return f.spec
+}
+
+// Format renders the entry, with its values escaped for markup if enabled
+func (f *EntryFormat) Format(e *Entry, markup bool, now time.Time) string {
+	var s strings.Builder
+	formatNodes(&s, f.nodes, e, markup, now)
+	return s.String()
+}
+
+func formatNodes(s *strings.Builder, nodes []formatNode, e *Entry, markup bool, now time.Time) {
+	for _, node := range nodes {
+		switch {
+		case node.test != "":
+			if (entryValue(e, node.test, now) == "") == node.negate {
+				formatNodes(s, node.children, e, markup, now)
+			}
+		case node.field != "":
+			value := entryValue(e, node.field, now)
+			literal := value == ""
+			if literal {
+				value = node.fallback
+			}
+			value = formatColumn(value, node.width, node.pad)
+			if markup && !literal {
+				value = markupEscaper.Replace(value)
+			}
+			s.WriteString(value)
+		default:
+			s.WriteString(node.text)
+		}
+	}
+}
+
+// formatColumn truncates the value to the width, marking it with an ellipsis, and pads it if requested
+func formatColumn(value string, width int, pad bool) string {
+	// The values are single line items
+	value = strings.ReplaceAll(value, "\n", " ")
+	if width == 0 {
+		return value
+	}
+	n := utf8.RuneCountInString(value)
+	if n > width {
+		runes := []rune(value)
+		return string(runes[:width-1]) + "…"
+	}
+	if pad {
+		return value + strings.Repeat(" ", width-n)
+	}
+	return value
+}
+
+// entryValue returns the value of a field of the entry for the templates, or of the values
+// computed from the entry
+func entryValue(e *Entry, field string, now time.Time) string {
+	times := e.FullEntry.Times
+	switch field {
+	case "Group":
+		return e.Group
+	case "Tags":
+		return strings.Join(e.Tags(), ", ")
+	case "Database":
+		if e.Database == nil {
+			return ""
+		}
+		return e.Database.Name()
+	case "Expires":
+		if expiry := timeOf(times.ExpiryTime); times.Expires.Bool && !expiry.IsZero() {
+			return expiry.Local().Format("2006-01-02")
+		}
+		return ""
+	case "Expired":
+		if expiry := timeOf(times.ExpiryTime); times.Expires.Bool && !expiry.IsZero() && expiry.Before(now) {
+			return "expired"
+		}
+		return ""
+	case "OTP":
+		// Never the secret
+		if e.FullEntry.GetContent(OTP) != "" || e.FullEntry.GetContent(TOTPSEED) != "" {
+			return "2FA"
+		}
+		return ""
+	}
+	return e.FullEntry.GetContent(field)
+}
+
+// entryFormat returns the compiled template of the entries, compiled again only when it changes
+func (m *Menu) entryFormat() *EntryFormat {
+	spec := m.Configuration.Style.FormatEntry
+	if m.format == nil || m.format.Spec() != spec {
+		m.format = CompileEntryFormat(spec)
+	}
+	return m.format
+}
@@ -0,0 +1,52 @@
+package kpmenulib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tobischo/gokeepasslib/v3"
+	w "github.com/tobischo/gokeepasslib/v3/wrappers"
+)
+
+func TestEntryFormat(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local)
+	db := NewDatabase(DatabaseSource{Database: "test.kdbx"})
+	github := newAuditEntry(db, "GitHub <work>", "me", "https://github.com", "secret")
+	github.Group = "Root/Work"
+	github.FullEntry.Tags = "dev;work"
+	github.FullEntry.Values = append(github.FullEntry.Values, gokeepasslib.ValueData{Key: OTP, Value: gokeepasslib.V{Content: "otpauth://totp/GitHub?secret=JBSWY3DPEHPK3PXP"}})
+	github.FullEntry.Times.Expires = w.NewBoolWrapper(true)
+	expiry := w.TimeWrapper{Time: now.Add(-time.Hour)}
+	github.FullEntry.Times.ExpiryTime = &expiry
+	github.FullEntry.Values = append(github.FullEntry.Values, gokeepasslib.ValueData{Key: "Site:Login", Value: gokeepasslib.V{Content: "mylogin"}})
+	mail := newAuditEntry(db, "A very long mail server title", "", "", "secret")
+
+	for _, c := range []struct {
+		spec    string
+		entry   *Entry
+		markup  bool
+		display string
+	}{
+		{"{Title} - {UserName}", &github, false, "GitHub <work> - me"},
+		{"{Title:10}|{UserName:4}|", &mail, false, "A very lo…|    |"},
+		{"{Title:.8} {UserName|no user}", &mail, false, "A very … no user"},
+		{"{Title}{?OTP} [2FA]{/}{?Expired} [{Expired}]{/}", &github, false, "GitHub <work> [2FA] [expired]"},
+		{"{Title}{?OTP} [2FA]{/}{!UserName} (no {?URL}user{/}{!URL}user nor URL{/}){/}", &mail, false, "A very long mail server title (no user nor URL)"},
+		{"{Group}/{Title} {Tags} {Expires}", &github, false, "Root/Work/GitHub <work> dev, work 2024-06-01"},
+		{"<b>{Title}</b> {Database}", &github, true, "<b>GitHub &lt;work&gt;</b> test.kdbx"},
+		// Escaped characters of the field names and the texts
+		{`{Site\:Login:6} {Site\\Key|-}`, &github, false, "mylog… -"},
+		{`{Title\|x|a\}b}`, &mail, false, "a}b"},
+		// Malformed tags and unclosed conditional parts are kept as text
+		{"{Title", &mail, false, "{Title"},
+		{"{Title:x} {Title:0} {} {my field}", &github, false, "{Title:x} {Title:0} {} "},
+		{"{?OTP}[2FA] {UserName}", &github, false, "{?OTP}[2FA] me"},
+		{"{UserName}{/} {?}x{/}", &github, false, "me{/} {?}x{/}"},
+		{"{?OTP}{!URL}x{/}", &github, false, "{?OTP}"},
+	} {
+		format := CompileEntryFormat(c.spec)
+		if display := format.Format(c.entry, c.markup, now); display != c.display {
+			t.Errorf("%s: expected %q, got %q", c.spec, c.display, display)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package kpmenulib
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// usageHalfLife is the time after which a use counts half
+const usageHalfLife = 7 * 24 * time.Hour
+
+// UsageRecord is the frecency of an entry: its uses, decayed since the last one
+type UsageRecord struct {
+	Score   float64   `json:"score"`
+	Updated time.Time `json:"updated"`
+}
+
+// UsageStore is the frecency of the entries, by UUID only: it has no title, no database
+// name and no value
+type UsageStore map[string]UsageRecord
+
+// usageStorePath returns the file of the usage store, shared by the databases
+func usageStorePath() string {
+	return filepath.Join(os.Getenv("HOME"), ".cache/kpmenu/usage.json")
+}
+
+// LoadUsage reads the usage store, empty if it does not exist
+func LoadUsage(name string) (UsageStore, error) {
+	store := UsageStore{}
+	data, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Save writes the usage store
+func (s UsageStore) Save(name string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(name, data)
+}
+
+// ResetUsage removes the usage store
+func ResetUsage(name string) error {
+	if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Score returns the frecency of the entry at the time now
+func (s UsageStore) Score(uuid string, now time.Time) float64 {
+	record, ok := s[uuid]
+	if !ok {
+		return 0
+	}
+	elapsed := now.Sub(record.Updated)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return record.Score * math.Exp2(-float64(elapsed)/float64(usageHalfLife))
+}
+
+// Use records a use of the entry at the time now
+func (s UsageStore) Use(uuid string, now time.Time) {
+	s[uuid] = UsageRecord{Score: s.Score(uuid, now) + 1, Updated: now}
+}
+
+// recordUsage records a use of the entry into the usage store, if frecency is enabled
+func (m *Menu) recordUsage(entry *Entry) {
+	if !m.Configuration.General.Frecency || entry == nil {
+		return
+	}
+	name := usageStorePath()
+	store, err := LoadUsage(name)
+	if err != nil {
+		// A broken store is replaced, it only sorts the entries
+		log.Printf("failed to read the usage store: %s", err)
+		store = UsageStore{}
+	}
+	store.Use(hex.EncodeToString(entry.UUID[:]), time.Now())
+	if err := store.Save(name); err != nil {
+		log.Printf("failed to write the usage store: %s", err)
+	}
+}
+
+// frecentEntries returns the entries sorted by frecency for the menu, an unreadable usage store
+// or active window only loses their part of the ranking
+func frecentEntries(menu *Menu, entries []Entry) []Entry {
+	store, err := LoadUsage(usageStorePath())
+	if err != nil {
+		log.Printf("failed to read the usage store: %s", err)
+		store = UsageStore{}
+	}
+	window, errPrompt := activeWindowTitle(menu)
+	if errPrompt.Error != nil {
+		log.Printf("failed to identify the active window: %s", errPrompt.Error)
+	}
+	return rankEntries(entries, store, window, time.Now())
+}
+
+// rankEntries returns the entries sorted by frecency, the entries whose URL matches the active
+// window first. The order of the database is kept between entries with the same rank.
+func rankEntries(entries []Entry, store UsageStore, window string, now time.Time) []Entry {
+	type rankedEntry struct {
+		entry  Entry
+		window bool
+		score  float64
+	}
+	ranked := make([]rankedEntry, len(entries))
+	for i, e := range entries {
+		ranked[i] = rankedEntry{
+			entry:  e,
+			window: urlMatchesWindow(e.FullEntry.GetContent("URL"), window),
+			score:  store.Score(hex.EncodeToString(e.UUID[:]), now),
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].window != ranked[j].window {
+			return ranked[i].window
+		}
+		return ranked[i].score > ranked[j].score
+	})
+	sorted := make([]Entry, len(ranked))
+	for i, r := range ranked {
+		sorted[i] = r.entry
+	}
+	return sorted
+}
+
+// urlMatchesWindow returns whether the title of the window has the host of the URL, or its name
+// without subdomains and top level domain: browsers show the title of the page, e.g. GitHub
+func urlMatchesWindow(rawURL, window string) bool {
+	if rawURL == "" || window == "" {
+		return false
+	}
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "https://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(strings.TrimPrefix(u.Hostname(), "www."))
+	if host == "" {
+		return false
+	}
+	window = strings.ToLower(window)
+	if strings.Contains(window, host) {
+		return true
+	}
+	if net.ParseIP(host) != nil {
+		return false
+	}
+	labels := strings.Split(host, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	// Too short names match too many titles, e.g. co of co.uk
+	name := labels[len(labels)-2]
+	return len(name) > 2 && strings.Contains(window, name)
+}
@@ -0,0 +1,79 @@
+package kpmenulib
+
+import (
+	"encoding/hex"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestUsageStore(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	store := UsageStore{}
+	store.Use("a", now.Add(-usageHalfLife))
+	store.Use("a", now.Add(-usageHalfLife))
+	store.Use("b", now)
+	if score := store.Score("a", now); score < 0.99 || score > 1.01 {
+		t.Errorf("expected two uses a half-life ago to score 1, got %f", score)
+	}
+	if score := store.Score("c", now); score != 0 {
+		t.Errorf("expected an unused entry to score 0, got %f", score)
+	}
+
+	t.Setenv("HOME", t.TempDir())
+	name := usageStorePath()
+	if err := store.Save(name); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadUsage(name)
+	if err != nil || len(loaded) != 2 || loaded.Score("b", now) != 1 {
+		t.Errorf("unexpected store %v %v", loaded, err)
+	}
+	if err := frecencyCommand(NewConfiguration(), []string{"reset"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("expected the store to be removed, got %v", err)
+	}
+	if loaded, err := LoadUsage(name); err != nil || len(loaded) != 0 {
+		t.Errorf("expected an empty store, got %v %v", loaded, err)
+	}
+}
+
+func TestRankEntries(t *testing.T) {
+	db := NewDatabase(DatabaseSource{Database: "test.kdbx"})
+	entries := []Entry{
+		newAuditEntry(db, "Mail", "me", "https://mail.example.org", "a"),
+		newAuditEntry(db, "GitHub", "me", "https://github.com/login", "b"),
+		newAuditEntry(db, "Bank", "me", "bank.example.com", "c"),
+		newAuditEntry(db, "Server", "root", "ssh://10.0.0.1", "d"),
+	}
+	for i := range entries {
+		entries[i].UUID[0] = byte(i + 1)
+	}
+	now := time.Now()
+	store := UsageStore{}
+	store.Use(hex.EncodeToString(entries[2].UUID[:]), now)
+	store.Use(hex.EncodeToString(entries[0].UUID[:]), now.Add(-time.Hour))
+
+	titles := func(entries []Entry) string {
+		var s string
+		for _, e := range entries {
+			s += e.FullEntry.GetTitle() + " "
+		}
+		return s
+	}
+	if ranked := titles(rankEntries(entries, store, "", now)); ranked != "Bank Mail GitHub Server " {
+		t.Errorf("unexpected order %q", ranked)
+	}
+	// Browsers show the name of the site, not its host
+	if ranked := titles(rankEntries(entries, store, "GitHub · Sign in - Mozilla Firefox", now)); ranked != "GitHub Bank Mail Server " {
+		t.Errorf("unexpected order with the active window %q", ranked)
+	}
+	if ranked := titles(rankEntries(entries, store, "root@10.0.0.1: ~", now)); ranked != "Server Bank Mail GitHub " {
+		t.Errorf("unexpected order with the active window %q", ranked)
+	}
+	if titles(entries) != "Mail GitHub Bank Server " {
+		t.Error("the entries of the database were sorted")
+	}
+}
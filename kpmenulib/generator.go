@@ -0,0 +1,293 @@
+package kpmenulib
+
+import (
+	"bufio"
+	"crypto/rand"
+	_ "embed"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Character classes of generated passwords
+const (
+	ClassUpper   = 'u'
+	ClassLower   = 'l'
+	ClassDigits  = 'd'
+	ClassSymbols = 's'
+)
+
+// DefaultProfileName is the name of the profile built from the generatorDefault option
+const DefaultProfileName = "default"
+
+var passwordClasses = map[rune]string{
+	ClassUpper:   "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	ClassLower:   "abcdefghijklmnopqrstuvwxyz",
+	ClassDigits:  "0123456789",
+	ClassSymbols: "!#$%&*+-=?@^_",
+}
+
+// Characters easily confused with each other
+const lookAlikeCharacters = "Il1O0o"
+
+// The EFF large wordlist for passphrases, by the Electronic Frontier Foundation
+// (https://www.eff.org/dice), licensed under CC BY 3.0 US
+//
+//go:embed eff_large_wordlist.txt
+var wordListRaw string
+var (
+	wordList     []string
+	wordListOnce sync.Once
+)
+
+// PasswordProfile describes how passwords are generated.
+//
+// A profile is written as comma separated options, e.g.
+//
+//	length=20,classes=ulds,require=ud,nosimilar
+//	words=6,separator=-
+//
+// where classes are u(pper case), l(ower case), d(igits) and s(ymbols). If
+// words is set a diceware passphrase is generated instead of a password.
+type PasswordProfile struct {
+	Name      string
+	Length    int    // Number of characters
+	Classes   string // Classes of characters to use
+	Require   string // Classes that must appear at least once
+	NoSimilar bool   // Exclude look-alike characters
+	Words     int    // Number of words of a passphrase
+	Separator string // Separator between the words of a passphrase
+}
+
+// ParsePasswordProfile parses the options of a profile
+func ParsePasswordProfile(name, spec string) (PasswordProfile, error) {
+	profile := PasswordProfile{
+		Name:      name,
+		Length:    20,
+		Classes:   "ulds",
+		Separator: " ",
+	}
+	for _, option := range strings.Split(spec, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(option), "=")
+		var err error
+		switch strings.ToLower(key) {
+		case "":
+		case "length":
+			profile.Length, err = strconv.Atoi(value)
+		case "classes":
+			profile.Classes = value
+		case "require":
+			profile.Require = value
+		case "nosimilar":
+			profile.NoSimilar = value == "" || value == "true"
+		case "words":
+			profile.Words, err = strconv.Atoi(value)
+		case "separator":
+			if value == "space" {
+				value = " "
+			}
+			profile.Separator = value
+		default:
+			return profile, fmt.Errorf("unknown generator option %q", key)
+		}
+		if err != nil {
+			return profile, fmt.Errorf("invalid generator option %q: %v", option, err)
+		}
+	}
+	return profile, profile.validate()
+}
+
+// ParsePasswordProfiles parses a list of profiles separated by ;, each one written as name:options
+func ParsePasswordProfiles(spec string) ([]PasswordProfile, error) {
+	var profiles []PasswordProfile
+	for _, s := range strings.Split(spec, ";") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		name, options, found := strings.Cut(s, ":")
+		if !found {
+			return nil, fmt.Errorf("invalid generator profile %q, expected name:options", s)
+		}
+		profile, err := ParsePasswordProfile(strings.TrimSpace(name), options)
+		if err != nil {
+			return nil, fmt.Errorf("generator profile %s: %v", name, err)
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, nil
+}
+
+func (p PasswordProfile) validate() error {
+	if p.Words < 0 {
+		return errors.New("words must not be negative")
+	}
+	if p.Words > 0 {
+		return nil
+	}
+	if p.Length <= 0 {
+		return errors.New("length must be greater than 0")
+	}
+	for _, c := range p.Classes + p.Require {
+		if _, ok := passwordClasses[c]; !ok {
+			return fmt.Errorf("unknown character class %q", c)
+		}
+	}
+	for _, c := range p.Require {
+		if !strings.ContainsRune(p.Classes, c) {
+			return fmt.Errorf("required class %q is not in classes", c)
+		}
+	}
+	if len(uniqueClasses(p.Require)) > p.Length {
+		return errors.New("length is shorter than the number of required classes")
+	}
+	if p.characters() == "" {
+		return errors.New("no character class selected")
+	}
+	return nil
+}
+
+// Generate returns a new random password or passphrase
+func (p PasswordProfile) Generate() (string, error) {
+	if err := p.validate(); err != nil {
+		return "", err
+	}
+	if p.Words > 0 {
+		return p.generatePassphrase()
+	}
+
+	characters := p.characters()
+	for {
+		password, err := randomString(characters, p.Length)
+		if err != nil {
+			return "", err
+		}
+		// Retry instead of forcing characters, to keep the distribution uniform
+		if p.hasRequired(password) {
+			return password, nil
+		}
+	}
+}
+
+// Entropy returns an estimate of the entropy in bits of the generated passwords
+func (p PasswordProfile) Entropy() float64 {
+	if p.Words > 0 {
+		return float64(p.Words) * math.Log2(float64(len(words())))
+	}
+	return float64(p.Length) * math.Log2(float64(len(p.characters())))
+}
+
+// String describes the profile with its entropy estimate
+func (p PasswordProfile) String() string {
+	if p.Words > 0 {
+		return fmt.Sprintf("%s (%d words, ~%.0f bits)", p.Name, p.Words, p.Entropy())
+	}
+	return fmt.Sprintf("%s (%d chars, ~%.0f bits)", p.Name, p.Length, p.Entropy())
+}
+
+func (p PasswordProfile) characters() string {
+	var characters strings.Builder
+	for _, c := range uniqueClasses(p.Classes) {
+		for _, r := range passwordClasses[c] {
+			if p.NoSimilar && strings.ContainsRune(lookAlikeCharacters, r) {
+				continue
+			}
+			characters.WriteRune(r)
+		}
+	}
+	return characters.String()
+}
+
+func (p PasswordProfile) hasRequired(password string) bool {
+	for _, c := range p.Require {
+		if !strings.ContainsAny(password, passwordClasses[c]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p PasswordProfile) generatePassphrase() (string, error) {
+	list := words()
+	phrase := make([]string, p.Words)
+	for i := range phrase {
+		n, err := randomInt(len(list))
+		if err != nil {
+			return "", err
+		}
+		phrase[i] = list[n]
+	}
+	return strings.Join(phrase, p.Separator), nil
+}
+
+// GeneratePassword returns a password generated with the default profile of the configuration
+func GeneratePassword(cfg *Configuration) (string, error) {
+	profile, err := ParsePasswordProfile(DefaultProfileName, cfg.General.GeneratorDefault)
+	if err != nil {
+		return "", err
+	}
+	return profile.Generate()
+}
+
+// PasswordProfiles returns the default profile followed by the configured ones
+func PasswordProfiles(cfg *Configuration) ([]PasswordProfile, error) {
+	profile, err := ParsePasswordProfile(DefaultProfileName, cfg.General.GeneratorDefault)
+	if err != nil {
+		return nil, err
+	}
+	profiles, err := ParsePasswordProfiles(cfg.General.GeneratorProfiles)
+	if err != nil {
+		return nil, err
+	}
+	return append([]PasswordProfile{profile}, profiles...), nil
+}
+
+func uniqueClasses(classes string) []rune {
+	var unique []rune
+	for _, c := range classes {
+		if !strings.ContainsRune(string(unique), c) {
+			unique = append(unique, c)
+		}
+	}
+	return unique
+}
+
+func randomString(characters string, length int) (string, error) {
+	runes := []rune(characters)
+	result := make([]rune, length)
+	for i := range result {
+		n, err := randomInt(len(runes))
+		if err != nil {
+			return "", err
+		}
+		result[i] = runes[n]
+	}
+	return string(result), nil
+}
+
+func randomInt(max int) (int, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
+	if err != nil {
+		return 0, err
+	}
+	return int(n.Int64()), nil
+}
+
+// words returns the diceware word list, lines are formatted as "DICE<TAB>WORD", # starts a comment
+func words() []string {
+	wordListOnce.Do(func() {
+		s := bufio.NewScanner(strings.NewReader(wordListRaw))
+		for s.Scan() {
+			if strings.HasPrefix(s.Text(), "#") {
+				continue
+			}
+			if fields := strings.Fields(s.Text()); len(fields) == 2 {
+				wordList = append(wordList, fields[1])
+			}
+		}
+	})
+	return wordList
+}
@@ -0,0 +1,71 @@
+package kpmenulib
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePasswordProfiles(t *testing.T) {
+	profiles, err := ParsePasswordProfiles("pin:length=6,classes=d; phrase:words=5,separator=-")
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if len(profiles) != 2 {
+		t.Fatalf("expected 2 profiles, got %d", len(profiles))
+	}
+	if p := profiles[0]; p.Name != "pin" || p.Length != 6 || p.Classes != "d" {
+		t.Errorf("unexpected profile %#v", p)
+	}
+	if p := profiles[1]; p.Name != "phrase" || p.Words != 5 || p.Separator != "-" {
+		t.Errorf("unexpected profile %#v", p)
+	}
+
+	for _, spec := range []string{"nocolon", "a:length=x", "a:classes=z", "a:classes=d,require=u", "a:length=1,require=ud", "a:unknown=1", "a:words=-3"} {
+		if _, err := ParsePasswordProfiles(spec); err == nil {
+			t.Errorf("expected an error for %q", spec)
+		}
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	profile, err := ParsePasswordProfile("test", "length=12,classes=lds,require=ds,nosimilar")
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	for i := 0; i < 50; i++ {
+		password, err := profile.Generate()
+		if err != nil {
+			t.Fatalf("expected no error, got %s", err)
+		}
+		if len(password) != 12 {
+			t.Errorf("expected length 12, got %q", password)
+		}
+		if strings.ContainsAny(password, passwordClasses[ClassUpper]+lookAlikeCharacters) {
+			t.Errorf("unexpected characters in %q", password)
+		}
+		if !strings.ContainsAny(password, passwordClasses[ClassDigits]) || !strings.ContainsAny(password, passwordClasses[ClassSymbols]) {
+			t.Errorf("missing required classes in %q", password)
+		}
+	}
+}
+
+func TestGeneratePassphrase(t *testing.T) {
+	profile, err := ParsePasswordProfile("test", "words=6,separator=.")
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	phrase, err := profile.Generate()
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if got := len(strings.Split(phrase, ".")); got != 6 {
+		t.Errorf("expected 6 words, got %q", phrase)
+	}
+	if len(words()) != 7776 {
+		t.Errorf("expected 7776 words, got %d", len(words()))
+	}
+	// log2(7776) is about 12.9
+	if e := profile.Entropy(); e < 77 || e > 78 {
+		t.Errorf("unexpected entropy %f", e)
+	}
+}
@@ -0,0 +1,18 @@
+package kpmenulib
+
+import (
+	"syscall"
+)
+
+// hardenProcess prevents the memory of the process from being read by other
+// processes of the user (ptrace, /proc/pid/mem) or written into core dumps
+func hardenProcess() MemoryProtection {
+	var protection MemoryProtection
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_DUMPABLE, 0, 0); errno == 0 {
+		protection.NotDumpable = true
+	}
+	if err := syscall.Setrlimit(syscall.RLIMIT_CORE, &syscall.Rlimit{}); err == nil {
+		protection.NoCoreDump = true
+	}
+	return protection
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package kpmenulib
+
+// hardenProcess is only supported on Linux
+func hardenProcess() MemoryProtection {
+	return MemoryProtection{}
+}
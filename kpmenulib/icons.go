@@ -0,0 +1,135 @@
+package kpmenulib
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+// keepassIcons are the freedesktop icon names of the standard icons of KeePass, by IconID
+var keepassIcons = [...]string{
+	"dialog-password",         // Key
+	"applications-internet",   // World
+	"dialog-warning",          // Warning
+	"network-server",          // NetworkServer
+	"folder",                  // MarkedDirectory
+	"internet-group-chat",     // UserCommunication
+	"applications-other",      // Parts
+	"accessories-text-editor", // Notepad
+	"network-wired",           // WorldSocket
+	"avatar-default",          // Identity
+	"text-x-generic",          // PaperReady
+	"camera-photo",            // Digicam
+	"network-wireless",        // IRCommunication
+	"dialog-password",         // MultiKeys
+	"battery",                 // Energy
+	"scanner",                 // Scanner
+	"applications-internet",   // WorldStar
+	"media-optical",           // CDRom
+	"video-display",           // Monitor
+	"internet-mail",           // EMail
+	"preferences-system",      // Configuration
+	"edit-paste",              // ClipboardReady
+	"document-new",            // PaperNew
+	"video-display",           // Screen
+	"battery-caution",         // EnergyCareful
+	"mail-send-receive",       // EMailBox
+	"media-floppy",            // Disk
+	"drive-harddisk",          // Drive
+	"dialog-question",         // PaperQ
+	"utilities-terminal",      // TerminalEncrypted
+	"utilities-terminal",      // Console
+	"printer",                 // Printer
+	"applications-other",      // ProgramIcons
+	"system-run",              // Run
+	"preferences-system",      // Settings
+	"network-workgroup",       // WorldComputer
+	"package-x-generic",       // Archive
+	"accessories-calculator",  // Homebanking
+	"drive-harddisk",          // DriveWindows
+	"appointment-soon",        // Clock
+	"system-search",           // EMailSearch
+	"emblem-important",        // PaperFlag
+	"media-flash",             // Memory
+	"user-trash",              // TrashBin
+	"x-office-document",       // Note
+	"process-stop",            // Expired
+	"dialog-information",      // Info
+	"package-x-generic",       // Package
+	"folder",                  // Folder
+	"folder-open",             // FolderOpen
+	"folder",                  // FolderPackage
+	"changes-allow",           // LockOpen
+	"changes-prevent",         // PaperLocked
+	"emblem-default",          // Checked
+	"accessories-text-editor", // Pen
+	"image-x-generic",         // Thumbnail
+	"x-office-address-book",   // Book
+	"x-office-document",       // List
+	"dialog-password",         // UserKey
+	"applications-utilities",  // Tool
+	"user-home",               // Home
+	"starred",                 // Star
+	"computer",                // Tux
+	"accessories-text-editor", // Feather
+	"computer",                // Apple
+	"accessories-dictionary",  // Wiki
+	"accessories-calculator",  // Money
+	"application-certificate", // Certificate
+	"phone",                   // BlackBerry
+}
+
+// entryIcon returns the icon of the entry for the menus: the path of its custom icon,
+// or the freedesktop name of its standard icon, empty if none
+func entryIcon(e *Entry) string {
+	if e.FullEntry.CustomIconUUID != (gokeepasslib.UUID{}) && e.Database != nil {
+		if path, err := e.Database.customIcon(e.FullEntry.CustomIconUUID); err == nil {
+			return path
+		}
+	}
+	if id := e.FullEntry.IconID; id >= 0 && id < int64(len(keepassIcons)) {
+		return keepassIcons[id]
+	}
+	return ""
+}
+
+// iconCacheDir returns the directory of the custom icons of the database
+func (db *Database) iconCacheDir() string {
+	name, err := filepath.Abs(db.Source.Database)
+	if err != nil {
+		name = db.Source.Database
+	}
+	hash := sha256.Sum256([]byte(name))
+	return filepath.Join(os.Getenv("HOME"), ".cache/kpmenu/icons", hex.EncodeToString(hash[:8]))
+}
+
+// customIcon returns the path of the PNG file of a custom icon, extracted from the database
+// the first time it is used. Icons are named by their UUID, which changes with their image.
+func (db *Database) customIcon(uuid gokeepasslib.UUID) (string, error) {
+	path := filepath.Join(db.iconCacheDir(), hex.EncodeToString(uuid[:])+".png")
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	if db.Keepass.Content == nil || db.Keepass.Content.Meta == nil {
+		return "", fmt.Errorf("custom icon %x not found", uuid[:])
+	}
+	for _, icon := range db.Keepass.Content.Meta.CustomIcons {
+		if icon.UUID != uuid {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(icon.Data)
+		if err != nil {
+			return "", fmt.Errorf("custom icon %x: %v", uuid[:], err)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return "", err
+		}
+		return path, writeFileAtomic(path, data)
+	}
+	return "", fmt.Errorf("custom icon %x not found", uuid[:])
+}
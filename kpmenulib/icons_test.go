@@ -0,0 +1,51 @@
+package kpmenulib
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+func TestEntryIcon(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	db := NewDatabase(DatabaseSource{Database: "test.kdbx"})
+	db.Keepass.Content = gokeepasslib.NewContent()
+	png := []byte("\x89PNG\r\n\x1a\nicon")
+	icon := gokeepasslib.CustomIcon{UUID: gokeepasslib.NewUUID(), Data: base64.StdEncoding.EncodeToString(png)}
+	db.Keepass.Content.Meta.CustomIcons = append(db.Keepass.Content.Meta.CustomIcons, icon)
+
+	entry := newAuditEntry(db, "GitHub", "me", "https://github.com", "secret")
+	entry.FullEntry.IconID = 62
+	if name := entryIcon(&entry); name != "computer" {
+		t.Errorf("expected the icon of Tux, got %q", name)
+	}
+	entry.FullEntry.IconID = 1000
+	if name := entryIcon(&entry); name != "" {
+		t.Errorf("expected no icon for an unknown id, got %q", name)
+	}
+
+	// Custom icons are extracted once into the cache
+	entry.FullEntry.CustomIconUUID = icon.UUID
+	path := entryIcon(&entry)
+	if !strings.HasPrefix(path, db.iconCacheDir()) {
+		t.Fatalf("expected the custom icon in the cache, got %q", path)
+	}
+	if data, err := os.ReadFile(path); err != nil || !bytes.Equal(data, png) {
+		t.Errorf("unexpected icon file %q %v", data, err)
+	}
+	db.Keepass.Content.Meta.CustomIcons = nil
+	if cached := entryIcon(&entry); cached != path {
+		t.Errorf("expected the cached icon, got %q", cached)
+	}
+
+	// Unknown custom icons fall back to the standard icon
+	entry.FullEntry.CustomIconUUID = gokeepasslib.NewUUID()
+	entry.FullEntry.IconID = 0
+	if name := entryIcon(&entry); name != "dialog-password" {
+		t.Errorf("expected the standard icon, got %q", name)
+	}
+}
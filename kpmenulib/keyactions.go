@@ -0,0 +1,396 @@
+package kpmenulib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/png"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/shlex"
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+// Actions on the selected entry, of the custom keys and of the action menu
+const (
+	KeyActionCopy        = "copy"        // Copy the field of the argument
+	KeyActionType        = "type"        // Type the autotype sequence of the argument
+	KeyActionURL         = "url"         // Open the URL of the entry
+	KeyActionOTP         = "otp"         // Show the OTP of the entry
+	KeyActionCommand     = "command"     // Run the shell command of the argument, the fields are given on stdin as JSON
+	KeyActionFields      = "fields"      // Choose a field to copy
+	KeyActionAutotype    = "autotype"    // Type the autotype sequence of the entry
+	KeyActionTypeField   = "typefield"   // Choose a field to type
+	KeyActionNotes       = "notes"       // Show the notes
+	KeyActionAttachments = "attachments" // Show the attachments
+	KeyActionHistory     = "history"     // Show the history of the changes
+	KeyActionQR          = "qr"          // Show the QR code of the field of the argument, or of the OTP
+)
+
+// DefaultKeyActions are the actions of the custom keys of the autotype before they were configurable
+const DefaultKeyActions = "type:{USERNAME};type:{PASSWORD};type:{TOTP};type:{PASSWORD}{ENTER};type:{URL}"
+
+// customKeyExitCode is the exit code of the menus for the first custom key, the next keys follow
+const customKeyExitCode = 10
+
+// maxCustomKeys is the number of custom keys of rofi, the backend with the most
+const maxCustomKeys = 19
+
+// KeyAction is an action on the selected entry, run by a custom key or chosen in the action menu
+type KeyAction struct {
+	Action   string
+	Argument string
+}
+
+// String describes the action for the help of the custom keys
+func (a KeyAction) String() string {
+	switch a.Action {
+	case KeyActionCopy:
+		return "copy " + a.Argument
+	case KeyActionType:
+		return "type " + a.Argument
+	case KeyActionURL:
+		return "open URL"
+	case KeyActionOTP:
+		return "show OTP"
+	case KeyActionFields:
+		return "copy a field"
+	case KeyActionAutotype:
+		return "autotype"
+	case KeyActionTypeField:
+		return "type a field"
+	case KeyActionNotes:
+		return "show notes"
+	case KeyActionAttachments:
+		return "show attachments"
+	case KeyActionHistory:
+		return "show history"
+	case KeyActionQR:
+		if a.Argument != "" {
+			return "show QR of " + a.Argument
+		}
+		return "show QR"
+	case KeyActionCommand:
+		// The command may be long, its program is enough
+		program, _, _ := strings.Cut(strings.TrimSpace(a.Argument), " ")
+		return "run " + program
+	}
+	return "none"
+}
+
+// ParseKeyActions parses the actions of the custom keys, separated by ;, the first for the custom
+// key 1 (Alt-1 in rofi). Actions are action:argument, e.g. copy:Password, type:{USERNAME}{ENTER},
+// url, otp, qr or qr:Password and command:notify-send "$(jq -r .Title)". An empty action leaves the key unbound.
+// A ; of an argument is escaped as \;, e.g. command:cut -f 2 \; echo.
+// The action menu of the entries is parsed the same way.
+func ParseKeyActions(spec string) ([]KeyAction, error) {
+	var actions []KeyAction
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+	for _, s := range splitKeyActions(spec) {
+		name, argument, _ := strings.Cut(strings.TrimSpace(s), ":")
+		action := KeyAction{Action: strings.TrimSpace(name), Argument: strings.TrimSpace(argument)}
+		switch action.Action {
+		case "", KeyActionQR:
+		case KeyActionCopy, KeyActionType, KeyActionCommand:
+			if action.Argument == "" {
+				return nil, fmt.Errorf("action %d: %s needs an argument", len(actions)+1, action.Action)
+			}
+		case KeyActionURL, KeyActionOTP, KeyActionFields, KeyActionAutotype, KeyActionTypeField,
+			KeyActionNotes, KeyActionAttachments, KeyActionHistory:
+			if action.Argument != "" {
+				return nil, fmt.Errorf("action %d: %s has no argument", len(actions)+1, action.Action)
+			}
+		default:
+			return nil, fmt.Errorf("action %d: unknown action %q, supported: copy, type, url, otp, command, fields, autotype, typefield, notes, attachments, history, qr", len(actions)+1, action.Action)
+		}
+		actions = append(actions, action)
+	}
+	if len(actions) > maxCustomKeys {
+		return nil, fmt.Errorf("%d actions, at most %d are supported", len(actions), maxCustomKeys)
+	}
+	return actions, nil
+}
+
+// splitKeyActions splits the actions separated by ;, unescaping \;
+func splitKeyActions(spec string) []string {
+	var actions []string
+	var action strings.Builder
+	for i := 0; i < len(spec); i++ {
+		switch {
+		case strings.HasPrefix(spec[i:], `\;`):
+			action.WriteByte(';')
+			i++
+		case spec[i] == ';':
+			actions = append(actions, action.String())
+			action.Reset()
+		default:
+			action.WriteByte(spec[i])
+		}
+	}
+	return append(actions, action.String())
+}
+
+// keyAction returns the action of the custom key, false if the key is unbound
+func (m *Menu) keyAction(key int) (KeyAction, bool) {
+	actions, err := ParseKeyActions(m.Configuration.General.CustomKeys)
+	if err != nil || key < 1 || key > len(actions) || actions[key-1].Action == "" {
+		return KeyAction{}, false
+	}
+	return actions[key-1], true
+}
+
+// keyActionsHelp describes the custom keys supported by the backend, shown by backends supporting messages
+func keyActionsHelp(menu *Menu) string {
+	backend, err := promptBackend(menu.Configuration)
+	if err != nil {
+		return ""
+	}
+	actions, err := ParseKeyActions(menu.Configuration.General.CustomKeys)
+	if err != nil {
+		log.Printf("invalid custom keys: %s", err)
+		return ""
+	}
+	var help []string
+	for i, action := range actions {
+		if i >= backend.Capabilities().CustomKeys {
+			break
+		}
+		if action.Action != "" {
+			help = append(help, fmt.Sprintf("Alt-%d: %s", i+1, action))
+		}
+	}
+	return strings.Join(help, ", ")
+}
+
+// runKeyAction runs the action of a custom key on the entry
+func (m *Menu) runKeyAction(action KeyAction, entry *Entry, out *PacketResp) ErrorPrompt {
+	var errPrompt ErrorPrompt
+	fe := entry.FullEntry
+	switch action.Action {
+	case KeyActionCopy:
+		value := getContent(fe, action.Argument)
+		if value == "" {
+			errPrompt.Error = fmt.Errorf("the entry has no field %s", action.Argument)
+			return errPrompt
+		}
+		return m.copyField(entry, action.Argument, value)
+	case KeyActionFields, KeyActionTypeField:
+		field, value, errPrompt := PromptFields(m, entry)
+		if errPrompt.Cancelled || errPrompt.Error != nil {
+			return errPrompt
+		}
+		if value == "" {
+			errPrompt.Error = errors.New("selected field not found")
+			return errPrompt
+		}
+		if action.Action == KeyActionTypeField {
+			return typeField(m, entry, field, value, out)
+		}
+		return m.copyField(entry, field, value)
+	case KeyActionType:
+		return typeSequence(m, entry, action.Argument, out)
+	case KeyActionAutotype:
+		return typeSequence(m, entry, entrySequence(m, entry), out)
+	case KeyActionNotes:
+		notes := fe.GetContent("Notes")
+		if notes == "" {
+			errPrompt.Error = errors.New("the entry has no notes")
+			return errPrompt
+		}
+		return PromptLines(m, "Notes", strings.Split(notes, "\n"))
+	case KeyActionAttachments:
+		lines := entryAttachments(entry)
+		if len(lines) == 0 {
+			errPrompt.Error = errors.New("the entry has no attachments")
+			return errPrompt
+		}
+		return PromptLines(m, "Attachments", lines)
+	case KeyActionHistory:
+		lines := entryHistory(fe)
+		if len(lines) == 0 {
+			errPrompt.Error = errors.New("the entry has no history")
+			return errPrompt
+		}
+		return PromptLines(m, "History", lines)
+	case KeyActionQR:
+		field, value := action.Argument, getContent(fe, action.Argument)
+		if field == "" {
+			// The OTP to set up a phone, or a field to choose
+			if field, value = otpField, entryOTPURI(fe); value == "" {
+				if field, value, errPrompt = PromptFields(m, entry); errPrompt.Cancelled || errPrompt.Error != nil {
+					return errPrompt
+				}
+			}
+		}
+		if value == "" {
+			errPrompt.Error = fmt.Errorf("the entry has no field %s", field)
+			return errPrompt
+		}
+		return m.showQR(entry, field, value)
+	case KeyActionURL:
+		url := fe.GetContent("URL")
+		if url == "" {
+			errPrompt.Error = errors.New("the entry has no URL")
+			return errPrompt
+		}
+		if err := exec.Command("xdg-open", url).Start(); err != nil {
+			errPrompt.Error = fmt.Errorf("failed to open the URL: %s", err)
+		}
+	case KeyActionOTP:
+		otp, err := CreateOTP(fe, time.Now().Unix())
+		if err != nil {
+			errPrompt.Error = fmt.Errorf("failed to create otp: %s", err)
+			return errPrompt
+		}
+		m.logAccess(AccessOTP, entry, otpField)
+		PromptMessage(m, fmt.Sprintf("%s: %s", fe.GetTitle(), otp))
+	case KeyActionCommand:
+		// The values are given on stdin, the arguments of a process are visible to every user.
+		// A JSON object keeps any value, e.g. multiline notes.
+		values := make(map[string]string, len(fe.Values))
+		var fields []string
+		for _, v := range fe.Values {
+			values[v.Key] = v.Value.Content
+			fields = append(fields, v.Key)
+		}
+		input, err := json.Marshal(values)
+		if err != nil {
+			errPrompt.Error = fmt.Errorf("failed to encode the fields of the entry: %s", err)
+			return errPrompt
+		}
+		m.logAccess(AccessCommand, entry, strings.Join(fields, ","))
+		if _, err := run("sh", string(input)+"\n", "-c", action.Argument); err != nil {
+			errPrompt.Error = fmt.Errorf("the command of the custom key failed: %s", err)
+		}
+	}
+	return errPrompt
+}
+
+// copyField copies the value of the field into the clipboard, until the clipboard timeout
+func (m *Menu) copyField(entry *Entry, field, value string) ErrorPrompt {
+	var errPrompt ErrorPrompt
+	if err := CopyToClipboard(m, value); err != nil {
+		errPrompt.Error = fmt.Errorf("failed to use clipboard manager to update clipboard: %s", err)
+		return errPrompt
+	}
+	log.Printf("copied field into the clipboard")
+	m.logAccess(AccessCopy, entry, field)
+	CleanClipboard(m, value)
+	return errPrompt
+}
+
+// showQR shows the value of the field as a QR code: in the terminal with the terminal menu,
+// otherwise as a temporary image opened by the viewer, deleted when the viewer exits. The viewer
+// is not waited for, the daemon keeps serving requests while it is open
+func (m *Menu) showQR(entry *Entry, field, value string) ErrorPrompt {
+	var errPrompt ErrorPrompt
+	code, err := encodeQR([]byte(value))
+	if err != nil {
+		errPrompt.Error = fmt.Errorf("failed to encode the QR code: %s", err)
+		return errPrompt
+	}
+	m.logAccess(AccessQR, entry, field)
+	if m.Configuration.General.Menu == PromptTerminal {
+		err = showTerminalQR(code, fmt.Sprintf("%s: %s", entry.FullEntry.GetTitle(), field))
+	} else {
+		err = showQRImage(m.WaitGroup, m.Configuration.Executable.CustomQRViewer, code)
+	}
+	if err != nil {
+		errPrompt.Error = fmt.Errorf("failed to show the QR code: %s", err)
+	}
+	return errPrompt
+}
+
+// showQRImage writes the code into a temporary PNG file, readable only by the user, and starts
+// the viewer with it: the file is removed once the viewer exits
+func showQRImage(wg *sync.WaitGroup, viewer string, code *qrCode) error {
+	command, err := shlex.Split(viewer)
+	if err != nil || len(command) == 0 {
+		return fmt.Errorf("invalid QR code viewer %q", viewer)
+	}
+	file, err := os.CreateTemp("", "kpmenu-qr-*.png")
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(file, code.image(8)); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	cmd := exec.Command(command[0], append(command[1:], file.Name())...)
+	if err := cmd.Start(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := cmd.Wait(); err != nil {
+			log.Printf("QR code viewer failed: %s", err)
+		}
+		os.Remove(file.Name())
+	}()
+	return nil
+}
+
+// entryAttachments describes the attachments of the entry, their names and sizes
+func entryAttachments(entry *Entry) []string {
+	var lines []string
+	for _, binary := range entry.FullEntry.Binaries {
+		line := binary.Name
+		if entry.Database != nil {
+			if b := binary.Find(entry.Database.Keepass); b != nil {
+				if content, err := b.GetContentBytes(); err == nil {
+					line = fmt.Sprintf("%s (%d bytes)", binary.Name, len(content))
+				}
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// entryHistory describes the previous versions of the entry, the newest first: when they were
+// replaced and the fields changed, never the values
+func entryHistory(e gokeepasslib.Entry) []string {
+	var versions []gokeepasslib.Entry
+	for _, history := range e.Histories {
+		versions = append(versions, history.Entries...)
+	}
+	var lines []string
+	next := e
+	for i := len(versions) - 1; i >= 0; i-- {
+		var changed []string
+		for _, v := range next.Values {
+			if versions[i].GetContent(v.Key) != v.Value.Content {
+				changed = append(changed, v.Key)
+			}
+		}
+		for _, v := range versions[i].Values {
+			if next.Get(v.Key) == nil {
+				changed = append(changed, v.Key)
+			}
+		}
+		description := "no field changed"
+		if len(changed) > 0 {
+			description = "changed " + strings.Join(changed, ", ")
+		}
+		lines = append(lines, fmt.Sprintf("%s  %s", timeOf(next.Times.LastModificationTime).Local().Format("2006-01-02 15:04"), description))
+		next = versions[i]
+	}
+	if len(versions) > 0 {
+		lines = append(lines, fmt.Sprintf("%s  created", timeOf(next.Times.CreationTime).Local().Format("2006-01-02 15:04")))
+	}
+	return lines
+}
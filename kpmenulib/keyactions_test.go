@@ -0,0 +1,211 @@
+package kpmenulib
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+func TestParseKeyActions(t *testing.T) {
+	actions, err := ParseKeyActions("copy:Password; type:{USERNAME}{TAB} ;;url;otp;command:cat > out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []KeyAction{
+		{KeyActionCopy, "Password"},
+		{KeyActionType, "{USERNAME}{TAB}"},
+		{},
+		{KeyActionURL, ""},
+		{KeyActionOTP, ""},
+		{KeyActionCommand, "cat > out"},
+	}
+	if len(actions) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, actions)
+	}
+	for i := range expected {
+		if actions[i] != expected[i] {
+			t.Errorf("custom key %d: expected %v, got %v", i+1, expected[i], actions[i])
+		}
+	}
+
+	// A ; of a command is escaped
+	actions, err = ParseKeyActions(`command:cut -f 2 \; echo;url`)
+	if err != nil || len(actions) != 2 || actions[0].Argument != "cut -f 2 ; echo" || actions[1].Action != KeyActionURL {
+		t.Errorf("expected the escaped ; to be kept in the command, got %v, %v", actions, err)
+	}
+
+	for _, spec := range []string{"paste:Password", "copy", "url:https://example.com", strings.Repeat("otp;", maxCustomKeys) + "otp"} {
+		if _, err := ParseKeyActions(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
+
+func TestKeyActions(t *testing.T) {
+	menu := &Menu{Configuration: NewConfiguration()}
+	menu.Configuration.General.CustomKeys = "copy:Password;;command:cat > out"
+
+	// The help only has the bound keys the backend supports
+	menu.Configuration.General.Menu = PromptRofi
+	if help := keyActionsHelp(menu); help != "Alt-1: copy Password, Alt-3: run cat" {
+		t.Errorf("unexpected help %q", help)
+	}
+	menu.Configuration.General.Menu = PromptDmenu
+	if help := keyActionsHelp(menu); help != "" {
+		t.Errorf("expected no help without custom keys, got %q", help)
+	}
+	if _, ok := menu.keyAction(2); ok {
+		t.Error("expected the custom key 2 to be unbound")
+	}
+
+	// Menus report the custom keys by exit codes
+	if result, err := executePrompt([]string{"sh", "-c", "echo GitHub; exit 12"}, nil); result != "GitHub" || err.CustomKey != 3 || err.Cancelled {
+		t.Errorf("expected GitHub with the custom key 3, got %q %+v", result, err)
+	}
+
+	// Commands get the fields on stdin
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+	db := NewDatabase(DatabaseSource{Database: "test.kdbx"})
+	entry := newAuditEntry(db, "GitHub", "me", "https://github.com", "secret")
+	entry.FullEntry.Values = append(entry.FullEntry.Values, gokeepasslib.ValueData{Key: "Notes", Value: gokeepasslib.V{Content: "a\nb"}})
+	action, ok := menu.keyAction(3)
+	if !ok {
+		t.Fatal("expected an action for the custom key 3")
+	}
+	if err := menu.runKeyAction(action, &entry, nil); err.Error != nil {
+		t.Fatal(err.Error)
+	}
+	out, err := os.ReadFile(filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]string
+	if err := json.Unmarshal(out, &fields); err != nil || fields["Password"] != "secret" || fields["UserName"] != "me" || fields["Notes"] != "a\nb" {
+		t.Errorf("unexpected input of the command %q", out)
+	}
+}
+
+func TestEntrySelectionCustomKey(t *testing.T) {
+	db := NewDatabase(DatabaseSource{Database: "test.kdbx"})
+	db.Loaded = true
+	db.Entries = []Entry{
+		newAuditEntry(db, "GitHub", "me", "https://github.com", "secret"),
+		newAuditEntry(db, "GitLab", "you", "https://gitlab.com", "hidden"),
+	}
+	menu := &Menu{Configuration: NewConfiguration(), Databases: []*Database{db}, Database: db}
+	menu.Configuration.General.Menu = PromptCustom
+	menu.Configuration.General.CustomKeys = "otp;command:cat > out"
+	// The menu selects the second entry with the custom key 2
+	menu.Configuration.Executable.CustomPromptEntries = `sh -c "sed -n 2p; exit 11"`
+
+	entry, key, err := PromptEntries(menu, "")
+	if err.Error != nil || err.Cancelled {
+		t.Fatalf("unexpected prompt error %+v", err)
+	}
+	if entry.FullEntry.GetTitle() != "GitLab" || key != 2 {
+		t.Fatalf("expected GitLab with the custom key 2, got %q %d", entry.FullEntry.GetTitle(), key)
+	}
+
+	// The action runs without the field selection
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+	if err := menu.entrySelection(""); err != nil {
+		t.Fatal(err.String())
+	}
+	out, errRead := os.ReadFile(filepath.Join(dir, "out"))
+	if errRead != nil || !strings.Contains(string(out), `"Password":"hidden"`) {
+		t.Errorf("expected the fields of GitLab, got %q %v", out, errRead)
+	}
+}
+
+func TestTagSelection(t *testing.T) {
+	db := NewDatabase(DatabaseSource{Database: "test.kdbx"})
+	db.Loaded = true
+	db.Entries = []Entry{
+		newAuditEntry(db, "GitHub", "me", "https://github.com", "secret"),
+		newAuditEntry(db, "GitLab", "you", "https://gitlab.com", "hidden"),
+	}
+	db.Entries[1].FullEntry.Tags = "work"
+	menu := &Menu{Configuration: NewConfiguration(), Databases: []*Database{db}, Database: db}
+	menu.Configuration.General.Menu = PromptCustom
+	menu.Configuration.General.CustomKeys = "command:cat > out"
+	menu.Configuration.Executable.CustomPromptFields = "grep work"
+	// The first entry with the tag, with the custom key 1
+	menu.Configuration.Executable.CustomPromptEntries = `sh -c "head -1; exit 10"`
+
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+	if err := menu.tagSelection(); err != nil {
+		t.Fatal(err.String())
+	}
+	out, errRead := os.ReadFile(filepath.Join(dir, "out"))
+	if errRead != nil || !strings.Contains(string(out), `"Title":"GitLab"`) {
+		t.Errorf("expected the fields of GitLab, got %q %v", out, errRead)
+	}
+	// The daemon serves the next requests with the same configuration
+	if menu.Configuration.Flags.Tag != "" {
+		t.Errorf("expected the configuration to be unchanged, got tag %q", menu.Configuration.Flags.Tag)
+	}
+}
+
+func TestEntryActions(t *testing.T) {
+	db := NewDatabase(DatabaseSource{Database: "test.kdbx"})
+	db.Loaded = true
+	db.Entries = []Entry{newAuditEntry(db, "GitHub", "me", "https://github.com", "secret")}
+	menu := &Menu{Configuration: NewConfiguration(), Databases: []*Database{db}, Database: db}
+	menu.Configuration.General.Menu = PromptCustom
+	menu.Configuration.General.EntryActions = "fields;notes;command:cat > out"
+	menu.Configuration.Executable.CustomPromptEntries = "head -1"
+	// The action menu lists the descriptions of the actions
+	menu.Configuration.Executable.CustomPromptFields = "grep run"
+
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+	if err := menu.entrySelection(""); err != nil {
+		t.Fatal(err.String())
+	}
+	if out, err := os.ReadFile(filepath.Join(dir, "out")); err != nil || !strings.Contains(string(out), `"Password":"secret"`) {
+		t.Errorf("expected the fields of GitHub, got %q %v", out, err)
+	}
+
+	menu.Configuration.General.EntryActions = "notes;history;pastebin"
+	menu.Configuration.Database.Database = "test.kdbx"
+	if err := validateConfig(menu.Configuration); err == nil || !strings.Contains(err.Error(), "entry actions") {
+		t.Errorf("expected an error for an unknown action, got %v", err)
+	}
+}
+
+func TestEntryHistory(t *testing.T) {
+	entry := newAuditEntry(nil, "GitHub", "me", "https://github.com", "secret")
+	if lines := entryHistory(entry.FullEntry); len(lines) != 0 {
+		t.Errorf("expected no history, got %v", lines)
+	}
+
+	previous := entry.FullEntry.Clone()
+	previous.Histories = nil
+	previous.Get("Password").Value.Content = "old"
+	previous.Values = append(previous.Values, gokeepasslib.ValueData{Key: "PIN", Value: gokeepasslib.V{Content: "1234"}})
+	entry.FullEntry.Histories = []gokeepasslib.History{{Entries: []gokeepasslib.Entry{previous}}}
+	lines := entryHistory(entry.FullEntry)
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "changed Password, PIN") || !strings.HasSuffix(lines[1], "created") {
+		t.Errorf("unexpected history %q", lines)
+	}
+	for _, line := range lines {
+		if strings.Contains(line, "old") || strings.Contains(line, "1234") {
+			t.Errorf("the history shows a value: %q", line)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package kpmenulib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// Key file formats, see ParseKeyData
+const (
+	KeyFileXMLv1  = "XML v1"
+	KeyFileXMLv2  = "XML v2"
+	KeyFileBinary = "32 bytes binary"
+	KeyFileHex    = "64 characters hex"
+	KeyFileHashed = "SHA-256 of the file"
+)
+
+// Key file errors
+var (
+	ErrKeyFileEmpty        = errors.New("the key file is empty")
+	ErrKeyFileXML          = errors.New("malformed XML key file")
+	ErrKeyFileVersion      = errors.New("unsupported XML key file version")
+	ErrKeyFileEncoding     = errors.New("invalid encoding of the key data")
+	ErrKeyFileLength       = errors.New("the key data is not 32 bytes long")
+	ErrKeyFileHashMissing  = errors.New("the key data has no hash")
+	ErrKeyFileHashMismatch = errors.New("the key data doesn't match its hash, the key file is corrupted")
+)
+
+// KeyFileError reports why a key file can't be used
+type KeyFileError struct {
+	Path   string // Path of the key file
+	Format string // Detected format, if any
+	Err    error
+}
+
+func (e *KeyFileError) Error() string {
+	if e.Format != "" {
+		return fmt.Sprintf("key file %s (%s): %v", e.Path, e.Format, e.Err)
+	}
+	return fmt.Sprintf("key file %s: %v", e.Path, e.Err)
+}
+
+func (e *KeyFileError) Unwrap() error {
+	return e.Err
+}
+
+// xmlKeyFile is the XML key file of KeePass
+//
+//	<KeyFile>
+//		<Meta><Version>2.0</Version></Meta>
+//		<Key><Data Hash="8DAFDF2A">A7007945 D07D54BA ...</Data></Key>
+//	</KeyFile>
+//
+// Version 1 stores the key as base64, version 2 as hex with the first 4 bytes
+// of its SHA-256 as hash.
+type xmlKeyFile struct {
+	XMLName xml.Name `xml:"KeyFile"`
+	Meta    struct {
+		Version string `xml:"Version"`
+	} `xml:"Meta"`
+	Key struct {
+		Data struct {
+			Hash  string `xml:"Hash,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"Data"`
+	} `xml:"Key"`
+}
+
+// ReadKeyFile reads the key of the key file at path, see ParseKeyData
+func ReadKeyFile(path string) (key []byte, format string, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", &KeyFileError{Path: path, Err: err}
+	}
+	key, format, err = ParseKeyData(data)
+	if err != nil {
+		return nil, format, &KeyFileError{Path: path, Format: format, Err: err}
+	}
+	return key, format, nil
+}
+
+// ParseKeyData returns the 32 bytes key of the content of a key file, and its format.
+// As KeePass does, XML key files are parsed, 32 bytes files are the key itself,
+// 64 characters hex files are decoded and any other file is hashed with SHA-256.
+func ParseKeyData(data []byte) (key []byte, format string, err error) {
+	if len(data) == 0 {
+		return nil, "", ErrKeyFileEmpty
+	}
+
+	// An XML key file must be valid, it isn't hashed as any other file
+	if looksLikeXMLKeyFile(data) {
+		return parseXMLKeyFile(data)
+	}
+
+	if len(data) == 32 {
+		return data, KeyFileBinary, nil
+	}
+	if len(data) == 64 {
+		if key, err := hex.DecodeString(string(data)); err == nil {
+			return key, KeyFileHex, nil
+		}
+	}
+	hash := sha256.Sum256(data)
+	return hash[:], KeyFileHashed, nil
+}
+
+// looksLikeXMLKeyFile tells if data is meant to be an XML key file, i.e. its first element is KeyFile
+func looksLikeXMLKeyFile(data []byte) bool {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return false
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			return t.Name.Local == "KeyFile"
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) > 0 {
+				return false
+			}
+		}
+	}
+}
+
+func parseXMLKeyFile(data []byte) ([]byte, string, error) {
+	var keyFile xmlKeyFile
+	if err := xml.Unmarshal(data, &keyFile); err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrKeyFileXML, err)
+	}
+	value := strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, keyFile.Key.Data.Value)
+
+	switch keyFile.Meta.Version {
+	// 1.00 is written by old versions of KeePass
+	case "1.0", "1.00":
+		key, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, KeyFileXMLv1, fmt.Errorf("%w: %v", ErrKeyFileEncoding, err)
+		}
+		if len(key) != 32 {
+			return nil, KeyFileXMLv1, ErrKeyFileLength
+		}
+		return key, KeyFileXMLv1, nil
+	case "2.0":
+		key, err := hex.DecodeString(value)
+		if err != nil {
+			return nil, KeyFileXMLv2, fmt.Errorf("%w: %v", ErrKeyFileEncoding, err)
+		}
+		if len(key) != 32 {
+			return nil, KeyFileXMLv2, ErrKeyFileLength
+		}
+		if keyFile.Key.Data.Hash == "" {
+			return nil, KeyFileXMLv2, ErrKeyFileHashMissing
+		}
+		hash := sha256.Sum256(key)
+		if !strings.EqualFold(hex.EncodeToString(hash[:4]), keyFile.Key.Data.Hash) {
+			return nil, KeyFileXMLv2, ErrKeyFileHashMismatch
+		}
+		return key, KeyFileXMLv2, nil
+	}
+	return nil, "", fmt.Errorf("%w %q", ErrKeyFileVersion, keyFile.Meta.Version)
+}
@@ -0,0 +1,79 @@
+package kpmenulib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+func TestParseKeyData(t *testing.T) {
+	key := bytes.Repeat([]byte{0xA7, 0x00, 0x79, 0x45}, 8)
+	hash := sha256.Sum256(key)
+	hexKey := strings.ToUpper(hex.EncodeToString(key))
+	xmlV2 := func(hash, data string) string {
+		return fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<KeyFile>
+	<Meta><Version>2.0</Version></Meta>
+	<Key><Data Hash="%s">
+		%s %s
+	</Data></Key>
+</KeyFile>`, hash, data[:32], data[32:])
+	}
+	other := []byte("any content is hashed")
+	otherHash := sha256.Sum256(other)
+
+	for name, test := range map[string]struct {
+		data   string
+		key    []byte
+		format string
+		err    error
+	}{
+		"xml v1":        {"<KeyFile><Meta><Version>1.00</Version></Meta><Key><Data>" + base64.StdEncoding.EncodeToString(key) + "</Data></Key></KeyFile>", key, KeyFileXMLv1, nil},
+		"xml v2":        {xmlV2(fmt.Sprintf("%X", hash[:4]), hexKey), key, KeyFileXMLv2, nil},
+		"xml v2 hash":   {xmlV2("00000000", hexKey), nil, KeyFileXMLv2, ErrKeyFileHashMismatch},
+		"xml v2 data":   {xmlV2(fmt.Sprintf("%X", hash[:4]), "Z"+hexKey[1:]), nil, KeyFileXMLv2, ErrKeyFileEncoding},
+		"xml v2 length": {xmlV2("00000000", hexKey[:60]+"    "), nil, KeyFileXMLv2, ErrKeyFileLength},
+		"xml version":   {"<KeyFile><Meta><Version>3.0</Version></Meta></KeyFile>", nil, "", ErrKeyFileVersion},
+		"xml malformed": {"<KeyFile><Meta>", nil, "", ErrKeyFileXML},
+		"binary":        {string(key), key, KeyFileBinary, nil},
+		"hex":           {hexKey, key, KeyFileHex, nil},
+		"hashed":        {string(other), otherHash[:], KeyFileHashed, nil},
+		"empty":         {"", nil, "", ErrKeyFileEmpty},
+	} {
+		got, format, err := ParseKeyData([]byte(test.data))
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: expected error %v, got %v", name, test.err, err)
+		}
+		if !bytes.Equal(got, test.key) || format != test.format {
+			t.Errorf("%s: expected %x (%s), got %x (%s)", name, test.key, test.format, got, format)
+		}
+		// Valid key files give the same key as KeePass
+		if test.err == nil {
+			if expected, _ := gokeepasslib.ParseKeyData([]byte(test.data)); !bytes.Equal(got, expected) {
+				t.Errorf("%s: expected %x as gokeepasslib, got %x", name, expected, got)
+			}
+		}
+	}
+}
+
+func TestAddCredentialsKeyFileError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.key")
+	if err := os.WriteFile(path, []byte("<KeyFile><Meta><Version>2.0</Version></Meta><Key><Data Hash=\"00\">00</Data></Key></KeyFile>"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db := NewDatabase(DatabaseSource{Database: "db.kdbx", KeyFile: path})
+	err := db.AddCredentialsToDatabase("secret", nil)
+	var keyFileErr *KeyFileError
+	if !errors.As(err, &keyFileErr) || keyFileErr.Path != path || !errors.Is(err, ErrKeyFileLength) {
+		t.Errorf("expected a key file error, got %v", err)
+	}
+}
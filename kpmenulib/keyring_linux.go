@@ -0,0 +1,109 @@
+package kpmenulib
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// keyctl(2) operations, special keyrings and permissions
+const (
+	keyctlRevoke          = 3
+	keyctlSetPerm         = 5
+	keyctlSearch          = 10
+	keyctlRead            = 11
+	keyctlSetTimeout      = 15
+	keyctlInvalidate      = 21
+	keySpecSessionKeyring = -3
+	keySpecUserKeyring    = -4
+	keyPossessorAll       = 0x3f000000
+)
+
+// keyringSearch returns the id of the user key with the description, looking into
+// the session keyring and then the user keyring
+func keyringSearch(description string) (int, error) {
+	keyType, err := syscall.BytePtrFromString("user")
+	if err != nil {
+		return 0, err
+	}
+	desc, err := syscall.BytePtrFromString(description)
+	if err != nil {
+		return 0, err
+	}
+	for _, keyring := range []int{keySpecSessionKeyring, keySpecUserKeyring} {
+		id, _, errno := syscall.Syscall6(syscall.SYS_KEYCTL, keyctlSearch, uintptr(keyring),
+			uintptr(unsafe.Pointer(keyType)), uintptr(unsafe.Pointer(desc)), 0, 0)
+		if errno == 0 {
+			return int(id), nil
+		}
+		err = errno
+	}
+	return 0, err
+}
+
+// keyringRead returns the payload of the key
+func keyringRead(id int) ([]byte, error) {
+	size, _, errno := syscall.Syscall6(syscall.SYS_KEYCTL, keyctlRead, uintptr(id), 0, 0, 0, 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	// The key may change between the calls, retry while it grows
+	for {
+		payload := make([]byte, size)
+		var buffer uintptr
+		if size > 0 {
+			buffer = uintptr(unsafe.Pointer(&payload[0]))
+		}
+		n, _, errno := syscall.Syscall6(syscall.SYS_KEYCTL, keyctlRead, uintptr(id), buffer, size, 0, 0)
+		if errno != 0 {
+			return nil, errno
+		}
+		if n <= size {
+			return payload[:n], nil
+		}
+		wipe(payload)
+		size = n
+	}
+}
+
+// keyringAdd adds a user key to the session keyring, only readable by the processes of the
+// session, and removed by the kernel after timeout, rounded up to the second
+func keyringAdd(description string, payload []byte, timeout time.Duration) error {
+	keyType, err := syscall.BytePtrFromString("user")
+	if err != nil {
+		return err
+	}
+	desc, err := syscall.BytePtrFromString(description)
+	if err != nil {
+		return err
+	}
+	keyring := keySpecSessionKeyring
+	var data uintptr
+	if len(payload) > 0 {
+		data = uintptr(unsafe.Pointer(&payload[0]))
+	}
+	id, _, errno := syscall.Syscall6(syscall.SYS_ADD_KEY, uintptr(unsafe.Pointer(keyType)), uintptr(unsafe.Pointer(desc)),
+		data, uintptr(len(payload)), uintptr(keyring), 0)
+	if errno != 0 {
+		return errno
+	}
+	if _, _, errno = syscall.Syscall(syscall.SYS_KEYCTL, keyctlSetPerm, id, keyPossessorAll); errno == 0 {
+		_, _, errno = syscall.Syscall(syscall.SYS_KEYCTL, keyctlSetTimeout, id, uintptr((timeout+time.Second-1)/time.Second))
+	}
+	if errno != 0 {
+		keyringRemove(int(id))
+		return errno
+	}
+	return nil
+}
+
+// keyringRemove invalidates the key, or revokes it on kernels older than 3.5
+func keyringRemove(id int) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_KEYCTL, keyctlInvalidate, uintptr(id), 0); errno == 0 {
+		return nil
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_KEYCTL, keyctlRevoke, uintptr(id), 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+package kpmenulib
+
+import (
+	"errors"
+	"time"
+)
+
+var errKeyringUnsupported = errors.New("the kernel keyring is only available on Linux")
+
+func keyringSearch(description string) (int, error) {
+	return 0, errKeyringUnsupported
+}
+
+func keyringRead(id int) ([]byte, error) {
+	return nil, errKeyringUnsupported
+}
+
+func keyringAdd(description string, payload []byte, timeout time.Duration) error {
+	return errKeyringUnsupported
+}
+
+func keyringRemove(id int) error {
+	return errKeyringUnsupported
+}
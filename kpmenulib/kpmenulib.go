@@ -2,41 +2,57 @@ package kpmenulib
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"os/exec"
+	"time"
 )
 
 func validateConfig(config *Configuration) error {
 	// Check if database has been selected
-	if config.Database.Database == "" {
+	sources, err := config.DatabaseSources()
+	if err != nil {
+		return err
+	}
+	if len(sources) == 0 {
 		// Database not found
 		return errors.New("you must select a database with -d or via config")
 	}
 
-	// Check if rofi is installed
-	if config.General.Menu == PromptRofi {
-		cmd := exec.Command("which", "rofi")
-		err := cmd.Run()
-		if err != nil {
-			log.Printf("rofi not found, using dmenu")
-			config.General.Menu = PromptDmenu
-		}
-	} else if config.General.Menu == PromptWofi {
-		cmd := exec.Command("which", "wofi")
-		err := cmd.Run()
-		if err != nil {
-			log.Printf("wofi not found, using dmenu")
-			config.General.Menu = PromptDmenu
+	if err := validateCredentialProviders(config.Database.CredentialProviders); err != nil {
+		return err
+	}
+	// The kernel keyring expires keys by the second, a timeout of 0 never expires them
+	if timeout := config.Database.SessionTimeout; timeout > 0 && timeout < time.Second {
+		return fmt.Errorf("session timeout: %s is less than a second", timeout)
+	}
+	if _, err := ParseKeyActions(config.General.CustomKeys); err != nil {
+		return fmt.Errorf("custom keys: %v", err)
+	}
+	if _, err := ParseKeyActions(config.General.EntryActions); err != nil {
+		return fmt.Errorf("entry actions: %v", err)
+	}
+
+	// The terminal menu prompts in the terminal of kpmenu, a server would prompt in its own
+	if config.General.Menu == PromptTerminal {
+		if config.Flags.Daemon {
+			return errors.New("the terminal menu can't be used by the daemon")
 		}
-	} else if config.General.Menu != PromptDmenu && config.General.Menu != PromptCustom {
-		return errors.New("invalid menu option, exiting")
+		config.General.NoCache = true
 	}
 
-	if config.General.Menu == PromptDmenu {
-		// Check if dmenu is installed
-		cmd := exec.Command("which", "dmenu")
-		err := cmd.Run()
-		if err != nil {
+	// Check if the menu is installed, falling back to dmenu
+	backend, err := promptBackend(config)
+	if err != nil {
+		return err
+	}
+	if exe := backend.Executable(); exe != "" && !commandExists(exe) {
+		if config.General.Menu == PromptDmenu {
+			return errors.New("dmenu not found, exiting")
+		}
+		log.Printf("%s not found, using dmenu", exe)
+		config.General.Menu = PromptDmenu
+		if !commandExists("dmenu") {
 			return errors.New("dmenu not found, exiting")
 		}
 	}
@@ -1,21 +1,34 @@
 package kpmenulib
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/tobischo/gokeepasslib/v3"
+	w "github.com/tobischo/gokeepasslib/v3/wrappers"
 )
 
 // Menu is the main structure of kpmenu
 type Menu struct {
-	CacheStart    time.Time       // Cache start time
-	CliArguments  []string        // Arguments of kpmenu
-	Configuration *Configuration  // Configuration of kpmenu
-	Database      *Database       // Database
-	WaitGroup     *sync.WaitGroup // WaitGroup used for goroutines
-	ReloadConfig  func() error    // Call-back to update configuration options
+	CacheStart    time.Time        // Cache start time
+	CliArguments  []string         // Arguments of kpmenu
+	Configuration *Configuration   // Configuration of kpmenu
+	Database      *Database        // Main database
+	Databases     []*Database      // All the databases, the main one first
+	WaitGroup     *sync.WaitGroup  // WaitGroup used for goroutines
+	ReloadConfig  func() error     // Call-back to update configuration options
+	mutex         sync.Mutex       // Serializes requests and database reloads
+	protection    MemoryProtection // Protections of the process, see MemoryProtection
+	client        AccessClient     // Client of the current request, for the access log
+	out           *PacketResp      // Response of the current request, written by the echo typer
+	format        *EntryFormat     // Compiled template of the entries, see entryFormat
+	password      string           // Password of the configuration, until it unlocks the main database
 }
 
 // NewMenu initializes a Menu struct
@@ -27,10 +40,20 @@ func NewMenu(config *Configuration) (*Menu, error) {
 	menu := Menu{
 		CliArguments:  os.Args[1:],
 		Configuration: config,
-		Database:      NewDatabase(),
 		WaitGroup:     new(sync.WaitGroup),
 	}
 
+	// Databases are unlocked when needed
+	sources, err := config.DatabaseSources()
+	if err != nil {
+		return nil, err
+	}
+	for _, source := range sources {
+		menu.Databases = append(menu.Databases, NewDatabase(source))
+	}
+	menu.Database = menu.Databases[0]
+	menu.takePassword(config)
+
 	// Set start cache time, if not a daemon
 	if !config.Flags.Daemon && !config.General.NoCache {
 		menu.CacheStart = time.Now()
@@ -39,9 +62,63 @@ func NewMenu(config *Configuration) (*Menu, error) {
 	return &menu, nil
 }
 
+// useDatabases replaces the databases when the configuration of a request selects other ones,
+// the previous ones are locked
+func (m *Menu) useDatabases(config *Configuration) error {
+	sources, err := config.DatabaseSources()
+	if err != nil {
+		return err
+	}
+	if len(sources) == 0 {
+		return nil
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if len(sources) == len(m.Databases) {
+		same := true
+		for i, db := range m.Databases {
+			same = same && db.Source == sources[i]
+		}
+		if same {
+			return nil
+		}
+	}
+	log.Printf("database configuration is changed, re-opening the database")
+	for _, db := range m.Databases {
+		if db.stopWatch != nil {
+			db.stopWatch()
+			db.stopWatch = nil
+		}
+		db.Lock()
+	}
+	m.Databases = nil
+	for _, source := range sources {
+		m.Databases = append(m.Databases, NewDatabase(source))
+	}
+	m.Database = m.Databases[0]
+	m.password = ""
+	return nil
+}
+
+// takePassword moves the password out of the configuration, which is loaded again at every request,
+// for the next unlock of the main database. Once the database is unlocked it is dropped.
+func (m *Menu) takePassword(config *Configuration) {
+	if password := config.Database.Password; password != "" {
+		if !m.Database.Loaded {
+			m.password = password
+		}
+		config.Database.Password = ""
+	}
+}
+
 // Execute is the function used to open the database (if necessary) and open the menu
 // returns true if the program should exit
 func (menu *Menu) Execute(out *PacketResp) (fatal bool) {
+	menu.mutex.Lock()
+	defer menu.mutex.Unlock()
+	menu.out = out
+
 	// Open database
 	if !menu.Database.Loaded {
 		if err := menu.OpenDatabase(); err != nil {
@@ -49,9 +126,13 @@ func (menu *Menu) Execute(out *PacketResp) (fatal bool) {
 			return err.Fatal
 		}
 	} else if menu.Configuration.Flags.Daemon {
-		// reload Database for next time
+		// Reload databases not watched for next time
 		defer func() {
-			go menu.OpenDatabase()
+			for _, db := range menu.Databases {
+				if db.Loaded && db.stopWatch == nil {
+					go menu.ReloadDatabase(db)
+				}
+			}
 		}()
 	}
 
@@ -75,27 +156,18 @@ func (menu *Menu) Execute(out *PacketResp) (fatal bool) {
 // Show checks if the database configuration is changed, if so it will re-open the database
 // returns true if the program should exit
 func (menu *Menu) Show(out *PacketResp) (fatal bool) {
-	// Be sure that the database configuration is the same, otherwise a Run is necessary
-	copiedDatabase := menu.Configuration.Database
-
-	// If something related to the database is changed we must re-open it, or exit true
-	if copiedDatabase.Database != menu.Configuration.Database.Database ||
-		copiedDatabase.KeyFile != menu.Configuration.Database.KeyFile ||
-		copiedDatabase.KeyFileData != menu.Configuration.Database.KeyFileData ||
-		copiedDatabase.Password != menu.Configuration.Database.Password {
-		menu.Database.Loaded = false
-		log.Printf("database configuration is changed, re-opening the database")
-	}
+	// Databases are locked while a reload may be running
+	menu.mutex.Lock()
 
 	// Check if the cache is not timed out, if not a daemon
 	if !menu.Configuration.Flags.Daemon {
 		if menu.Configuration.General.NoCache {
 			// Cache disabled
-			menu.Database.Loaded = false
+			menu.lockDatabases()
 			log.Printf("no cache flag is set, re-opening the database")
 		} else if (menu.CacheStart.Equal(time.Time{})) {
 			// Cache enabled via client call
-			menu.Database.Loaded = false
+			menu.lockDatabases()
 			log.Printf("cache start time not set, re-opening the database")
 		} else {
 			// Cache exists
@@ -108,52 +180,265 @@ func (menu *Menu) Show(out *PacketResp) (fatal bool) {
 				}
 			} else {
 				// Cache timed out
-				menu.Database.Loaded = false
+				menu.lockDatabases()
 				log.Printf("cache timed out, re-opening the database")
 			}
 		}
 	}
+	menu.mutex.Unlock()
 
 	return menu.Execute(out)
 }
 
-// OpenDatabase asks for password and populates the database
+// OpenDatabase asks for password and populates the main database
 func (m *Menu) OpenDatabase() *ErrorDatabase {
-	// yubikey challenge response need data header
-	m.Database.DeocdeDatabase(m.Configuration)
-
-	if !m.Database.Loaded {
-		// Get password from config otherwise ask for it
-		password := m.Configuration.Database.Password
-		if password == "" {
-			// Get password from user
-			pw, err := PromptPassword(m)
-			if !err.Cancelled {
-				if err.Error != nil {
-					return NewErrorDatabase("failed to get password from dmenu: %s", err.Error, true)
-				}
-			} else {
-				// Exit because cancelled
-				return NewErrorDatabase("exiting because user cancelled password prompt", nil, true)
+	return m.UnlockDatabase(m.Database)
+}
+
+// UnlockDatabase asks for password (if not loaded yet) and populates the database
+// Errors are fatal only for the main database
+func (m *Menu) UnlockDatabase(db *Database) *ErrorDatabase {
+	fatal := db == m.Database
+
+	// Only decode the file again if it changed, with the cached key
+	if db.Loaded {
+		if err := db.Reload(); err != nil {
+			return NewErrorDatabase("failed to open database: %s", err, fatal)
+		}
+		return nil
+	}
+
+	// Try the credential providers in order, until one unlocks the database
+	var failure error = ErrNoCredentials
+	for _, name := range credentialChain(m.Configuration) {
+		err := m.unlockWith(db, name)
+		if err == nil {
+			db.Provider = name
+			log.Printf("database %s unlocked by credential provider %s", db.Name(), name)
+			break
+		}
+		if name == ProviderSession && !errors.Is(err, ErrNoCredentials) {
+			// The database credentials changed, the key is useless
+			if _, err := forgetSessionKey(m, db); err != nil {
+				log.Printf("failed to remove the session key of %s: %s", db.Name(), err)
 			}
-			password = pw
 		}
+		if errors.Is(err, errCredentialsCancelled) {
+			// Exit because cancelled
+			return NewErrorDatabase("exiting because user cancelled password prompt", nil, fatal)
+		}
+		if !errors.Is(err, ErrNoCredentials) {
+			log.Printf("credential provider %s failed for %s: %s", name, db.Name(), err)
+			failure = err
+		}
+	}
+	if db.Provider == "" {
+		PromptError(m, fmt.Sprintf("%s: %s", db.Name(), failure))
+		return NewErrorDatabase("failed to open database: %s", failure, fatal)
+	}
 
-		// Add credentials into the database
-		m.Database.AddCredentialsToDatabase(m.Configuration, password, m.Database.Keepass.Header.FileHeaders.KdfParameters.Salt[:])
+	// Share the unlock with the next processes of the session
+	if m.Configuration.Database.SessionTimeout > 0 && db.Provider != ProviderSession {
+		if err := storeSessionKey(m, db); err != nil {
+			log.Printf("failed to store the session key of %s: %s", db.Name(), err)
+		}
 	}
 
-	// Open database
-	if err := m.Database.OpenDatabase(m.Configuration); err != nil {
-		return NewErrorDatabase("failed to open database: %s", err, true)
+	// Only the composite key is kept, forget the password of the configuration too
+	if db == m.Database {
+		m.password = ""
 	}
 
 	// Get entries of database
-	m.Database.IterateDatabase()
+	db.IterateDatabase()
 
 	// Set database as loaded
-	m.Database.Loaded = true
+	db.Loaded = true
+	if db.key != nil && !db.key.locked {
+		log.Printf("failed to lock the key of %s in memory, it may be swapped (see ulimit -l)", db.Name())
+	}
+	log.Printf("memory protection: %s", m.MemoryProtection())
+
+	// Keep the database up to date while caching it
+	if !m.Configuration.General.NoWatch && (m.Configuration.Flags.Daemon || !m.Configuration.General.NoCache) {
+		if err := m.WatchDatabase(db); err != nil {
+			log.Printf("failed to watch database file: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// unlockWith decodes the database with the credentials of the provider, the database is locked on failure
+func (m *Menu) unlockWith(db *Database, provider string) error {
+	// yubikey challenge response need data header
+	db.DeocdeDatabase()
+
+	credentials, err := credentialProviders[provider](m, db)
+	if err == nil {
+		err = db.AddCredentials(credentials, db.challenge())
+	}
+	if err == nil {
+		err = db.protectCredentials()
+	}
+	if err == nil {
+		err = db.OpenDatabase()
+	}
+	if err != nil {
+		db.Lock()
+	}
+	return err
+}
+
+// UnlockAll unlocks every database not loaded yet
+// Databases failing to unlock are skipped
+func (m *Menu) UnlockAll() {
+	for _, db := range m.Databases {
+		if !db.Loaded {
+			if err := m.UnlockDatabase(db); err != nil {
+				log.Printf("database %s not unlocked: %s", db.Source.Database, err)
+			}
+		}
+	}
+}
+
+// Entries returns the entries of all the loaded databases, with the tag if not empty
+func (m *Menu) Entries(tag string) []Entry {
+	var entries []Entry
+	for _, db := range m.Databases {
+		if !db.Loaded {
+			continue
+		}
+		for _, e := range db.Entries {
+			if tag == "" || e.HasTag(tag) {
+				entries = append(entries, e)
+			}
+		}
+	}
+	return entries
+}
+
+// Tags returns the sorted tags of the entries of all the loaded databases.
+// Tags differing only by case are the same tag.
+func (m *Menu) Tags() []string {
+	var tags []string
+	for _, db := range m.loadedDatabases() {
+		for _, e := range db.Entries {
+			for _, tag := range e.Tags() {
+				if !containsFold(tags, tag) {
+					tags = append(tags, tag)
+				}
+			}
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return strings.ToLower(tags[i]) < strings.ToLower(tags[j]) })
+	return tags
+}
+
+// loadedDatabases returns the databases already unlocked
+func (m *Menu) loadedDatabases() []*Database {
+	var loaded []*Database
+	for _, db := range m.Databases {
+		if db.Loaded {
+			loaded = append(loaded, db)
+		}
+	}
+	return loaded
+}
+
+// LockAll locks every database, waiting for pending reloads
+func (m *Menu) LockAll() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.lockDatabases()
+}
 
+// MemoryProtection reports the protections of the secrets in memory
+func (m *Menu) MemoryProtection() MemoryProtection {
+	protection := m.protection
+	loaded := m.loadedDatabases()
+	protection.KeyLocked = len(loaded) > 0
+	for _, db := range loaded {
+		if db.key == nil || !db.key.locked {
+			protection.KeyLocked = false
+		}
+	}
+	return protection
+}
+
+// lockDatabases locks every database, they must be unlocked again
+func (m *Menu) lockDatabases() {
+	for _, db := range m.Databases {
+		db.Lock()
+	}
+}
+
+// ReloadDatabase decodes the database file again with the cached credentials.
+// On failure, e.g. if the file is being written, the loaded database is kept.
+func (m *Menu) ReloadDatabase(db *Database) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !db.Loaded {
+		return
+	}
+	if err := db.Reload(); err != nil {
+		log.Printf("failed to reload database %s, keeping the loaded one: %s", db.Source.Database, err)
+	}
+}
+
+// MergeDatabase merges the file name into the database, see Database.MergeFile
+func (m *Menu) MergeDatabase(db *Database, name string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !db.Loaded {
+		return
+	}
+	summary, err := db.MergeFile(name)
+	if err != nil {
+		log.Printf("failed to merge %s into %s: %s", name, db.Source.Database, err)
+		return
+	}
+	log.Printf("merged %s into %s: %s", name, db.Source.Database, summary)
+}
+
+// WatchDatabase reloads the database whenever its file changes.
+// With autoMerge, sync conflict copies of the file are merged into the database.
+func (m *Menu) WatchDatabase(db *Database) error {
+	if db.stopWatch != nil {
+		return nil
+	}
+	var related func(base, name string) bool
+	if m.Configuration.General.AutoMerge {
+		related = isConflictFile
+	}
+	changes, stop, err := watchFile(db.Source.Database, related)
+	if err != nil {
+		return err
+	}
+	db.stopWatch = stop
+
+	go func() {
+		// Wait for the writes to settle before reading a file
+		timers := make(map[string]*time.Timer)
+		for name := range changes {
+			if timer, ok := timers[name]; ok {
+				timer.Reset(watchDelay)
+				continue
+			}
+			name := name
+			if name == db.Source.Database {
+				timers[name] = time.AfterFunc(watchDelay, func() { m.ReloadDatabase(db) })
+			} else {
+				timers[name] = time.AfterFunc(watchDelay, func() { m.MergeDatabase(db, name) })
+			}
+		}
+		for _, timer := range timers {
+			timer.Stop()
+		}
+	}()
+	log.Printf("watching database file %s for changes", db.Source.Database)
 	return nil
 }
 
@@ -170,23 +455,56 @@ func (m *Menu) OpenMenu() *ErrorDatabase {
 	}
 	switch selectedMenu {
 	case MenuShow:
-		return m.entrySelection()
+		return m.entrySelection(m.Configuration.Flags.Tag)
+	case MenuTags:
+		return m.tagSelection()
+	case MenuNew:
+		_, err := m.newEntry("")
+		return err
+	case MenuEdit:
+		return m.editSelection()
+	case MenuGenerate:
+		return m.generateSelection()
+	case MenuAudit:
+		return m.auditSelection()
 	case MenuReload:
 		log.Printf("reloading database")
-		if err := m.OpenDatabase(); err != nil {
-			return err
+		for _, db := range m.loadedDatabases() {
+			if err := m.UnlockDatabase(db); err != nil {
+				return err
+			}
 		}
 		return m.OpenMenu()
 	case MenuExit:
-		m.Database.Loaded = false
+		m.lockDatabases()
 		return NewErrorDatabase("exiting", nil, true)
 	}
 	return nil
 }
 
-func (m *Menu) entrySelection() *ErrorDatabase {
+// tagSelection lists the tags, then the entries with the chosen tag
+func (m *Menu) tagSelection() *ErrorDatabase {
+	tags := m.Tags()
+	if len(tags) == 0 {
+		return NewErrorDatabase("no entry has tags", nil, false)
+	}
+	sel, err := PromptChoose(m, tags)
+	if err.Cancelled || err.Error != nil {
+		if err.Error != nil {
+			return NewErrorDatabase("failed to select tag: %s", err.Error, false)
+		}
+		return NewErrorDatabase("", nil, false)
+	}
+	if sel == -1 {
+		return NewErrorDatabase("selected tag not found", nil, false)
+	}
+	return m.entrySelection(tags[sel])
+}
+
+// entrySelection lists the entries, with the tag if not empty, then the fields of the chosen one
+func (m *Menu) entrySelection(tag string) *ErrorDatabase {
 	// Prompt for entry selection
-	selectedEntry, err := PromptEntries(m)
+	selectedEntry, key, err := PromptEntries(m, tag)
 	if err.Cancelled {
 		if err.Error != nil {
 			return NewErrorDatabase("failed to select entry: %s", err.Error, false)
@@ -194,13 +512,39 @@ func (m *Menu) entrySelection() *ErrorDatabase {
 		// Cancelled
 		return NewErrorDatabase("", nil, false)
 	}
-	if selectedEntry == nil {
+	if selectedEntry == nil || selectedEntry.Database == nil {
 		// Entry not found
 		return NewErrorDatabase("selected entry not found", nil, false)
 	}
 
+	// Custom keys run their action directly
+	if key != 0 {
+		if err := runCustomKey(m, selectedEntry, key, m.out); err.Error != nil {
+			return NewErrorDatabase("failed to run the action of the custom key: %s", err.Error, false)
+		}
+		return nil
+	}
+
+	// Prompt for the action, if configured, copying a field is the default one
+	if actions, _ := ParseKeyActions(m.Configuration.General.EntryActions); len(actions) > 0 {
+		action, err := PromptAction(m, selectedEntry, actions)
+		if err.Cancelled || err.Error != nil || action.Action == "" {
+			if err.Error != nil {
+				return NewErrorDatabase("failed to select action: %s", err.Error, false)
+			}
+			// Cancelled
+			return NewErrorDatabase("", nil, false)
+		}
+		if action.Action != KeyActionFields {
+			if err := m.runKeyAction(action, selectedEntry, m.out); err.Error != nil {
+				return NewErrorDatabase("failed to run the action: %s", err.Error, false)
+			}
+			return nil
+		}
+	}
+
 	// Prompt for field selection
-	fieldValue, err := PromptFields(m, selectedEntry)
+	field, fieldValue, err := PromptFields(m, selectedEntry)
 	if err.Cancelled {
 		if err.Error != nil {
 			return NewErrorDatabase("failed to select field: %s", err.Error, false)
@@ -218,12 +562,233 @@ func (m *Menu) entrySelection() *ErrorDatabase {
 		return NewErrorDatabase("failed to use clipboard manager to update clipboard: %s", err, true)
 	}
 	log.Printf("copied field into the clipboard")
+	m.logAccess(AccessCopy, selectedEntry, field)
 
 	// Clean clipboard (goroutine)
 	CleanClipboard(m, fieldValue)
 	return nil
 }
 
+func (m *Menu) editSelection() *ErrorDatabase {
+	// Prompt for entry selection, custom keys select the entry too
+	selectedEntry, _, err := PromptEntries(m, m.Configuration.Flags.Tag)
+	if err.Cancelled {
+		if err.Error != nil {
+			return NewErrorDatabase("failed to select entry: %s", err.Error, false)
+		}
+		// Cancelled
+		return NewErrorDatabase("", nil, false)
+	}
+	if selectedEntry == nil || selectedEntry.Database == nil {
+		// Entry not found
+		return NewErrorDatabase("selected entry not found", nil, false)
+	}
+
+	// Prompt for field selection
+	field, err := PromptFieldName(m, selectedEntry)
+	if err.Cancelled || err.Error != nil {
+		if err.Error != nil {
+			return NewErrorDatabase("failed to select field: %s", err.Error, false)
+		}
+		// Cancelled
+		return NewErrorDatabase("", nil, false)
+	}
+	if field == "" {
+		return NewErrorDatabase("no field selected", nil, false)
+	}
+	return m.editField(selectedEntry, field)
+}
+
+// editField prompts for the new value of the field and saves it into the database
+func (m *Menu) editField(selectedEntry *Entry, field string) *ErrorDatabase {
+	// Prompt for the new value, hidden for protected fields
+	hidden := field == "Password"
+	if v := selectedEntry.FullEntry.Get(field); v != nil && v.Value.Protected.Bool {
+		hidden = true
+	}
+	value, err := PromptInput(m, field, hidden)
+	if err.Cancelled || err.Error != nil {
+		if err.Error != nil {
+			return NewErrorDatabase("failed to read new value: %s", err.Error, false)
+		}
+		// Cancelled
+		return NewErrorDatabase("", nil, false)
+	}
+
+	// Write the change into the database file
+	if err := selectedEntry.Database.SetEntryField(selectedEntry.UUID, field, value); err != nil {
+		return NewErrorDatabase("failed to save database: %s", err, false)
+	}
+	log.Printf("updated field %s of entry %s", field, selectedEntry.FullEntry.GetTitle())
+	return nil
+}
+
+// auditSelection lists the entries with the worst passwords, the password of the chosen one is edited
+func (m *Menu) auditSelection() *ErrorDatabase {
+	report, errAudit := m.Audit()
+	if errAudit != nil {
+		return NewErrorDatabase("failed to audit passwords: %s", errAudit, false)
+	}
+	findings := report.Findings
+	if len(findings) == 0 {
+		return NewErrorDatabase("no issue found by the audit", nil, false)
+	}
+	if len(findings) > maxAuditFindings {
+		findings = findings[:maxAuditFindings]
+	}
+	items := make([]string, len(findings))
+	for i, f := range findings {
+		items[i] = fmt.Sprintf("%s - %s", f.Title, f.Summary())
+	}
+	sel, err := PromptChoose(m, items)
+	if err.Cancelled || err.Error != nil || sel == -1 {
+		if err.Error != nil {
+			return NewErrorDatabase("failed to select entry: %s", err.Error, false)
+		}
+		// Cancelled
+		return NewErrorDatabase("", nil, false)
+	}
+	return m.editField(&findings[sel].Entry, "Password")
+}
+
+// generateSelection generates a password with the selected profile into the clipboard
+func (m *Menu) generateSelection() *ErrorDatabase {
+	profiles, errProfiles := PasswordProfiles(m.Configuration)
+	if errProfiles != nil {
+		return NewErrorDatabase("invalid generator configuration: %s", errProfiles, false)
+	}
+	items := make([]string, len(profiles))
+	for i, p := range profiles {
+		items[i] = p.String()
+	}
+	sel, err := PromptChoose(m, items)
+	if err.Cancelled || err.Error != nil || sel == -1 {
+		if err.Error != nil {
+			return NewErrorDatabase("failed to select profile: %s", err.Error, false)
+		}
+		// Cancelled
+		return NewErrorDatabase("", nil, false)
+	}
+
+	password, errGen := profiles[sel].Generate()
+	if errGen != nil {
+		return NewErrorDatabase("failed to generate password: %s", errGen, false)
+	}
+
+	// Copy to clipboard
+	if err := CopyToClipboard(m, password); err != nil {
+		return NewErrorDatabase("failed to use clipboard manager to update clipboard: %s", err, true)
+	}
+	log.Printf("copied generated password into the clipboard")
+
+	// Clean clipboard (goroutine)
+	CleanClipboard(m, password)
+	return nil
+}
+
+// newEntry prompts for the fields of a new entry and saves it into the database.
+// If window is set, it is proposed as title and used as autotype window association.
+func (m *Menu) newEntry(window string) (*Entry, *ErrorDatabase) {
+	prompt := func(label string, hidden bool, suggestions ...string) (string, *ErrorDatabase) {
+		value, err := PromptInput(m, label, hidden, suggestions...)
+		if err.Cancelled || err.Error != nil {
+			if err.Error != nil {
+				return "", NewErrorDatabase("failed to read "+label+": %s", err.Error, false)
+			}
+			// Cancelled
+			return "", NewErrorDatabase("", nil, false)
+		}
+		return value, nil
+	}
+
+	// Select the database when more are unlocked
+	db := m.Database
+	if loaded := m.loadedDatabases(); len(loaded) > 1 {
+		items := make([]string, len(loaded))
+		for i, l := range loaded {
+			items[i] = l.Name()
+		}
+		sel, errPrompt := PromptChoose(m, items)
+		if errPrompt.Cancelled || errPrompt.Error != nil || sel == -1 {
+			if errPrompt.Error != nil {
+				return nil, NewErrorDatabase("failed to select database: %s", errPrompt.Error, false)
+			}
+			// Cancelled
+			return nil, NewErrorDatabase("", nil, false)
+		}
+		db = loaded[sel]
+	}
+
+	group, err := prompt("Group", false, db.GroupPaths()...)
+	if err != nil {
+		return nil, err
+	}
+	var suggestions []string
+	if window != "" {
+		suggestions = append(suggestions, window)
+	}
+	title, err := prompt("Title", false, suggestions...)
+	if err != nil {
+		return nil, err
+	}
+	username, err := prompt("UserName", false)
+	if err != nil {
+		return nil, err
+	}
+	url, err := prompt("URL", false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Password is either typed or generated with a profile
+	profiles, errProfiles := PasswordProfiles(m.Configuration)
+	if errProfiles != nil {
+		return nil, NewErrorDatabase("invalid generator configuration: %s", errProfiles, false)
+	}
+	items := []string{"Type password"}
+	for _, p := range profiles {
+		items = append(items, "Generate "+p.String())
+	}
+	sel, errPrompt := PromptChoose(m, items)
+	if errPrompt.Cancelled || errPrompt.Error != nil || sel == -1 {
+		if errPrompt.Error != nil {
+			return nil, NewErrorDatabase("failed to select password source: %s", errPrompt.Error, false)
+		}
+		// Cancelled
+		return nil, NewErrorDatabase("", nil, false)
+	}
+	var password string
+	if sel > 0 {
+		var errGen error
+		if password, errGen = profiles[sel-1].Generate(); errGen != nil {
+			return nil, NewErrorDatabase("failed to generate password: %s", errGen, false)
+		}
+	} else if password, err = prompt(m.Configuration.Style.TextPassword, true); err != nil {
+		return nil, err
+	}
+
+	entry := gokeepasslib.NewEntry()
+	entry.AutoType.Enabled = w.NewBoolWrapper(true)
+	entry.Values = []gokeepasslib.ValueData{
+		{Key: "Title", Value: gokeepasslib.V{Content: title}},
+		{Key: "UserName", Value: gokeepasslib.V{Content: username}},
+		{Key: "Password", Value: gokeepasslib.V{Content: password, Protected: w.NewBoolWrapper(true)}},
+		{Key: "URL", Value: gokeepasslib.V{Content: url}},
+		{Key: "Notes", Value: gokeepasslib.V{Content: ""}},
+	}
+	if window != "" {
+		entry.AutoType.Associations = []gokeepasslib.AutoTypeAssociation{{Window: window}}
+	}
+
+	// Write the entry into the database file
+	added, errAdd := db.AddEntry(group, entry)
+	if errAdd != nil {
+		return nil, NewErrorDatabase("failed to save database: %s", errAdd, false)
+	}
+	log.Printf("created entry %s", title)
+	return added, nil
+}
+
 // ErrorDatabase is an error that can be fatal or non-fatal
 type ErrorDatabase struct {
 	Message       string
@@ -0,0 +1,395 @@
+package kpmenulib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tobischo/gokeepasslib/v3"
+	w "github.com/tobischo/gokeepasslib/v3/wrappers"
+)
+
+// MergeSummary counts the changes made by a merge
+type MergeSummary struct {
+	Added       int // Entries only in the other database
+	Updated     int // Entries more recent in the other database
+	Kept        int // Entries more recent in this database, the other version is kept in history
+	Deleted     int // Entries and groups deleted in the other database
+	GroupsAdded int // Groups only in the other database
+}
+
+// Changed tells if the merge changed the database
+func (s MergeSummary) Changed() bool {
+	return s != MergeSummary{}
+}
+
+func (s MergeSummary) String() string {
+	return fmt.Sprintf("%d added, %d updated, %d kept, %d deleted, %d groups added",
+		s.Added, s.Updated, s.Kept, s.Deleted, s.GroupsAdded)
+}
+
+// Merge merges the content of other into the database.
+//
+// Entries and groups are matched by UUID, wherever they are in the tree. For entries
+// in both databases the most recently modified version wins, the other one is kept
+// in the history, and an entry moved goes into the group of its latest move.
+// Objects deleted in one database are deleted in the other one too, unless
+// they were modified after the deletion.
+func (db *Database) Merge(other *Database) MergeSummary {
+	var summary MergeSummary
+	root := db.Keepass.Content.Root
+
+	// Deletions of both databases, the latest one wins
+	deleted := make(map[gokeepasslib.UUID]time.Time)
+	for _, objects := range [][]gokeepasslib.DeletedObjectData{root.DeletedObjects, other.Keepass.Content.Root.DeletedObjects} {
+		for _, o := range objects {
+			if t := timeOf(o.DeletionTime); t.After(deleted[o.UUID]) || deleted[o.UUID].IsZero() {
+				deleted[o.UUID] = t
+			}
+		}
+	}
+
+	// Groups and entries of the other database
+	var mergeGroups func(parent gokeepasslib.UUID, groups []gokeepasslib.Group)
+	mergeGroups = func(parent gokeepasslib.UUID, groups []gokeepasslib.Group) {
+		for _, g := range groups {
+			if isDeleted(deleted, g.UUID, g.Times) {
+				continue
+			}
+			if findGroup(root.Groups, g.UUID) == nil {
+				newGroup := g
+				newGroup.Entries = nil
+				newGroup.Groups = nil
+				if p := findGroup(root.Groups, parent); p != nil {
+					p.Groups = append(p.Groups, newGroup)
+				} else {
+					root.Groups[0].Groups = append(root.Groups[0].Groups, newGroup)
+				}
+				summary.GroupsAdded++
+			}
+			for _, e := range g.Entries {
+				db.mergeEntry(g.UUID, e, deleted, &summary)
+			}
+			mergeGroups(g.UUID, g.Groups)
+		}
+	}
+	for _, g := range other.Keepass.Content.Root.Groups {
+		// The root groups match even if created separately, a database without groups takes the other one
+		if len(root.Groups) == 0 {
+			newGroup := g
+			newGroup.Entries = nil
+			newGroup.Groups = nil
+			root.Groups = append(root.Groups, newGroup)
+			summary.GroupsAdded++
+		}
+		target := root.Groups[0].UUID
+		if findGroup(root.Groups, g.UUID) != nil {
+			target = g.UUID
+		}
+		for _, e := range g.Entries {
+			db.mergeEntry(target, e, deleted, &summary)
+		}
+		mergeGroups(target, g.Groups)
+	}
+
+	// Apply the deletions to this database
+	for uuid := range deleted {
+		if e := db.findEntry(uuid); e != nil && isDeleted(deleted, uuid, e.Times) {
+			removeEntry(root.Groups, uuid)
+			summary.Deleted++
+		} else if g := findGroup(root.Groups, uuid); g != nil && isDeleted(deleted, uuid, g.Times) {
+			removeGroup(&root.Groups, uuid)
+			summary.Deleted++
+		}
+	}
+	root.DeletedObjects = root.DeletedObjects[:0]
+	for uuid, t := range deleted {
+		deletionTime := w.TimeWrapper{Time: t}
+		root.DeletedObjects = append(root.DeletedObjects, gokeepasslib.DeletedObjectData{
+			UUID:         uuid,
+			DeletionTime: &deletionTime,
+		})
+	}
+	sort.Slice(root.DeletedObjects, func(i, j int) bool {
+		return root.DeletedObjects[i].DeletionTime.Time.Before(root.DeletedObjects[j].DeletionTime.Time)
+	})
+
+	db.IterateDatabase()
+	return summary
+}
+
+// mergeEntry merges the entry of the other database, adding it into the group identified by parent if missing
+func (db *Database) mergeEntry(parent gokeepasslib.UUID, theirs gokeepasslib.Entry, deleted map[gokeepasslib.UUID]time.Time, summary *MergeSummary) {
+	if isDeleted(deleted, theirs.UUID, theirs.Times) {
+		return
+	}
+	ours := db.findEntry(theirs.UUID)
+	if ours == nil {
+		groups := db.Keepass.Content.Root.Groups
+		g := findGroup(groups, parent)
+		if g == nil {
+			g = &groups[0]
+		}
+		g.Entries = append(g.Entries, theirs)
+		summary.Added++
+		return
+	}
+
+	oursTime, theirsTime := timeOf(ours.Times.LastModificationTime), timeOf(theirs.Times.LastModificationTime)
+	// The entry follows the latest move, or the latest version when the moves are not dated
+	oursMove, theirsMove := timeOf(ours.Times.LocationChanged), timeOf(theirs.Times.LocationChanged)
+	move := theirsMove.After(oursMove) || (theirsMove.Equal(oursMove) && theirsTime.After(oursTime))
+	switch {
+	case theirsTime.After(oursTime):
+		// Their version wins, ours goes into the history
+		history := mergeHistories(ours, &theirs)
+		previous := *ours
+		previous.Histories = nil
+		*ours = theirs
+		ours.Histories = []gokeepasslib.History{{Entries: history}}
+		if !move {
+			ours.Times.LocationChanged = previous.Times.LocationChanged
+		}
+		if !hasHistory(history, oursTime) {
+			db.addHistory(ours, previous)
+		}
+		summary.Updated++
+	case oursTime.After(theirsTime):
+		// Our version wins, theirs goes into the history if not there yet
+		history := mergeHistories(ours, &theirs)
+		ours.Histories = []gokeepasslib.History{{Entries: history}}
+		if !hasHistory(history, theirsTime) {
+			previous := theirs
+			previous.Histories = nil
+			db.addHistory(ours, previous)
+		}
+		if move {
+			ours.Times.LocationChanged = theirs.Times.LocationChanged
+		}
+		summary.Kept++
+	case move:
+		ours.Times.LocationChanged = theirs.Times.LocationChanged
+		summary.Updated++
+	}
+	if move {
+		db.moveEntry(theirs.UUID, parent)
+	}
+}
+
+// moveEntry moves the entry into the group identified by parent, if it is in another group
+func (db *Database) moveEntry(uuid, parent gokeepasslib.UUID) {
+	groups := db.Keepass.Content.Root.Groups
+	from, to := findEntryGroup(groups, uuid), findGroup(groups, parent)
+	if from == nil || to == nil || from == to {
+		return
+	}
+	for i := range from.Entries {
+		if from.Entries[i].UUID.Compare(uuid) {
+			to.Entries = append(to.Entries, from.Entries[i])
+			from.Entries = append(from.Entries[:i:i], from.Entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// mergeHistories returns the union of the histories of a and b, ordered by modification time
+func mergeHistories(a, b *gokeepasslib.Entry) []gokeepasslib.Entry {
+	var merged []gokeepasslib.Entry
+	for _, e := range []*gokeepasslib.Entry{a, b} {
+		for _, h := range e.Histories {
+			for _, old := range h.Entries {
+				if !hasHistory(merged, timeOf(old.Times.LastModificationTime)) {
+					merged = append(merged, old)
+				}
+			}
+		}
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		return timeOf(merged[i].Times.LastModificationTime).Before(timeOf(merged[j].Times.LastModificationTime))
+	})
+	return merged
+}
+
+func hasHistory(history []gokeepasslib.Entry, t time.Time) bool {
+	for _, h := range history {
+		if timeOf(h.Times.LastModificationTime).Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// isDeleted tells if the object was deleted after its last modification
+func isDeleted(deleted map[gokeepasslib.UUID]time.Time, uuid gokeepasslib.UUID, times gokeepasslib.TimeData) bool {
+	t, ok := deleted[uuid]
+	return ok && !timeOf(times.LastModificationTime).After(t)
+}
+
+func timeOf(t *w.TimeWrapper) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return t.Time
+}
+
+// findGroup returns a pointer to the group identified by uuid into groups and their subgroups
+func findGroup(groups []gokeepasslib.Group, uuid gokeepasslib.UUID) *gokeepasslib.Group {
+	for i := range groups {
+		if groups[i].UUID.Compare(uuid) {
+			return &groups[i]
+		}
+		if g := findGroup(groups[i].Groups, uuid); g != nil {
+			return g
+		}
+	}
+	return nil
+}
+
+// findEntryGroup returns a pointer to the group of the entry identified by uuid into groups and their subgroups
+func findEntryGroup(groups []gokeepasslib.Group, uuid gokeepasslib.UUID) *gokeepasslib.Group {
+	for i := range groups {
+		for j := range groups[i].Entries {
+			if groups[i].Entries[j].UUID.Compare(uuid) {
+				return &groups[i]
+			}
+		}
+		if g := findEntryGroup(groups[i].Groups, uuid); g != nil {
+			return g
+		}
+	}
+	return nil
+}
+
+func removeEntry(groups []gokeepasslib.Group, uuid gokeepasslib.UUID) bool {
+	for i := range groups {
+		for j := range groups[i].Entries {
+			if groups[i].Entries[j].UUID.Compare(uuid) {
+				groups[i].Entries = append(groups[i].Entries[:j:j], groups[i].Entries[j+1:]...)
+				return true
+			}
+		}
+		if removeEntry(groups[i].Groups, uuid) {
+			return true
+		}
+	}
+	return false
+}
+
+func removeGroup(groups *[]gokeepasslib.Group, uuid gokeepasslib.UUID) bool {
+	for i := range *groups {
+		if (*groups)[i].UUID.Compare(uuid) {
+			*groups = append((*groups)[:i:i], (*groups)[i+1:]...)
+			return true
+		}
+		if removeGroup(&(*groups)[i].Groups, uuid) {
+			return true
+		}
+	}
+	return false
+}
+
+// MergeFile merges the database file name, unlocked with the same credentials, and saves the database.
+// The key data of a challenge-response command is answered again for the challenge of the file.
+// The database file is backed up before being saved. If saving fails, the database is read again
+// from its file, the merge is not kept in memory.
+func (db *Database) MergeFile(name string) (MergeSummary, error) {
+	other := NewDatabase(DatabaseSource{Database: name, KeyFileData: db.Source.KeyFileData})
+	// The merged entries may refer to the values of the other database, only its key is destroyed
+	defer func() { other.key.Destroy() }()
+	// The challenge is in the header of the file
+	other.DeocdeDatabase()
+	err := other.AddCredentials(db.mergeCredentials(), other.challenge())
+	if err == nil {
+		err = other.protectCredentials()
+	}
+	if err == nil {
+		err = other.OpenDatabase()
+	}
+	if err != nil {
+		return MergeSummary{}, fmt.Errorf("failed to open %s: %v", name, err)
+	}
+
+	summary := db.Merge(other)
+	if !summary.Changed() {
+		return summary, nil
+	}
+	backup, err := db.Backup()
+	if err != nil {
+		err = fmt.Errorf("failed to backup database: %v", err)
+	} else {
+		log.Printf("backed up %s into %s", db.Source.Database, backup)
+		err = db.SaveDatabase()
+	}
+	if err != nil {
+		if errReload := db.ReadAgain(); errReload != nil {
+			log.Printf("failed to read %s again: %s", db.Source.Database, errReload)
+		}
+		return summary, err
+	}
+	return summary, nil
+}
+
+// mergeCredentials returns the credentials of the database for another file: a copy of its composite
+// key, without the key data when it is the response to the challenge of the database file
+func (db *Database) mergeCredentials() Credentials {
+	c := db.Keepass.Credentials
+	key := make([]byte, 0, len(c.Passphrase)+len(c.Key)+len(c.Windows))
+	key = append(append(append(key, c.Passphrase...), c.Key...), c.Windows...)
+	// The key data is the last 32 bytes, see ParseKeyData
+	if n := len(key) - 32; db.challengeResponse() && n >= 0 {
+		wipe(key[n:])
+		return Credentials{BaseKey: key[:n]}
+	}
+	return Credentials{Key: key}
+}
+
+// Backup copies the database file into the cache folder
+// Returns the path of the backup
+func (db *Database) Backup() (string, error) {
+	dir := filepath.Join(os.Getenv("HOME"), ".cache/kpmenu/backups")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	src, err := os.Open(db.Source.Database)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	// Backups made in the same second are numbered
+	base := filepath.Join(dir, fmt.Sprintf("%s.%s", filepath.Base(db.Source.Database), time.Now().Format("20060102-150405")))
+	name := base
+	dst, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	for i := 1; errors.Is(err, os.ErrExist); i++ {
+		name = fmt.Sprintf("%s-%d", base, i)
+		dst, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(dst, src); err == nil {
+		err = dst.Sync()
+	}
+	if errClose := dst.Close(); err == nil {
+		err = errClose
+	}
+	return name, err
+}
+
+// isConflictFile tells if name is a conflict copy of the database file base, as made by
+// Syncthing (base.sync-conflict-DATE-TIME-ID.kdbx) or Nextcloud (base (conflicted copy DATE TIME).kdbx)
+func isConflictFile(base, name string) bool {
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	if name == base || !strings.HasPrefix(name, stem) || !strings.HasSuffix(name, ext) {
+		return false
+	}
+	middle := name[len(stem) : len(name)-len(ext)]
+	return strings.HasPrefix(middle, ".sync-conflict-") || strings.HasPrefix(middle, " (conflicted copy ")
+}
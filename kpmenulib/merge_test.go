@@ -0,0 +1,284 @@
+package kpmenulib
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tobischo/gokeepasslib/v3"
+	w "github.com/tobischo/gokeepasslib/v3/wrappers"
+)
+
+// newConflictCopy copies the test database like a sync tool would on a conflict, and opens the copy
+func newConflictCopy(t *testing.T, cfg *Configuration) *Database {
+	t.Helper()
+	data, err := os.ReadFile(cfg.Database.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := strings.TrimSuffix(cfg.Database.Database, ".kdbx") + ".sync-conflict-20240101-120000-ABCDEFG.kdbx"
+	if err := os.WriteFile(name, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	copied := *cfg
+	copied.Database.Database = name
+	return openTestDatabase(t, &copied)
+}
+
+func setModified(e *gokeepasslib.Entry, d time.Duration) {
+	t := w.Now()
+	t.Time = t.Time.Add(d)
+	e.Times.LastModificationTime = &t
+}
+
+func TestMerge(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	cfg, entry := newTestDatabase(t)
+	db := openTestDatabase(t, cfg)
+	other := newConflictCopy(t, cfg)
+
+	// The other copy has a newer version of the entry and a new group
+	e := other.findEntry(entry.UUID)
+	e.Values[1].Value.Content = "other"
+	setModified(e, time.Hour)
+	added := gokeepasslib.NewEntry()
+	added.Values = append(added.Values, gokeepasslib.ValueData{Key: "Title", Value: gokeepasslib.V{Content: "new"}})
+	group := gokeepasslib.NewGroup()
+	group.Name = "Web"
+	group.Entries = append(group.Entries, added)
+	root := &other.Keepass.Content.Root.Groups[0]
+	root.Groups = append(root.Groups, group)
+	if err := other.SaveDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := db.MergeFile(other.Source.Database)
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if expected := (MergeSummary{Added: 1, Updated: 1, GroupsAdded: 1}); summary != expected {
+		t.Errorf("expected %s, got %s", expected, summary)
+	}
+
+	// Changes must be in the file, the replaced version in the history
+	db = openTestDatabase(t, cfg)
+	if !contains(db.GroupPaths(), "Root/Web") || len(db.Entries) != 2 {
+		t.Fatalf("expected the new group and entry, got %v", db.Entries)
+	}
+	merged := db.findEntry(entry.UUID)
+	if got := merged.GetContent("UserName"); got != "other" {
+		t.Errorf("expected %q, got %q", "other", got)
+	}
+	if len(merged.Histories) != 1 || len(merged.Histories[0].Entries) != 1 || merged.Histories[0].Entries[0].GetContent("UserName") != "user" {
+		t.Errorf("expected the previous version in history, got %v", merged.Histories)
+	}
+
+	// Merging again changes nothing
+	summary, err = db.MergeFile(other.Source.Database)
+	if err != nil || summary.Changed() {
+		t.Errorf("expected no changes, got %s, %v", summary, err)
+	}
+}
+
+func TestMergeFailure(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	cfg, entry := newTestDatabase(t)
+	db := openTestDatabase(t, cfg)
+	other := newConflictCopy(t, cfg)
+	e := other.findEntry(entry.UUID)
+	e.Values[1].Value.Content = "other"
+	setModified(e, time.Hour)
+	if err := other.SaveDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Someone else saves the database meanwhile, the merge can't be saved
+	changed := openTestDatabase(t, cfg)
+	if err := changed.SetEntryField(entry.UUID, "UserName", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.MergeFile(other.Source.Database); !errors.Is(err, ErrDatabaseChanged) {
+		t.Fatalf("expected %v, got %v", ErrDatabaseChanged, err)
+	}
+	if got := db.findEntry(entry.UUID).GetContent("UserName"); got != "changed" {
+		t.Errorf("expected the database to be read again, got %q", got)
+	}
+
+	// Backups made in the same second don't collide
+	first, err := db.Backup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second, err := db.Backup(); err != nil || second == first {
+		t.Errorf("expected a second backup, got %q, %v", second, err)
+	}
+}
+
+func TestMergeIntoEmpty(t *testing.T) {
+	cfg, entry := newTestDatabase(t)
+	db := openTestDatabase(t, cfg)
+	other := newConflictCopy(t, cfg)
+	db.Keepass.Content.Root.Groups = nil
+
+	summary := db.Merge(other)
+	if expected := (MergeSummary{Added: 1, GroupsAdded: 1}); summary != expected {
+		t.Errorf("expected %s, got %s", expected, summary)
+	}
+	if db.findEntry(entry.UUID) == nil {
+		t.Error("expected the entry to be merged")
+	}
+}
+
+func TestMergeKeepsNewer(t *testing.T) {
+	cfg, entry := newTestDatabase(t)
+	db := openTestDatabase(t, cfg)
+	other := newConflictCopy(t, cfg)
+
+	setModified(db.findEntry(entry.UUID), time.Hour)
+	e := other.findEntry(entry.UUID)
+	e.Values[1].Value.Content = "other"
+	setModified(e, time.Minute)
+
+	if summary := db.Merge(other); summary != (MergeSummary{Kept: 1}) {
+		t.Errorf("expected 1 kept entry, got %s", summary)
+	}
+	kept := db.findEntry(entry.UUID)
+	if got := kept.GetContent("UserName"); got != "user" {
+		t.Errorf("expected %q, got %q", "user", got)
+	}
+	if len(kept.Histories) != 1 || kept.Histories[0].Entries[0].GetContent("UserName") != "other" {
+		t.Errorf("expected the other version in history, got %v", kept.Histories)
+	}
+}
+
+func TestMergeMoved(t *testing.T) {
+	cfg, entry := newTestDatabase(t)
+	db := openTestDatabase(t, cfg)
+	other := newConflictCopy(t, cfg)
+
+	// Moved into a new group of the other copy, without other change
+	e := *other.findEntry(entry.UUID)
+	moved := w.Now()
+	moved.Time = moved.Time.Add(time.Hour)
+	e.Times.LocationChanged = &moved
+	removeEntry(other.Keepass.Content.Root.Groups, entry.UUID)
+	group := gokeepasslib.NewGroup()
+	group.Name = "Web"
+	group.Entries = append(group.Entries, e)
+	root := &other.Keepass.Content.Root.Groups[0]
+	root.Groups = append(root.Groups, group)
+
+	if summary := db.Merge(other); summary != (MergeSummary{Updated: 1, GroupsAdded: 1}) {
+		t.Errorf("expected 1 updated entry and 1 added group, got %s", summary)
+	}
+	if len(db.Entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(db.Entries))
+	}
+	if group := db.Entries[0].Group; group != "Root/Web" {
+		t.Errorf("expected the entry to be moved into Root/Web, got %s", group)
+	}
+}
+
+// openChallengeResponse opens the database keyed by the password "secret" and the response of the command
+func openChallengeResponse(t *testing.T, name, command string) *Database {
+	t.Helper()
+	db := NewDatabase(DatabaseSource{Database: name, KeyFileData: command})
+	db.DeocdeDatabase()
+	if err := db.AddCredentials(Credentials{Password: "secret"}, db.challenge()); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.OpenDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	db.IterateDatabase()
+	return db
+}
+
+func TestMergeFileChallengeResponse(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	// The response depends on the challenge of the file, as with a YubiKey
+	const command = "printf %s %salt | sha256sum | cut -c1-64"
+	cfg, entry := newTestDatabase(t)
+	db := openTestDatabase(t, cfg)
+	db.Source.KeyFileData = command
+	if err := db.AddCredentials(Credentials{Password: "secret"}, db.challenge()); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A copy saved by another client, with another KDF salt
+	data, err := os.ReadFile(cfg.Database.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := strings.TrimSuffix(cfg.Database.Database, ".kdbx") + ".sync-conflict-20240101-120000-ABCDEFG.kdbx"
+	if err := os.WriteFile(name, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	other := openChallengeResponse(t, name, command)
+	// The challenge refers to the header
+	other.challenge()[0]++
+	if err := other.AddCredentials(Credentials{Password: "secret"}, other.challenge()); err != nil {
+		t.Fatal(err)
+	}
+	e := other.findEntry(entry.UUID)
+	e.Values[1].Value.Content = "other"
+	setModified(e, time.Hour)
+	if err := other.SaveDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openChallengeResponse(t, cfg.Database.Database, command)
+	if err := db.protectCredentials(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Lock()
+	summary, err := db.MergeFile(name)
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if summary != (MergeSummary{Updated: 1}) {
+		t.Errorf("expected 1 updated entry, got %s", summary)
+	}
+	if got := db.findEntry(entry.UUID).GetContent("UserName"); got != "other" {
+		t.Errorf("expected %q, got %q", "other", got)
+	}
+}
+
+func TestMergeDeleted(t *testing.T) {
+	cfg, entry := newTestDatabase(t)
+	db := openTestDatabase(t, cfg)
+	other := newConflictCopy(t, cfg)
+
+	// Deleted in the other copy after the last modification
+	removeEntry(other.Keepass.Content.Root.Groups, entry.UUID)
+	deletionTime := w.Now()
+	deletionTime.Time = deletionTime.Time.Add(time.Hour)
+	other.Keepass.Content.Root.DeletedObjects = append(other.Keepass.Content.Root.DeletedObjects,
+		gokeepasslib.DeletedObjectData{UUID: entry.UUID, DeletionTime: &deletionTime})
+
+	if summary := db.Merge(other); summary != (MergeSummary{Deleted: 1}) {
+		t.Errorf("expected 1 deleted entry, got %s", summary)
+	}
+	if len(db.Entries) != 0 || len(db.Keepass.Content.Root.DeletedObjects) != 1 {
+		t.Errorf("expected the entry to be deleted, got %v", db.Entries)
+	}
+}
+
+func TestIsConflictFile(t *testing.T) {
+	for name, expected := range map[string]bool{
+		"db.kdbx": false,
+		"db.sync-conflict-20240101-120000-ABCDEFG.kdbx": true,
+		"db (conflicted copy 2024-01-01 120000).kdbx":   true,
+		"db.kdbx.tmp": false,
+		"other.sync-conflict-20240101-120000-ABCDEFG.kdbx": false,
+	} {
+		if got := isConflictFile("db.kdbx", name); got != expected {
+			t.Errorf("%s: expected %t, got %t", name, expected, got)
+		}
+	}
+}
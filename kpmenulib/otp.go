@@ -48,6 +48,34 @@ func (o OTPError) Error() string {
 	return o.err.Error()
 }
 
+// entryOTPURI returns the otpauth URI of the OTP of the entry, e.g. to show it as a QR code:
+// the otp key, or the URI of the legacy values. It is empty if the entry has no OTP.
+func entryOTPURI(a gokeepasslib.Entry) string {
+	if uri := strings.TrimSpace(a.GetContent(OTP)); strings.HasPrefix(uri, OTPAUTH+"://") {
+		return uri
+	}
+	seed := strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(a.GetContent(TOTPSEED)), " ", ""))
+	if seed == "" {
+		return ""
+	}
+	otp, err := CreateOTPAuth(a)
+	if err != nil {
+		return ""
+	}
+	query := url.Values{"secret": {seed}, "issuer": {a.GetTitle()}}
+	if otp.Period > 0 {
+		query.Set("period", strconv.Itoa(otp.Period))
+	}
+	if otp.Digits > 0 {
+		query.Set("digits", strconv.Itoa(otp.Digits))
+	}
+	label := a.GetTitle()
+	if user := a.GetContent("UserName"); user != "" {
+		label += ":" + user
+	}
+	return fmt.Sprintf("%s://%s/%s?%s", OTPAUTH, TOTP, url.PathEscape(label), query.Encode())
+}
+
 // CreateOTP generates a time-sensitive TOTP code for a database entry.
 //
 // Modern versions of KeepassXC and Keepass2Android store this URL in the `otp` key. A historic version
@@ -2,14 +2,16 @@ package kpmenulib
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"log"
 	"os/exec"
 	"regexp"
 	"strings"
 	"time"
 
+	"github.com/gen2brain/beeep"
 	"github.com/go-vgo/robotgo"
-	"github.com/google/shlex"
 	"github.com/tobischo/gokeepasslib/v3"
 )
 
@@ -18,17 +20,30 @@ type MenuSelection int
 
 // MenuSelections enum values
 const (
-	MenuShow   = MenuSelection(iota) // Show entries
-	MenuReload                       // Reload database
-	MenuExit                         // Exit
+	MenuShow     = MenuSelection(iota) // Show entries
+	MenuTags                           // Show entries by tag
+	MenuNew                            // Create a new entry
+	MenuEdit                           // Edit an entry field
+	MenuGenerate                       // Generate a password
+	MenuAudit                          // Show the entries with the worst passwords
+	MenuReload                         // Reload database
+	MenuExit                           // Exit
 )
 
 var menuSelections = [...]string{
 	"Show entries",
+	"Browse tags",
+	"New entry",
+	"Edit field",
+	"Generate password",
+	"Audit passwords",
 	"Reload database",
 	"Exit",
 }
 
+// unlockDatabaseItem is listed with the entries for every locked database
+const unlockDatabaseItem = "Unlock database"
+
 type entryItem struct {
 	Title string
 	Entry *Entry
@@ -37,19 +52,21 @@ type entryItem struct {
 // ErrorPrompt is a structure that handle an error of dmenu/rofi
 type ErrorPrompt struct {
 	Cancelled bool
-	KbCustom1 bool
-	KbCustom2 bool
-	KbCustom3 bool
-	KbCustom4 bool
-	KbCustom5 bool
+	CustomKey int // Custom key pressed (exit code 10 is the key 1), 0 if none
 	Error     error
 }
 
 // PromptPassword executes dmenu to ask for database password
 // Returns the written password
-func PromptPassword(menu *Menu) (string, ErrorPrompt) {
+func PromptPassword(menu *Menu, db *Database) (string, ErrorPrompt) {
+	// Tell which database is unlocked when more are used
+	label := menu.Configuration.Style.TextPassword
+	if len(menu.Databases) > 1 {
+		label = fmt.Sprintf("%s (%s)", label, db.Name())
+	}
+
 	// Prepare dmenu/rofi
-	command, err := getCommand(menu, menu.Configuration.Style.TextPassword, true, menu.Configuration.Executable.CustomPromptPassword)
+	command, err := getCommand(menu, PromptRequest{Label: label, Password: true, Custom: menu.Configuration.Executable.CustomPromptPassword})
 	ep := ErrorPrompt{}
 	if err != ep {
 		return "", err
@@ -64,6 +81,28 @@ func PromptPassword(menu *Menu) (string, ErrorPrompt) {
 	return executePrompt(command, nil)
 }
 
+// PromptError reports an error to the user with a desktop notification,
+// or with the menu if notifications aren't available
+func PromptError(menu *Menu, message string) {
+	PromptMessage(menu, message)
+}
+
+// PromptMessage shows a message to the user with a desktop notification,
+// or with the menu if notifications aren't available
+func PromptMessage(menu *Menu, message string) {
+	if err := beeep.Notify("kpmenu", message, ""); err == nil {
+		return
+	}
+
+	command, err := getCommand(menu, PromptRequest{Label: message, Custom: menu.Configuration.Executable.CustomPromptMenu})
+	ep := ErrorPrompt{}
+	if err != ep {
+		log.Printf("failed to show message: %s", err.Error)
+		return
+	}
+	executePrompt(command, strings.NewReader("OK\n"))
+}
+
 // PromptMenu executes dmenu to ask for menu selection
 // Returns the MenuSelection chosen
 func PromptMenu(menu *Menu) (MenuSelection, ErrorPrompt) {
@@ -71,7 +110,7 @@ func PromptMenu(menu *Menu) (MenuSelection, ErrorPrompt) {
 	var input strings.Builder
 
 	// Prepare dmenu/rofi
-	command, err := getCommand(menu, menu.Configuration.Style.TextMenu, false, menu.Configuration.Executable.CustomPromptMenu)
+	command, err := getCommand(menu, PromptRequest{Label: menu.Configuration.Style.TextMenu, Custom: menu.Configuration.Executable.CustomPromptMenu})
 	ep := ErrorPrompt{}
 	if err != ep {
 		return selection, err
@@ -102,17 +141,29 @@ func PromptMenu(menu *Menu) (MenuSelection, ErrorPrompt) {
 	return selection, err
 }
 
-// PromptEntries executes dmenu to ask for an entry selection
-// Returns the selected entry
-func PromptEntries(menu *Menu) (*Entry, ErrorPrompt) {
+// PromptEntries executes dmenu to ask for an entry selection, among the entries with the tag if not empty
+// Returns the selected entry and the custom key pressed, 0 if none
+func PromptEntries(menu *Menu, tag string) (*Entry, int, ErrorPrompt) {
 	var entry Entry
 	var input strings.Builder
 
 	// Prepare autotype command
-	command, erp := getCommand(menu, menu.Configuration.Style.TextEntry, false, menu.Configuration.Executable.CustomPromptEntries)
+	preview := backendSupports(menu, func(c PromptCapabilities) bool { return c.Preview })
+	icons := !menu.Configuration.Style.NoIcons && backendSupports(menu, func(c PromptCapabilities) bool { return c.Icons })
+	index := backendSupports(menu, func(c PromptCapabilities) bool { return c.Index })
+	markup := backendSupports(menu, func(c PromptCapabilities) bool { return c.Markup })
+	command, erp := getCommand(menu, PromptRequest{
+		Label:   menu.Configuration.Style.TextEntry,
+		Message: keyActionsHelp(menu),
+		Markup:  markup,
+		Preview: preview,
+		Icons:   icons,
+		Index:   index,
+		Custom:  menu.Configuration.Executable.CustomPromptEntries,
+	})
 	ep := ErrorPrompt{}
 	if erp != ep {
-		return &entry, erp
+		return &entry, 0, erp
 	}
 
 	// Add custom arguments
@@ -123,62 +174,137 @@ func PromptEntries(menu *Menu) (*Entry, ErrorPrompt) {
 	// Prepare a list of entries
 	// Identified by the formatted title and the entry pointer
 	var listEntries []entryItem
-	reg, err := regexp.Compile(`{[a-zA-Z]+\}`)
-	if err != nil {
-		return &entry, ErrorPrompt{
-			Cancelled: false,
-			Error:     err,
-		}
+	format := menu.entryFormat()
+	entries := menu.Entries(tag)
+	if menu.Configuration.General.Frecency {
+		entries = frecentEntries(menu, entries)
 	}
-	for i, e := range menu.Database.Entries {
+	now := time.Now()
+	for i, e := range entries {
 		// Format entry
-		title := menu.Configuration.Style.FormatEntry
-		matches := reg.FindAllString(title, -1)
-
-		// Replace every match
-		for _, match := range matches {
-			valueType := match[1 : len(match)-1] // Removes { and }
-			value := ""                          // By default empty value
-			vd := e.FullEntry.GetContent(valueType)
-			if vd != "" {
-				value = vd
+		title := format.Format(&entries[i], markup, now)
+		// Prefix with the database label when more are used
+		if len(menu.Databases) > 1 {
+			name := e.Database.Name()
+			if markup {
+				name = markupEscaper.Replace(name)
 			}
-			title = strings.Replace(title, match, value, -1)
+			title = fmt.Sprintf("[%s] %s", name, title)
+		}
+		if preview {
+			// Tabs separate the preview
+			title = strings.ReplaceAll(title, "\t", " ")
 		}
 		// Be sure to point on the right entry, do not point to the local e
-		listEntries = append(listEntries, entryItem{Title: title, Entry: &menu.Database.Entries[i]})
+		listEntries = append(listEntries, entryItem{Title: title, Entry: &entries[i]})
+	}
+
+	// Entries rendered the same are told apart by the index, or by a hidden suffix stable
+	// across prompts, from their UUID
+	items := make([]string, len(listEntries))
+	for i, e := range listEntries {
+		items[i] = e.Title
+	}
+	if !index {
+		items = uniqueItems(items, func(i int) uint {
+			uuid := listEntries[i].Entry.UUID
+			return uint(uuid[0])<<8 | uint(uuid[1])
+		})
 	}
 
 	// Prepare input (dmenu items)
-	for _, e := range listEntries {
-		input.WriteString(e.Title + "\n")
+	for i, e := range listEntries {
+		if preview {
+			input.WriteString(entryPreview(items[i], e.Entry))
+		} else {
+			input.WriteString(items[i])
+		}
+		// The icon is given as rofi does, after the text
+		if icon := entryIcon(e.Entry); icons && icon != "" {
+			input.WriteString("\x00icon\x1f" + icon)
+		}
+		input.WriteString("\n")
+	}
+
+	// Databases still locked can be unlocked from the list, after the entries
+	var locked []*Database
+	for _, db := range menu.Databases {
+		if !db.Loaded {
+			item := fmt.Sprintf("[%s] %s", db.Name(), unlockDatabaseItem)
+			locked = append(locked, db)
+			items = append(items, item)
+			input.WriteString(item + "\n")
+		}
 	}
 
 	// Execute prompt
 	result, errPrompt := executePrompt(command, strings.NewReader(input.String()))
+	key := errPrompt.CustomKey
+	errPrompt.CustomKey = 0
+	if preview {
+		// Drop the preview of the selected item
+		result, _, _ = strings.Cut(result, "\t")
+	}
 	if errPrompt.Error == nil && !errPrompt.Cancelled {
-		// Get selected entry
-		for _, e := range listEntries {
-			if e.Title == result {
-				entry = *e.Entry
-				break
+		var selected []int
+		if index {
+			if i := selectedIndex(result, len(items)); i != -1 {
+				selected = []int{i}
 			}
+		} else {
+			selected = matchItems(result, items)
+		}
+
+		// Ask which entry was meant rather than guessing
+		if len(selected) > 1 {
+			details := make([]string, len(selected))
+			for i, s := range selected {
+				details[i] = items[s]
+				if s < len(listEntries) {
+					details[i] = entryDetails(menu, listEntries[s].Entry)
+				}
+			}
+			sel, errAmbiguous := promptAmbiguous(menu, details)
+			if sel == -1 || errAmbiguous.Error != nil || errAmbiguous.Cancelled {
+				return &entry, 0, errAmbiguous
+			}
+			if errAmbiguous.CustomKey != 0 {
+				key = errAmbiguous.CustomKey
+			}
+			selected = selected[sel : sel+1]
+		}
+
+		// Unlock the database and prompt again
+		if len(selected) == 1 && selected[0] >= len(listEntries) {
+			if err := menu.UnlockDatabase(locked[selected[0]-len(listEntries)]); err != nil {
+				errPrompt.Cancelled = true
+				if err.Message != "" {
+					errPrompt.Error = errors.New(err.String())
+				}
+				return &entry, 0, errPrompt
+			}
+			return PromptEntries(menu, tag)
+		}
+
+		// Get selected entry
+		if len(selected) == 1 {
+			entry = *listEntries[selected[0]].Entry
 		}
 	}
-	return &entry, errPrompt
+	return &entry, key, errPrompt
 }
 
 // PromptFields executes dmenu to ask for a field selection
-// Returns the selected field value as string
-func PromptFields(menu *Menu, entry *Entry) (string, ErrorPrompt) {
-	var value string
+// Returns the selected field name and its value as string
+func PromptFields(menu *Menu, entry *Entry) (string, string, ErrorPrompt) {
+	var field, value string
 	var input strings.Builder
 
 	// Prepare autotype command
-	command, erp := getCommand(menu, menu.Configuration.Style.TextEntry, false, menu.Configuration.Executable.CustomPromptFields)
+	command, erp := getCommand(menu, PromptRequest{Label: menu.Configuration.Style.TextEntry, Custom: menu.Configuration.Executable.CustomPromptFields})
 	ep := ErrorPrompt{}
 	if erp != ep {
-		return value, erp
+		return field, value, erp
 	}
 
 	// Add custom arguments
@@ -232,51 +358,168 @@ func PromptFields(menu *Menu, entry *Entry) (string, ErrorPrompt) {
 			if ev != nil {
 				err.Cancelled = true
 				err.Error = fmt.Errorf("failed to create otp: %s", ev)
-				return value, err
+				return field, value, err
 			}
-			return value, err
+			menu.logAccess(AccessOTP, entry, otpField)
+			return otpField, value, err
 		}
 		// Check that the result is valid
 		if contains(fields, result) {
 			// Get field value
 			for _, v := range entry.FullEntry.Values {
 				if result == v.Key {
-					value = v.Value.Content
+					field, value = v.Key, v.Value.Content
 					break
 				}
 			}
 		}
 	}
-	return value, err
+	return field, value, err
+}
+
+// PromptFieldName executes dmenu to ask for a field of the entry to edit
+// Returns the selected field name
+func PromptFieldName(menu *Menu, entry *Entry) (string, ErrorPrompt) {
+	var input strings.Builder
+
+	command, erp := getCommand(menu, PromptRequest{Label: menu.Configuration.Style.TextField, Custom: menu.Configuration.Executable.CustomPromptFields})
+	ep := ErrorPrompt{}
+	if erp != ep {
+		return "", erp
+	}
+
+	// Add custom arguments
+	if menu.Configuration.Style.ArgsField != "" {
+		command = append(command, strings.Split(menu.Configuration.Style.ArgsField, " ")...)
+	}
+
+	// Ordered fields first, even if empty, then the remaining ones
+	fields := strings.Fields(menu.Configuration.Database.FieldOrder)
+	for _, v := range entry.FullEntry.Values {
+		if !contains(fields, v.Key) {
+			fields = append(fields, v.Key)
+		}
+	}
+
+	// Prepare input (dmenu items)
+	for _, f := range fields {
+		input.WriteString(f + "\n")
+	}
+
+	// Execute prompt, any typed field name is accepted to add a new field
+	result, err := executePrompt(command, strings.NewReader(input.String()))
+	if err.Error != nil || err.Cancelled {
+		return "", err
+	}
+	return strings.TrimSpace(result), err
 }
 
+// PromptInput executes dmenu to ask for a free text value
+// If hidden is set, the typed text is hidden like for the password prompt
+// The given suggestions are listed as items, so they can be selected instead of typed
+// Returns the written value
+func PromptInput(menu *Menu, label string, hidden bool, suggestions ...string) (string, ErrorPrompt) {
+	custom := menu.Configuration.Executable.CustomPromptInput
+	if custom == "" {
+		custom = menu.Configuration.Executable.CustomPromptFields
+	}
+	command, err := getCommand(menu, PromptRequest{Label: label, Password: hidden, Custom: custom})
+	ep := ErrorPrompt{}
+	if err != ep {
+		return "", err
+	}
+
+	// Prepare input (dmenu items)
+	var input strings.Builder
+	for _, e := range suggestions {
+		input.WriteString(e + "\n")
+	}
+
+	// Execute prompt
+	return executePrompt(command, strings.NewReader(input.String()))
+}
+
+// PromptChoose executes dmenu to ask for an item of the list
+// Returns the index of the selected item, -1 if none
 func PromptChoose(menu *Menu, items []string) (int, ErrorPrompt) {
+	return promptChoose(menu, PromptRequest{Label: menu.Configuration.Style.TextEntry, Message: keyActionsHelp(menu)}, items)
+}
+
+// PromptAction executes dmenu to ask for an action on the entry
+func PromptAction(menu *Menu, entry *Entry, actions []KeyAction) (KeyAction, ErrorPrompt) {
+	items := make([]string, len(actions))
+	for i, action := range actions {
+		items[i] = action.String()
+	}
+	sel, err := promptChoose(menu, PromptRequest{Label: entry.FullEntry.GetTitle()}, items)
+	if sel == -1 {
+		return KeyAction{}, err
+	}
+	return actions[sel], err
+}
+
+// PromptLines shows lines of text with the menu, e.g. the notes of an entry
+func PromptLines(menu *Menu, label string, lines []string) ErrorPrompt {
+	command, err := getCommand(menu, PromptRequest{Label: label, Custom: menu.Configuration.Executable.CustomPromptFields})
+	ep := ErrorPrompt{}
+	if err != ep {
+		return err
+	}
+	_, err = executePrompt(command, strings.NewReader(strings.Join(lines, "\n")+"\n"))
+	return err
+}
+
+// promptChoose asks for an item of the list with the request. Backends outputting the index tell
+// apart identical items, the others get hidden suffixes and a prompt if the result is still ambiguous.
+func promptChoose(menu *Menu, request PromptRequest, items []string) (int, ErrorPrompt) {
 	var input strings.Builder
 
 	// Prepare autotype command
-	command, erp := getCommand(menu, menu.Configuration.Style.TextEntry, false, menu.Configuration.Executable.CustomPromptFields)
+	index := backendSupports(menu, func(c PromptCapabilities) bool { return c.Index })
+	request.Index = index
+	request.Custom = menu.Configuration.Executable.CustomPromptFields
+	command, erp := getCommand(menu, request)
 	ep := ErrorPrompt{}
 	if erp != ep {
 		return -1, erp
 	}
 
 	// Prepare input (dmenu items)
+	if !index {
+		items = uniqueItems(items, func(i int) uint { return uint(i) })
+	}
 	for _, e := range items {
 		input.WriteString(e + "\n")
 	}
 
 	// Execute prompt
 	result, err := executePrompt(command, strings.NewReader(input.String()))
-	if err.Error == nil && !err.Cancelled {
-		// Ensures selection is one of the items
-		for i, sel := range items {
-			// Match for entry title and selected entry
-			if result == sel {
-				return i, err
-			}
-		}
+	if err.Error != nil || err.Cancelled {
+		return -1, err
+	}
+	if index {
+		return selectedIndex(result, len(items)), err
+	}
+	// Ensures selection is one of the items
+	matches := matchItems(result, items)
+	switch len(matches) {
+	case 0:
+		return -1, err
+	case 1:
+		return matches[0], err
+	}
+	candidates := make([]string, len(matches))
+	for i, m := range matches {
+		candidates[i] = items[m]
 	}
-	return -1, err
+	sel, errAmbiguous := promptAmbiguous(menu, candidates)
+	if sel == -1 || errAmbiguous.Error != nil || errAmbiguous.Cancelled {
+		return -1, errAmbiguous
+	}
+	if errAmbiguous.CustomKey != 0 {
+		err.CustomKey = errAmbiguous.CustomKey
+	}
+	return matches[sel], err
 }
 
 // PromptAutotype executes an external application to select an entry and then
@@ -318,28 +561,18 @@ func PromptAutotype(menu *Menu, out *PacketResp) ErrorPrompt {
 	var keySeq = menu.Configuration.General.AutotypeSequence
 	var errPrompt ErrorPrompt
 	if menu.Configuration.General.AutotypeNoAuto {
-		entry, errPrompt = PromptEntries(menu)
+		var key int
+		entry, key, errPrompt = PromptEntries(menu, menu.Configuration.Flags.Tag)
 		if entry == nil || errPrompt.Cancelled {
 			errPrompt.Cancelled = true
 			errPrompt.Error = fmt.Errorf("user cancelled")
 			return errPrompt
 		}
-
-		// Try to guess the key sequence
-		if keySeq == "" {
-			keySeq = entry.FullEntry.AutoType.DefaultSequence
+		if key != 0 {
+			return runCustomKey(menu, entry, key, out)
 		}
 
-		if keySeq == "" {
-			if entry.FullEntry.AutoType.Associations != nil {
-				for _, assoc := range entry.FullEntry.AutoType.Associations {
-					if assoc.KeystrokeSequence != "" {
-						keySeq = assoc.KeystrokeSequence
-						break
-					}
-				}
-			}
-		}
+		keySeq = entrySequence(menu, entry)
 	} else {
 		entry, keySeq, errPrompt = identifyWindow(menu)
 		if entry == nil || errPrompt.Cancelled {
@@ -347,12 +580,70 @@ func PromptAutotype(menu *Menu, out *PacketResp) ErrorPrompt {
 			errPrompt.Error = fmt.Errorf("no entry matched")
 			return errPrompt
 		}
+		if errPrompt.CustomKey != 0 {
+			return runCustomKey(menu, entry, errPrompt.CustomKey, out)
+		}
 	}
 
 	if keySeq == "" {
 		keySeq = "{USERNAME}{TAB}{PASSWORD}{ENTER}"
 	}
+	return typeSequence(menu, entry, keySeq, out)
+}
+
+// entrySequence guesses the key sequence of the entry when it isn't selected by the window:
+// the configured one, the default one of the entry or the one of its first association
+func entrySequence(menu *Menu, entry *Entry) string {
+	if keySeq := menu.Configuration.General.AutotypeSequence; keySeq != "" {
+		return keySeq
+	}
+	if keySeq := entry.FullEntry.AutoType.DefaultSequence; keySeq != "" {
+		return keySeq
+	}
+	for _, assoc := range entry.FullEntry.AutoType.Associations {
+		if assoc.KeystrokeSequence != "" {
+			return assoc.KeystrokeSequence
+		}
+	}
+	return "{USERNAME}{TAB}{PASSWORD}{ENTER}"
+}
+
+// runCustomKey runs the action of the custom key on the entry
+func runCustomKey(menu *Menu, entry *Entry, key int, out *PacketResp) ErrorPrompt {
+	action, ok := menu.keyAction(key)
+	if !ok {
+		var errPrompt ErrorPrompt
+		errPrompt.Cancelled = true
+		errPrompt.Error = fmt.Errorf("no action for the custom key %d", key)
+		return errPrompt
+	}
+	return menu.runKeyAction(action, entry, out)
+}
+
+// typeSequence types the autotype sequence with the fields of the entry
+func typeSequence(menu *Menu, entry *Entry, keySeq string, out *PacketResp) ErrorPrompt {
+	return typeValues(menu, entry, keySeq, nil, out)
+}
+
+// typeField types a value of the entry, e.g. a field selected with PromptFields
+func typeField(menu *Menu, entry *Entry, field, value string, out *PacketResp) ErrorPrompt {
+	// Field names may have spaces and braces, the token only has to be parsed
+	token := strings.Map(func(r rune) rune {
+		if r == ' ' || r == '{' || r == '}' || r == '=' {
+			return -1
+		}
+		return r
+	}, field)
+	if token == "" {
+		token = "FIELD"
+	}
+	return typeValues(menu, entry, "{"+token+"}", map[string]string{token: value}, out)
+}
 
+// typeValues types the autotype sequence, the values of its fields are looked up in values
+// first, then in the entry
+func typeValues(menu *Menu, entry *Entry, keySeq string, values map[string]string, out *PacketResp) ErrorPrompt {
+	var errPrompt ErrorPrompt
 	fe := entry.FullEntry
 	var input strings.Builder
 	input.WriteString(keySeq)
@@ -360,11 +651,12 @@ func PromptAutotype(menu *Menu, out *PacketResp) ErrorPrompt {
 	seq := NewSequence()
 	seq.Parse(keySeq)
 	rvp := make(Pairs)
+	var typed []string // Fields of the sequence, for the access log
 
 	for _, k := range seq.SeqEntries {
 		if k.Type == FIELD {
-			var value string
-			if k.Token == "TOTP" {
+			value, found := values[k.Token]
+			if !found && k.Token == "TOTP" {
 				// If the sequence asks for TOTP but the user has disabled it
 				// write a dummy code. **Not** writing it would break the
 				// sequence, which is ordered.
@@ -378,8 +670,9 @@ func PromptAutotype(menu *Menu, out *PacketResp) ErrorPrompt {
 						errPrompt.Error = fmt.Errorf("failed to create otp: %s", err)
 						return errPrompt
 					}
+					menu.logAccess(AccessOTP, entry, otpField)
 				}
-			} else {
+			} else if !found {
 				value = getContent(fe, k.Token)
 			}
 			input.WriteString(k.Token)
@@ -387,11 +680,19 @@ func PromptAutotype(menu *Menu, out *PacketResp) ErrorPrompt {
 			input.WriteString(value)
 			input.WriteString("\n")
 			rvp[k.Token] = value
+			if !contains(typed, k.Token) {
+				typed = append(typed, k.Token)
+			}
 		} else {
 			rvp[k.Token] = k.Token
 		}
 	}
 	seq.Keylag = 500 // ms
+	action := AccessAutotype
+	if menu.Configuration.Executable.CustomAutotypeTyper == "echo" {
+		action = AccessOutput
+	}
+	menu.logAccess(action, entry, strings.Join(typed, ","))
 	switch menu.Configuration.Executable.CustomAutotypeTyper {
 	case "":
 		seq.Exec(rvp, Robot{})
@@ -421,6 +722,8 @@ func executePrompt(command []string, input *strings.Reader) (result string, erro
 		errorPrompt.Cancelled = true
 		errorPrompt.Error = fmt.Errorf("the custom prompt command is empty")
 		return
+	} else if command[0] == terminalPromptCommand {
+		return runTerminalPrompt(command[1:], input)
 	} else if len(command) == 1 {
 		cmd = exec.Command(command[0])
 	} else {
@@ -445,19 +748,14 @@ func executePrompt(command []string, input *strings.Reader) (result string, erro
 				outErr.String(),
 			)
 		} else {
-			switch err.Error() {
-			case "exit status 10":
-				errorPrompt.KbCustom1 = true
-			case "exit status 11":
-				errorPrompt.KbCustom2 = true
-			case "exit status 12":
-				errorPrompt.KbCustom3 = true
-			case "exit status 13":
-				errorPrompt.KbCustom4 = true
-			case "exit status 14":
-				errorPrompt.KbCustom5 = true
-
-			default:
+			// The custom keys of the menus are reported by exit codes
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				if code := exitErr.ExitCode(); code >= customKeyExitCode && code < customKeyExitCode+maxCustomKeys {
+					errorPrompt.CustomKey = code - customKeyExitCode + 1
+				}
+			}
+			if errorPrompt.CustomKey == 0 {
 				errorPrompt.Cancelled = true
 			}
 		}
@@ -471,66 +769,42 @@ func (el MenuSelection) String() string {
 	return menuSelections[el]
 }
 
-func getCommand(menu *Menu, style string, pass bool, custom string) ([]string, ErrorPrompt) {
+// getCommand returns the command of a prompt with the configured backend.
+// Options not supported by the backend are dropped, so prompts can always ask for them.
+func getCommand(menu *Menu, request PromptRequest) ([]string, ErrorPrompt) {
+	backend, err := promptBackend(menu.Configuration)
 	var command []string
-	switch menu.Configuration.General.Menu {
-	case "rofi":
-		command = []string{
-			"rofi",
-			"-i",
-			"-dmenu",
-			"-p", style,
-			"-mesg", "Alt-1: type user/passwd, Alt-2: type user, Alt-3: type TOTP, Alt-4:type passwd&RET Alt-5:URL ",
-		}
-		if pass {
-			command = append(command, "-password")
-		}
-	case "wofi":
-		command = []string{
-			"wofi",
-			"-i",
-			"-d",
-			"-p", style,
-		}
-		if pass {
-			command = append(command, "--password")
-		}
-	case "dmenu":
-		command = []string{
-			"dmenu",
-			"-i",
-			"-p", style,
-		}
-		if pass {
-			command = append(command, []string{
-				"-nb", menu.Configuration.Style.PasswordBackground,
-				"-nf", menu.Configuration.Style.PasswordBackground,
-			}...)
-		}
-	case "custom":
-		var err error
-		command, err = shlex.Split(custom)
-		if err != nil {
-			var errorPrompt ErrorPrompt
-			errorPrompt.Cancelled = true
-			errorPrompt.Error = fmt.Errorf("failed to parse custom prompt, exiting")
-			return []string{}, errorPrompt
+	if err == nil {
+		capabilities := backend.Capabilities()
+		if !capabilities.Message {
+			request.Message = ""
 		}
+		request.Markup = request.Markup && capabilities.Markup
+		request.Icons = request.Icons && capabilities.Icons
+		request.Index = request.Index && capabilities.Index
+		request.Preview = request.Preview && capabilities.Preview
+		command, err = backend.Command(menu.Configuration, request)
+	}
+	if err != nil {
+		var errorPrompt ErrorPrompt
+		errorPrompt.Cancelled = true
+		errorPrompt.Error = err
+		return []string{}, errorPrompt
 	}
 	return command, ErrorPrompt{}
 }
 
-func identifyWindow(menu *Menu) (*Entry, string, ErrorPrompt) {
-	// Prepare autotype command
-	var activeWindow string
-	var errPrompt ErrorPrompt
+// activeWindowTitle returns the title of the active window
+func activeWindowTitle(menu *Menu) (string, ErrorPrompt) {
 	if menu.Configuration.Executable.CustomAutotypeWindowID == "" {
-		activeWindow = robotgo.GetTitle()
-	} else {
-		command := []string{"sh", "-c", menu.Configuration.Executable.CustomAutotypeWindowID}
-		activeWindow, errPrompt = executePrompt(command, nil)
+		return robotgo.GetTitle(), ErrorPrompt{}
 	}
+	command := []string{"sh", "-c", menu.Configuration.Executable.CustomAutotypeWindowID}
+	return executePrompt(command, nil)
+}
 
+func identifyWindow(menu *Menu) (*Entry, string, ErrorPrompt) {
+	activeWindow, errPrompt := activeWindowTitle(menu)
 	if errPrompt.Error != nil || errPrompt.Cancelled {
 		return &Entry{}, "", errPrompt
 	}
@@ -540,9 +814,13 @@ func identifyWindow(menu *Menu) (*Entry, string, ErrorPrompt) {
 		ent Entry
 		seq string
 	}
+
+	// Search all the databases
+	menu.UnlockAll()
+	entries := menu.Entries(menu.Configuration.Flags.Tag)
 	matches := make([]pair, 0)
-	unmatches := make([]pair, 0, len(menu.Database.Entries))
-	for _, e := range menu.Database.Entries {
+	unmatches := make([]pair, 0, len(entries))
+	for _, e := range entries {
 		defaultSequence := "{USERNAME}{TAB}{PASSWORD}{ENTER}"
 		if e.FullEntry.AutoType.DefaultSequence != "" {
 			defaultSequence = e.FullEntry.AutoType.DefaultSequence
@@ -597,31 +875,46 @@ func identifyWindow(menu *Menu) (*Entry, string, ErrorPrompt) {
 		keySeq = matches[0].seq
 
 	} else {
+		// Offer to create an entry for the window when nothing matched
+		offerNew := len(matches) == 0
 		matches = append(matches, unmatches...)
-		items := make([]string, len(matches))
-		for i, m := range matches {
-			items[i] = fmt.Sprintf("%-25s %-25s %-30s", m.ent.FullEntry.GetContent("Title"),
-				m.ent.FullEntry.GetContent("UserName"), m.seq)
+		items := make([]string, 0, len(matches)+1)
+		if offerNew {
+			items = append(items, MenuNew.String())
+		}
+		for _, m := range matches {
+			items = append(items, fmt.Sprintf("%-25s %-25s %-30s", m.ent.FullEntry.GetContent("Title"),
+				m.ent.FullEntry.GetContent("UserName"), m.seq))
 		}
 		sel, err := PromptChoose(menu, items)
 		ep := ErrorPrompt{}
+		if offerNew && sel != -1 {
+			if sel == 0 && err == ep {
+				newEntry, errDb := menu.newEntry(activeWindow)
+				if errDb != nil {
+					errPrompt.Cancelled = true
+					if errDb.Message != "" {
+						errPrompt.Error = errors.New(errDb.String())
+					}
+					return nil, "", errPrompt
+				}
+				entry = newEntry
+				keySeq = "{USERNAME}{TAB}{PASSWORD}{ENTER}"
+				if menu.Configuration.General.AutotypeSequence != "" {
+					keySeq = menu.Configuration.General.AutotypeSequence
+				}
+				return entry, keySeq, errPrompt
+			}
+			sel--
+		}
 		if err != ep || sel == -1 {
-			if err.KbCustom1 {
-				entry = &matches[sel].ent
-				keySeq = "{USERNAME}"
-			} else if err.KbCustom2 {
-				entry = &matches[sel].ent
-				keySeq = "{PASSWORD}"
-			} else if err.KbCustom3 {
-				// keySeq = "{USERNAME}{TAB}{PASSWORD}{ENTER}"
-				keySeq = "{TOTP}"
-				entry = &matches[sel].ent
-			} else if err.KbCustom4 {
-				keySeq = "{PASSWORD}{ENTER}"
-				entry = &matches[sel].ent
-			} else if err.KbCustom5 {
-				keySeq = "{URL}"
+			if sel == -1 {
+				return entry, keySeq, ep
+			}
+			if err.CustomKey != 0 {
+				// The action of the key is run by the caller
 				entry = &matches[sel].ent
+				return entry, "", err
 			}
 
 			return entry, keySeq, ep
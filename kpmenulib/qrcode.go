@@ -0,0 +1,484 @@
+package kpmenulib
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+)
+
+// QR codes are encoded natively, in byte mode with the medium error correction level (15%)
+
+// qrEccCodewordsPerBlock is the number of error correction codewords of the blocks, by version
+var qrEccCodewordsPerBlock = [41]int{0,
+	10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26,
+	26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28}
+
+// qrEccBlocks is the number of error correction blocks, by version
+var qrEccBlocks = [41]int{0,
+	1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16,
+	17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49}
+
+// qrFormatEcc are the bits of the medium error correction level in the format information
+const qrFormatEcc = 0
+
+// qrCode is the matrix of a QR code, true for the dark modules
+type qrCode struct {
+	size     int
+	modules  [][]bool
+	function [][]bool // Modules of the patterns, not of the data
+}
+
+// encodeQR encodes the data into the smallest QR code fitting it
+func encodeQR(data []byte) (*qrCode, error) {
+	version := 1
+	for ; ; version++ {
+		if version > 40 {
+			return nil, fmt.Errorf("%d bytes are too long for a QR code", len(data))
+		}
+		if 4+qrCountBits(version)+len(data)*8 <= qrDataCodewords(version)*8 {
+			break
+		}
+	}
+
+	// Mode, length and data, then the terminator and the padding bytes
+	capacity := qrDataCodewords(version) * 8
+	var bits qrBits
+	bits.append(0x4, 4)
+	bits.append(len(data), qrCountBits(version))
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	bits.append(0, min(4, capacity-len(bits)))
+	bits.append(0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+	codewords := make([]byte, len(bits)/8)
+	for i, bit := range bits {
+		if bit {
+			codewords[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+
+	q := newQRCode(version)
+	q.drawFunctionPatterns(version)
+	q.drawCodewords(qrAddEcc(codewords, version))
+
+	// Keep the mask giving the lowest penalty
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormatBits(mask)
+		if penalty := q.penalty(); bestPenalty == -1 || penalty < bestPenalty {
+			best, bestPenalty = mask, penalty
+		}
+		// Masks are xored, applying it again removes it
+		q.applyMask(mask)
+	}
+	q.applyMask(best)
+	q.drawFormatBits(best)
+	return q, nil
+}
+
+// qrBits is a sequence of bits, the most significant first
+type qrBits []bool
+
+func (b *qrBits) append(value, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, value>>i&1 == 1)
+	}
+}
+
+// qrCountBits returns the size of the length of the data in byte mode
+func qrCountBits(version int) int {
+	if version <= 9 {
+		return 8
+	}
+	return 16
+}
+
+// qrRawModules returns the number of modules available for data and error correction
+func qrRawModules(version int) int {
+	n := (16*version+128)*version + 64
+	if version >= 2 {
+		align := version/7 + 2
+		n -= (25*align-10)*align - 55
+		if version >= 7 {
+			n -= 36
+		}
+	}
+	return n
+}
+
+// qrDataCodewords returns the number of data codewords of the version
+func qrDataCodewords(version int) int {
+	return qrRawModules(version)/8 - qrEccCodewordsPerBlock[version]*qrEccBlocks[version]
+}
+
+// qrAddEcc splits the data into blocks, appends their error correction codewords and interleaves them
+func qrAddEcc(data []byte, version int) []byte {
+	numBlocks := qrEccBlocks[version]
+	eccLen := qrEccCodewordsPerBlock[version]
+	raw := qrRawModules(version) / 8
+	numShort := numBlocks - raw%numBlocks
+	shortLen := raw / numBlocks
+
+	// The short blocks have a gap before their error correction codewords, to be interleaved as the long ones
+	divisor := rsDivisor(eccLen)
+	blocks := make([][]byte, numBlocks)
+	k := 0
+	for i := range blocks {
+		n := shortLen - eccLen
+		if i >= numShort {
+			n++
+		}
+		block := make([]byte, shortLen+1)
+		copy(block, data[k:k+n])
+		copy(block[len(block)-eccLen:], rsRemainder(data[k:k+n], divisor))
+		blocks[i] = block
+		k += n
+	}
+	result := make([]byte, 0, raw)
+	for i := 0; i < shortLen+1; i++ {
+		for j, block := range blocks {
+			if i != shortLen-eccLen || j >= numShort {
+				result = append(result, block[i])
+			}
+		}
+	}
+	return result
+}
+
+// gfMultiply multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1
+func gfMultiply(x, y byte) byte {
+	var z byte
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x1D
+		z ^= (y >> i & 1) * x
+	}
+	return z
+}
+
+// rsDivisor returns the Reed-Solomon generator polynomial of the degree, the highest
+// coefficient first and without the leading 1
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+	return result
+}
+
+// rsRemainder returns the Reed-Solomon error correction codewords of the data
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, d := range divisor {
+			result[i] ^= gfMultiply(d, factor)
+		}
+	}
+	return result
+}
+
+func newQRCode(version int) *qrCode {
+	q := &qrCode{size: version*4 + 17}
+	q.modules = make([][]bool, q.size)
+	q.function = make([][]bool, q.size)
+	for y := range q.modules {
+		q.modules[y] = make([]bool, q.size)
+		q.function[y] = make([]bool, q.size)
+	}
+	return q
+}
+
+func (q *qrCode) setFunction(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+// drawFunctionPatterns draws the finder, alignment and timing patterns and the version,
+// and reserves the modules of the format information
+func (q *qrCode) drawFunctionPatterns(version int) {
+	for i := 0; i < q.size; i++ {
+		q.setFunction(6, i, i%2 == 0)
+		q.setFunction(i, 6, i%2 == 0)
+	}
+
+	for _, p := range [][2]int{{3, 3}, {q.size - 4, 3}, {3, q.size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := p[0]+dx, p[1]+dy
+				if x >= 0 && x < q.size && y >= 0 && y < q.size {
+					d := max(abs(dx), abs(dy))
+					q.setFunction(x, y, d != 2 && d != 4)
+				}
+			}
+		}
+	}
+
+	positions := qrAlignmentPositions(version)
+	n := len(positions)
+	for i := range positions {
+		for j := range positions {
+			// The corners of the finder patterns
+			if i == 0 && j == 0 || i == 0 && j == n-1 || i == n-1 && j == 0 {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.setFunction(positions[i]+dx, positions[j]+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	q.drawFormatBits(0)
+
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = rem<<1 ^ (rem>>11)*0x1F25
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := bits>>i&1 == 1
+			a, b := q.size-11+i%3, i/3
+			q.setFunction(a, b, dark)
+			q.setFunction(b, a, dark)
+		}
+	}
+}
+
+// qrAlignmentPositions returns the coordinates of the centers of the alignment patterns
+func qrAlignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+	n := version/7 + 2
+	step := (version*8 + n*3 + 5) / (n*4 - 4) * 2
+	positions := make([]int, n)
+	positions[0] = 6
+	for i, pos := n-1, version*4+17-7; i >= 1; i, pos = i-1, pos-step {
+		positions[i] = pos
+	}
+	return positions
+}
+
+// drawFormatBits draws both copies of the error correction level and the mask
+func (q *qrCode) drawFormatBits(mask int) {
+	data := qrFormatEcc<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+
+	for i := 0; i <= 5; i++ {
+		q.setFunction(8, i, bit(i))
+	}
+	q.setFunction(8, 7, bit(6))
+	q.setFunction(8, 8, bit(7))
+	q.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.setFunction(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		q.setFunction(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.setFunction(8, q.size-15+i, bit(i))
+	}
+	q.setFunction(8, q.size-8, true)
+}
+
+// drawCodewords draws the codewords in the zigzag order, the pairs of columns from the right
+func (q *qrCode) drawCodewords(codewords []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			// The vertical timing pattern
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < q.size; vert++ {
+			y := vert
+			if upward {
+				y = q.size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if !q.function[y][x] && i < len(codewords)*8 {
+					q.modules[y][x] = codewords[i/8]>>(7-i%8)&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask inverts the data modules selected by the mask
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !q.function[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the patterns making the code harder to read: runs of modules of the same
+// color, blocks of the same color, patterns looking like finders and unbalanced colors
+func (q *qrCode) penalty() int {
+	penalty := 0
+	at := func(x, y int, transpose bool) bool {
+		if transpose {
+			return q.modules[x][y]
+		}
+		return q.modules[y][x]
+	}
+	finder := []bool{true, false, true, true, true, false, true}
+	for _, transpose := range []bool{false, true} {
+		for y := 0; y < q.size; y++ {
+			run := 1
+			for x := 1; x <= q.size; x++ {
+				if x < q.size && at(x, y, transpose) == at(x-1, y, transpose) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					penalty += run - 2
+				}
+				run = 1
+			}
+			for x := 0; x+7 <= q.size; x++ {
+				matches := true
+				for i, dark := range finder {
+					if at(x+i, y, transpose) != dark {
+						matches = false
+						break
+					}
+				}
+				if matches && (q.lightRun(x-4, x, y, transpose) || q.lightRun(x+7, x+11, y, transpose)) {
+					penalty += 40
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x+1 < q.size && y+1 < q.size {
+				c := q.modules[y][x]
+				if q.modules[y][x+1] == c && q.modules[y+1][x] == c && q.modules[y+1][x+1] == c {
+					penalty += 3
+				}
+			}
+		}
+	}
+	total := q.size * q.size
+	penalty += (abs(dark*20-total*10)+total-1)/total*10 - 10
+	return penalty
+}
+
+// lightRun tells if the modules from x to end (excluded) of the line are light, the quiet zone is
+func (q *qrCode) lightRun(x, end, y int, transpose bool) bool {
+	for ; x < end; x++ {
+		if x < 0 || x >= q.size {
+			continue
+		}
+		if transpose && q.modules[x][y] || !transpose && q.modules[y][x] {
+			return false
+		}
+	}
+	return true
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// dark tells if the module is dark, the modules around the code are light
+func (q *qrCode) dark(x, y int) bool {
+	return x >= 0 && x < q.size && y >= 0 && y < q.size && q.modules[y][x]
+}
+
+// String renders the code with Unicode blocks for terminals, two modules by character, with a
+// quiet zone of 2 modules. The light modules are drawn, dark terminals show them as light.
+func (q *qrCode) String() string {
+	const border = 2
+	var s strings.Builder
+	for y := -border; y < q.size+border; y += 2 {
+		for x := -border; x < q.size+border; x++ {
+			switch top, bottom := !q.dark(x, y), !q.dark(x, y+1) && y+1 < q.size+border; {
+			case top && bottom:
+				s.WriteString("█")
+			case top:
+				s.WriteString("▀")
+			case bottom:
+				s.WriteString("▄")
+			default:
+				s.WriteString(" ")
+			}
+		}
+		s.WriteString("\n")
+	}
+	return s.String()
+}
+
+// image renders the code with scale pixels by module, with a quiet zone of 4 modules
+func (q *qrCode) image(scale int) image.Image {
+	const border = 4
+	size := (q.size + 2*border) * scale
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	for py := 0; py < size; py++ {
+		for px := 0; px < size; px++ {
+			c := color.Gray{Y: 0xFF}
+			if q.dark(px/scale-border, py/scale-border) {
+				c.Y = 0
+			}
+			img.SetGray(px, py, c)
+		}
+	}
+	return img
+}
@@ -0,0 +1,176 @@
+package kpmenulib
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+func TestQRCode(t *testing.T) {
+	// Codewords of HELLO WORLD in a version 1-M code
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	if ecc := rsRemainder(data, rsDivisor(10)); !bytes.Equal(ecc, []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}) {
+		t.Errorf("unexpected error correction codewords %v", ecc)
+	}
+	for version, expected := range map[int]string{1: "[]", 2: "[6 18]", 7: "[6 22 38]", 32: "[6 34 60 86 112 138]", 36: "[6 24 50 76 102 128 154]"} {
+		if positions := fmt.Sprint(qrAlignmentPositions(version)); positions != expected {
+			t.Errorf("version %d: expected the alignment patterns at %s, got %s", version, expected, positions)
+		}
+	}
+
+	formats := []int{0x5412, 0x5125, 0x5E7C, 0x5B4B, 0x45F9, 0x40CE, 0x4F97, 0x4AA0}
+	for _, text := range []string{"WIFI:S:home;T:WPA;P:secret;;", strings.Repeat("otpauth://totp/GitHub:me?secret=JBSWY3DPEHPK3PXP", 8)} {
+		q, err := encodeQR([]byte(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		version := (q.size - 17) / 4
+
+		// Both copies of the format information have the medium level and the mask
+		var first, second int
+		for i := 0; i < 15; i++ {
+			var x, y int
+			switch {
+			case i <= 5:
+				x, y = 8, i
+			case i <= 7:
+				x, y = 8, i+1
+			case i == 8:
+				x, y = 7, 8
+			default:
+				x, y = 14-i, 8
+			}
+			if q.modules[y][x] {
+				first |= 1 << i
+			}
+			x, y = q.size-1-i, 8
+			if i >= 8 {
+				x, y = 8, q.size-15+i
+			}
+			if q.modules[y][x] {
+				second |= 1 << i
+			}
+		}
+		mask := (first ^ 0x5412) >> 10 & 7
+		if first != second || first != formats[mask] {
+			t.Fatalf("unexpected format information %015b %015b", first, second)
+		}
+
+		// Read the codewords back, without the mask, and check them
+		q.applyMask(mask)
+		function := newQRCode(version)
+		function.drawFunctionPatterns(version)
+		var bits []bool
+		for right := q.size - 1; right >= 1; right -= 2 {
+			if right == 6 {
+				right--
+			}
+			for vert := 0; vert < q.size; vert++ {
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert
+				}
+				for x := right; x > right-2; x-- {
+					if !function.function[y][x] {
+						bits = append(bits, q.modules[y][x])
+					}
+				}
+			}
+		}
+		codewords := make([]byte, qrRawModules(version)/8)
+		for i := range codewords {
+			for _, bit := range bits[i*8 : i*8+8] {
+				codewords[i] <<= 1
+				if bit {
+					codewords[i] |= 1
+				}
+			}
+		}
+		numBlocks, eccLen := qrEccBlocks[version], qrEccCodewordsPerBlock[version]
+		numData := qrDataCodewords(version)
+		blocks := make([][]byte, numBlocks)
+		for i := 0; i < numData; i++ {
+			// The long blocks are last, they have one more data codeword
+			b := i % numBlocks
+			if i >= numData/numBlocks*numBlocks {
+				b = numBlocks - numData%numBlocks + i%numBlocks
+			}
+			blocks[b] = append(blocks[b], codewords[i])
+		}
+		var decoded []byte
+		for b, block := range blocks {
+			ecc := make([]byte, eccLen)
+			for i := range ecc {
+				ecc[i] = codewords[numData+i*numBlocks+b]
+			}
+			if !bytes.Equal(rsRemainder(block, rsDivisor(eccLen)), ecc) {
+				t.Fatalf("version %d: invalid error correction of block %d", version, b)
+			}
+			decoded = append(decoded, block...)
+		}
+		n := int(decoded[0]&0x0F)<<4 | int(decoded[1]>>4)
+		offset := 1
+		if version > 9 {
+			n = n<<8 | int(decoded[1]&0x0F)<<4 | int(decoded[2]>>4)
+			offset = 2
+		}
+		payload := make([]byte, n)
+		for i := range payload {
+			payload[i] = decoded[offset+i]<<4 | decoded[offset+i+1]>>4
+		}
+		if decoded[0]>>4 != 0x4 || string(payload) != text {
+			t.Errorf("version %d: expected %q, got %q", version, text, payload)
+		}
+	}
+
+	if _, err := encodeQR(make([]byte, 3000)); err == nil {
+		t.Error("expected an error for too long data")
+	}
+}
+
+func TestQRAction(t *testing.T) {
+	entry := newAuditEntry(nil, "GitHub", "me", "https://github.com", "secret")
+	entry.FullEntry.Values = append(entry.FullEntry.Values,
+		gokeepasslib.ValueData{Key: TOTPSEED, Value: gokeepasslib.V{Content: "jbsw y3dp ehpk 3pxp"}},
+		gokeepasslib.ValueData{Key: TOTPSETTINGS, Value: gokeepasslib.V{Content: "60;8"}})
+	if uri := entryOTPURI(entry.FullEntry); uri != "otpauth://totp/GitHub:me?digits=8&issuer=GitHub&period=60&secret=JBSWY3DPEHPK3PXP" {
+		t.Errorf("unexpected otpauth URI %q", uri)
+	}
+
+	// The viewer gets a temporary image, removed when it exits, and is not waited for
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+	out := filepath.Join(t.TempDir(), "qr.png")
+	menu := &Menu{Configuration: NewConfiguration(), WaitGroup: new(sync.WaitGroup)}
+	menu.Configuration.Executable.CustomQRViewer = fmt.Sprintf(`sh -c "sleep 0.5; cp \"\$0\" %s"`, out)
+	action := KeyAction{KeyActionQR, "Password"}
+	if err := menu.runKeyAction(action, &entry, nil); err.Error != nil {
+		t.Fatal(err.Error)
+	}
+	if _, err := os.Stat(out); err == nil {
+		t.Error("expected the viewer not to be waited for")
+	}
+	menu.WaitGroup.Wait()
+	file, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if img, err := png.Decode(file); err != nil || img.Bounds().Dx() != (21+8)*8 {
+		t.Errorf("expected the image of a version 1 code, got %v %v", img.Bounds(), err)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("the temporary image was not removed: %v", files)
+	}
+
+	if err := menu.runKeyAction(KeyAction{KeyActionQR, "PIN"}, &entry, nil); err.Error == nil {
+		t.Error("expected an error for a missing field")
+	}
+}
@@ -0,0 +1,91 @@
+package kpmenulib
+
+import (
+	"fmt"
+	"unsafe"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+// MemoryProtection reports which protections of the secrets in memory are active
+type MemoryProtection struct {
+	NotDumpable bool // Memory can't be read by other processes of the user
+	NoCoreDump  bool // Core dumps are disabled
+	KeyLocked   bool // Keys of the unlocked databases are locked in memory, never swapped
+}
+
+func (p MemoryProtection) String() string {
+	return fmt.Sprintf("not dumpable: %t, no core dump: %t, mlock: %t", p.NotDumpable, p.NoCoreDump, p.KeyLocked)
+}
+
+// secretBuffer holds key material, wiped when destroyed
+type secretBuffer struct {
+	data   []byte
+	locked bool // Locked in memory, never swapped
+}
+
+// Bytes returns the content of the buffer, valid until Destroy is called
+func (b *secretBuffer) Bytes() []byte {
+	return b.data
+}
+
+// Destroy wipes and releases the buffer
+func (b *secretBuffer) Destroy() {
+	if b == nil || b.data == nil {
+		return
+	}
+	wipe(b.data)
+	b.free()
+	b.data = nil
+	b.locked = false
+}
+
+// wipe overwrites data with zeros
+func wipe(data []byte) {
+	for i := range data {
+		data[i] = 0
+	}
+}
+
+// protectValues moves the protected values of the entries of groups, histories included, into a
+// buffer owned by the database and returns it. The values become views of the buffer, so wiping
+// the buffer wipes them: they read as zeros once the database is locked. The buffer is allocated
+// by the garbage collector, it stays valid while a value refers to it.
+func protectValues(groups []gokeepasslib.Group) []byte {
+	var values []*gokeepasslib.V
+	var fromEntries func(entries []gokeepasslib.Entry)
+	fromEntries = func(entries []gokeepasslib.Entry) {
+		for i := range entries {
+			for j := range entries[i].Values {
+				if v := &entries[i].Values[j].Value; v.Protected.Bool && v.Content != "" {
+					values = append(values, v)
+				}
+			}
+			for j := range entries[i].Histories {
+				fromEntries(entries[i].Histories[j].Entries)
+			}
+		}
+	}
+	var fromGroups func(groups []gokeepasslib.Group)
+	fromGroups = func(groups []gokeepasslib.Group) {
+		for i := range groups {
+			fromEntries(groups[i].Entries)
+			fromGroups(groups[i].Groups)
+		}
+	}
+	fromGroups(groups)
+
+	size := 0
+	for _, v := range values {
+		size += len(v.Content)
+	}
+	buffer := make([]byte, size)
+	n := 0
+	for _, v := range values {
+		value := buffer[n : n+len(v.Content)]
+		copy(value, v.Content)
+		v.Content = unsafe.String(&value[0], len(value))
+		n += len(value)
+	}
+	return buffer
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package kpmenulib
+
+// newSecretBuffer allocates size bytes, memory can't be locked on this platform
+func newSecretBuffer(size int) (*secretBuffer, error) {
+	return &secretBuffer{data: make([]byte, size)}, nil
+}
+
+func (b *secretBuffer) free() {}
@@ -0,0 +1,30 @@
+//go:build unix
+
+package kpmenulib
+
+import (
+	"syscall"
+)
+
+// newSecretBuffer allocates size bytes outside of the Go heap, so that the garbage collector
+// never copies them, and locks them in memory when allowed (see RLIMIT_MEMLOCK)
+func newSecretBuffer(size int) (*secretBuffer, error) {
+	if size == 0 {
+		return &secretBuffer{}, nil
+	}
+	data, err := syscall.Mmap(-1, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		return nil, err
+	}
+	return &secretBuffer{
+		data:   data,
+		locked: syscall.Mlock(data) == nil,
+	}, nil
+}
+
+func (b *secretBuffer) free() {
+	if b.locked {
+		syscall.Munlock(b.data)
+	}
+	syscall.Munmap(b.data)
+}
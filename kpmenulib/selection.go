@@ -0,0 +1,117 @@
+package kpmenulib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Backends not outputting the index of the selected item output its text: the items rendered
+// the same are told apart by a hidden suffix, the bits of a key as zero width characters
+const (
+	hiddenZero = "\u200b" // Zero width space
+	hiddenOne  = "\u200c" // Zero width non-joiner
+)
+
+// hiddenSuffix encodes the key as zero width characters, the lowest bit first
+func hiddenSuffix(key uint) string {
+	var suffix strings.Builder
+	for {
+		if key&1 == 1 {
+			suffix.WriteString(hiddenOne)
+		} else {
+			suffix.WriteString(hiddenZero)
+		}
+		key >>= 1
+		if key == 0 {
+			return suffix.String()
+		}
+	}
+}
+
+// stripHidden removes the hidden suffix of an item
+func stripHidden(item string) string {
+	for {
+		trimmed := strings.TrimSuffix(strings.TrimSuffix(item, hiddenZero), hiddenOne)
+		if trimmed == item {
+			return item
+		}
+		item = trimmed
+	}
+}
+
+// uniqueItems returns the items with the hidden suffixes of their keys appended to the ones
+// rendered the same, the others are unchanged. Stable keys give the same items to every prompt.
+func uniqueItems(items []string, key func(i int) uint) []string {
+	count := make(map[string]int, len(items))
+	for _, item := range items {
+		count[item]++
+	}
+	unique := make([]string, len(items))
+	for i, item := range items {
+		unique[i] = item
+		if count[item] > 1 {
+			unique[i] = item + hiddenSuffix(key(i))
+		}
+	}
+	return unique
+}
+
+// matchItems returns the indexes of the items matching the text output by a backend.
+// The hidden suffixes are ignored when the backend dropped them, several items may match then.
+func matchItems(result string, items []string) []int {
+	var matches []int
+	for i, item := range items {
+		if item == result {
+			matches = append(matches, i)
+		}
+	}
+	if len(matches) > 0 {
+		return matches
+	}
+	result = stripHidden(result)
+	for i, item := range items {
+		if stripHidden(item) == result {
+			matches = append(matches, i)
+		}
+	}
+	return matches
+}
+
+// selectedIndex returns the index output by a backend, -1 if it is not one of the n items
+func selectedIndex(result string, n int) int {
+	if i, err := strconv.Atoi(result); err == nil && i >= 0 && i < n {
+		return i
+	}
+	return -1
+}
+
+// promptAmbiguous asks which of the items matching the selection was meant, instead of guessing.
+// The items are numbered, any backend tells them apart.
+func promptAmbiguous(menu *Menu, items []string) (int, ErrorPrompt) {
+	numbered := make([]string, len(items))
+	for i, item := range items {
+		numbered[i] = fmt.Sprintf("%d. %s", i+1, stripHidden(item))
+	}
+	return promptChoose(menu, PromptRequest{
+		Label:   menu.Configuration.Style.TextEntry,
+		Message: "Several items match the selection, choose one",
+	}, numbered)
+}
+
+// entryDetails describes the entry to tell it apart from the entries with the same title
+func entryDetails(menu *Menu, e *Entry) string {
+	details := []string{e.FullEntry.GetTitle()}
+	if e.Group != "" {
+		details[0] = e.Group + "/" + details[0]
+	}
+	if len(menu.Databases) > 1 && e.Database != nil {
+		details[0] = fmt.Sprintf("[%s] %s", e.Database.Name(), details[0])
+	}
+	for _, field := range []string{"UserName", "URL"} {
+		if value := e.FullEntry.GetContent(field); value != "" {
+			details = append(details, value)
+		}
+	}
+	return strings.Join(details, "  ")
+}
@@ -0,0 +1,65 @@
+package kpmenulib
+
+import (
+	"testing"
+)
+
+func TestUniqueItems(t *testing.T) {
+	items := uniqueItems([]string{"GitHub - me", "Mail", "GitHub - me"}, func(i int) uint { return uint(i) })
+	if items[1] != "Mail" || items[0] == items[2] || stripHidden(items[0]) != "GitHub - me" || stripHidden(items[2]) != "GitHub - me" {
+		t.Fatalf("unexpected items %q", items)
+	}
+	if matches := matchItems(items[2], items); len(matches) != 1 || matches[0] != 2 {
+		t.Errorf("expected the third item, got %v", matches)
+	}
+	// Backends dropping the zero width characters make the selection ambiguous
+	if matches := matchItems("GitHub - me", items); len(matches) != 2 {
+		t.Errorf("expected both items, got %v", matches)
+	}
+	if matches := matchItems("new", items); len(matches) != 0 {
+		t.Errorf("expected no item, got %v", matches)
+	}
+	if selectedIndex("2", 3) != 2 || selectedIndex("3", 3) != -1 || selectedIndex("GitHub", 3) != -1 {
+		t.Error("unexpected selected index")
+	}
+}
+
+func TestPromptEntriesDuplicates(t *testing.T) {
+	db := NewDatabase(DatabaseSource{Database: "test.kdbx"})
+	db.Loaded = true
+	db.Entries = []Entry{
+		newAuditEntry(db, "GitHub", "me", "https://github.com", "first"),
+		newAuditEntry(db, "GitHub", "me", "https://github.com", "second"),
+	}
+	db.Entries[0].UUID[1] = 1
+	db.Entries[1].UUID[1] = 2
+	menu := &Menu{Configuration: NewConfiguration(), Databases: []*Database{db}, Database: db}
+	menu.Configuration.General.Menu = PromptCustom
+	menu.Configuration.Style.FormatEntry = "{Title} - {UserName}"
+
+	menu.Configuration.Executable.CustomPromptEntries = "sed -n 2p"
+	entry, _, err := PromptEntries(menu, "")
+	if err.Error != nil || entry.FullEntry.GetPassword() != "second" {
+		t.Errorf("expected the second entry, got %q %+v", entry.FullEntry.GetPassword(), err)
+	}
+
+	// A backend dropping the hidden suffix makes the selection ambiguous, the entry is chosen from the details
+	menu.Configuration.Executable.CustomPromptEntries = `sh -c "sed -n 2p | cut -b 1-11"`
+	menu.Configuration.Executable.CustomPromptFields = "sed -n 2p"
+	entry, _, err = PromptEntries(menu, "")
+	if err.Error != nil || entry.FullEntry.GetPassword() != "second" {
+		t.Errorf("expected the second entry, got %q %+v", entry.FullEntry.GetPassword(), err)
+	}
+	menu.Configuration.Executable.CustomPromptFields = "grep -v ."
+	entry, _, _ = PromptEntries(menu, "")
+	if entry.FullEntry.GetPassword() != "" {
+		t.Errorf("expected no entry without a choice, got %q", entry.FullEntry.GetPassword())
+	}
+
+	// Choices too
+	menu.Configuration.Executable.CustomPromptFields = "sed -n 2p"
+	sel, err := PromptChoose(menu, []string{"GitHub", "GitHub"})
+	if err.Error != nil || sel != 1 {
+		t.Errorf("expected the second item, got %d %+v", sel, err)
+	}
+}
@@ -220,3 +220,12 @@ func contains(kws []string, s string) bool {
 	}
 	return false
 }
+
+func containsFold(kws []string, s string) bool {
+	for _, keyword := range kws {
+		if strings.EqualFold(keyword, s) {
+			return true
+		}
+	}
+	return false
+}
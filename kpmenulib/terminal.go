@@ -0,0 +1,506 @@
+package kpmenulib
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// terminalPromptCommand is the argv[0] of the prompts of the built-in terminal selector,
+// executePrompt runs them in process instead of executing a program
+const terminalPromptCommand = "kpmenu-terminal"
+
+// terminalCustomKeys is the number of custom keys of the built-in selector, Alt-1 to Alt-9
+const terminalCustomKeys = 9
+
+var (
+	fzfOnce      sync.Once
+	fzfInstalled bool
+)
+
+// hasFzf tells if fzf is installed, it is looked up once
+func hasFzf() bool {
+	fzfOnce.Do(func() { fzfInstalled = commandExists("fzf") })
+	return fzfInstalled
+}
+
+// terminalBackend prompts on the terminal kpmenu was started from: with fzf if installed,
+// otherwise with a small built-in selector. Passwords are always read by kpmenu, hidden.
+type terminalBackend struct{}
+
+func (terminalBackend) Executable() string { return "" }
+
+func (terminalBackend) Capabilities() PromptCapabilities {
+	if hasFzf() {
+		return PromptCapabilities{Password: true, Message: true, Preview: true}
+	}
+	return PromptCapabilities{Password: true, CustomKeys: terminalCustomKeys, Message: true, Index: true, Preview: true}
+}
+
+func (terminalBackend) Command(config *Configuration, r PromptRequest) ([]string, error) {
+	if r.Password || !hasFzf() {
+		command := []string{terminalPromptCommand, "--prompt", r.Label}
+		if r.Message != "" {
+			command = append(command, "--header", r.Message)
+		}
+		if r.Password {
+			command = append(command, "--password")
+		}
+		if r.Index {
+			command = append(command, "--index")
+		}
+		if r.Preview {
+			command = append(command, "--preview")
+		}
+		return command, nil
+	}
+
+	// Free text is accepted when nothing matches, e.g. for new values
+	command := []string{"fzf", "-i", "--prompt", r.Label + "> ", "--bind", "enter:accept-or-print-query"}
+	if r.Message != "" {
+		command = append(command, "--header", r.Message)
+	}
+	if r.Preview {
+		command = append(command,
+			"--delimiter", "\t", "--with-nth", "1",
+			"--preview", `printf '%b\n' {2}; p={3}; [ "$p" -gt 0 ] 2>/dev/null && echo "OTP: $((p - $(date +%s) % p))s left"`,
+			"--preview-window", "right:50%:wrap",
+		)
+	}
+	return command, nil
+}
+
+// entryPreview returns the item of an entry for the prompts showing previews: the title
+// followed by the encoded preview and the period of its OTP, separated by tabs
+func entryPreview(title string, e *Entry) string {
+	var preview strings.Builder
+	fmt.Fprintf(&preview, "Group: %s\n", e.Group)
+	fmt.Fprintf(&preview, "UserName: %s\n", e.FullEntry.GetContent("UserName"))
+	fmt.Fprintf(&preview, "URL: %s\n", e.FullEntry.GetContent("URL"))
+	password := e.FullEntry.GetPassword()
+	fmt.Fprintf(&preview, "Password: %s (%d characters)", strings.Repeat("*", min(utf8.RuneCountInString(password), 32)), utf8.RuneCountInString(password))
+	period := 0
+	if otp, err := CreateOTPAuth(e.FullEntry); err == nil && len(otp.secret) > 0 {
+		period = otp.Period
+	}
+	title = strings.ReplaceAll(title, "\t", " ")
+	return fmt.Sprintf("%s\t%s\t%d", title, encodePreview(preview.String()), period)
+}
+
+// encodePreview escapes the backslashes, newlines and tabs of a preview to keep it in a
+// single field of an item, printf %b decodes it
+func encodePreview(preview string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\t", " ").Replace(preview)
+}
+
+// decodePreview reverts encodePreview
+func decodePreview(encoded string) string {
+	var preview strings.Builder
+	for i := 0; i < len(encoded); i++ {
+		if encoded[i] == '\\' && i+1 < len(encoded) {
+			i++
+			if encoded[i] == 'n' {
+				preview.WriteByte('\n')
+				continue
+			}
+		}
+		preview.WriteByte(encoded[i])
+	}
+	return preview.String()
+}
+
+// terminalOptions are the options of a prompt of the built-in selector
+type terminalOptions struct {
+	label    string
+	message  string
+	password bool
+	index    bool
+	preview  bool
+}
+
+// parseTerminalOptions parses the arguments of terminalBackend.Command, unknown ones are
+// ignored as they are meant for fzf (e.g. the configured additional arguments)
+func parseTerminalOptions(args []string) terminalOptions {
+	var options terminalOptions
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--prompt":
+			if i+1 < len(args) {
+				i++
+				options.label = args[i]
+			}
+		case "--header":
+			if i+1 < len(args) {
+				i++
+				options.message = args[i]
+			}
+		case "--password":
+			options.password = true
+		case "--index":
+			options.index = true
+		case "--preview":
+			options.preview = true
+		}
+	}
+	return options
+}
+
+// terminalItem is an item of the built-in selector
+type terminalItem struct {
+	line    string // Line of the input, the output when selected
+	text    string // Shown and filtered text
+	preview string
+	period  int // Period of the OTP of the preview, 0 without OTP
+}
+
+func parseTerminalItem(line string, preview bool) terminalItem {
+	item := terminalItem{line: line, text: line}
+	if !preview {
+		return item
+	}
+	fields := strings.SplitN(line, "\t", 3)
+	item.text = fields[0]
+	if len(fields) > 1 {
+		item.preview = decodePreview(fields[1])
+	}
+	if len(fields) > 2 {
+		item.period, _ = strconv.Atoi(fields[2])
+	}
+	return item
+}
+
+// terminalSelector is the state of the built-in selector, independent of the terminal
+type terminalSelector struct {
+	options terminalOptions
+	items   []terminalItem
+	query   []rune
+	matches []int // Indexes of the items matching the query
+	cursor  int   // Index of the selected match
+}
+
+func newTerminalSelector(options terminalOptions, input string) *terminalSelector {
+	s := &terminalSelector{options: options}
+	if input != "" {
+		for _, line := range strings.Split(strings.TrimRight(input, "\n"), "\n") {
+			s.items = append(s.items, parseTerminalItem(line, options.preview))
+		}
+	}
+	s.filter()
+	return s
+}
+
+// filter selects the items containing every word of the query, ignoring the case
+func (s *terminalSelector) filter() {
+	words := strings.Fields(strings.ToLower(string(s.query)))
+	s.matches = s.matches[:0]
+	for i, item := range s.items {
+		text := strings.ToLower(item.text)
+		match := true
+		for _, word := range words {
+			if !strings.Contains(text, word) {
+				match = false
+				break
+			}
+		}
+		if match {
+			s.matches = append(s.matches, i)
+		}
+	}
+	s.cursor = 0
+}
+
+// selected returns the index of the selected item, -1 if nothing matches
+func (s *terminalSelector) selected() int {
+	if s.cursor < len(s.matches) {
+		return s.matches[s.cursor]
+	}
+	return -1
+}
+
+// result returns the output of the selection: the line or the index of the selected item,
+// or the query if nothing matches
+func (s *terminalSelector) result() string {
+	i := s.selected()
+	switch {
+	case s.options.password || (i == -1 && !s.options.index):
+		return string(s.query)
+	case s.options.index:
+		return strconv.Itoa(i)
+	default:
+		return s.items[i].line
+	}
+}
+
+// key handles a key read from the terminal, it returns true when the prompt is done
+func (s *terminalSelector) key(k string) (bool, string, ErrorPrompt) {
+	var errorPrompt ErrorPrompt
+	switch k {
+	case "\r", "\n":
+		return true, s.result(), errorPrompt
+	case "\x1b", "\x03", "\x07": // Esc, Ctrl-C, Ctrl-G
+		errorPrompt.Cancelled = true
+		return true, "", errorPrompt
+	case "\x1b[A", "\x1bOA", "\x10": // Up, Ctrl-P
+		if s.cursor > 0 {
+			s.cursor--
+		}
+	case "\x1b[B", "\x1bOB", "\x0e": // Down, Ctrl-N
+		if s.cursor < len(s.matches)-1 {
+			s.cursor++
+		}
+	case "\x7f", "\x08": // Backspace
+		if len(s.query) > 0 {
+			s.query = s.query[:len(s.query)-1]
+			s.filter()
+		}
+	case "\x15": // Ctrl-U
+		s.query = nil
+		s.filter()
+	case "\t":
+		if i := s.selected(); i != -1 && !s.options.password {
+			s.query = []rune(s.items[i].text)
+			s.filter()
+		}
+	default:
+		if len(k) == 2 && k[0] == '\x1b' && k[1] >= '1' && k[1] < '1'+terminalCustomKeys && !s.options.password {
+			// Alt-1 to Alt-9, as the custom keys of rofi
+			errorPrompt.CustomKey = int(k[1] - '0')
+			return true, s.result(), errorPrompt
+		}
+		if r, _ := utf8.DecodeRuneInString(k); len(k) > 0 && unicode.IsPrint(r) {
+			s.query = append(s.query, []rune(k)...)
+			s.filter()
+		}
+	}
+	return false, "", errorPrompt
+}
+
+// render draws the selector on a screen of the given size
+func (s *terminalSelector) render(w io.Writer, now time.Time, rows, cols int) {
+	if s.options.password {
+		// Only the label on the current line, the typed text is hidden
+		fmt.Fprintf(w, "\r\x1b[K%s: ", s.options.label)
+		return
+	}
+
+	var screen strings.Builder
+	screen.WriteString("\x1b[H\x1b[2J")
+	line := func(text string) {
+		if runes := []rune(text); len(runes) > cols {
+			text = string(runes[:cols])
+		}
+		screen.WriteString(text + "\r\n")
+		rows--
+	}
+
+	top := 1
+	if s.options.message != "" {
+		line(s.options.message)
+		top++
+	}
+	prompt := s.options.label + "> " + string(s.query)
+
+	// Preview of the selected item below the matches
+	var preview []string
+	if i := s.selected(); i != -1 && s.items[i].preview != "" {
+		item := s.items[i]
+		preview = append([]string{strings.Repeat("─", cols)}, strings.Split(item.preview, "\n")...)
+		if item.period > 0 {
+			preview = append(preview, fmt.Sprintf("OTP: %ds left", int64(item.period)-now.Unix()%int64(item.period)))
+		}
+	}
+	height := rows - 1 - len(preview)
+	if height < 1 {
+		height = 1
+	}
+	first := 0
+	if s.cursor >= height {
+		first = s.cursor - height + 1
+	}
+	line(prompt)
+	for n := first; n < len(s.matches) && n < first+height; n++ {
+		if n == s.cursor {
+			line("\x1b[7m> " + s.items[s.matches[n]].text + "\x1b[0m")
+		} else {
+			line("  " + s.items[s.matches[n]].text)
+		}
+	}
+	for _, l := range preview {
+		line(l)
+	}
+	// Put the cursor back at the end of the query
+	fmt.Fprintf(&screen, "\x1b[%d;%dH", top, utf8.RuneCountInString(prompt)+1)
+	io.WriteString(w, screen.String())
+}
+
+// splitKeys splits the bytes read from the terminal into keys: escape sequences, Alt
+// combinations and characters
+func splitKeys(data string) []string {
+	var keys []string
+	for len(data) > 0 {
+		n := 1
+		switch {
+		case data[0] == '\x1b' && len(data) >= 3 && (data[1] == '[' || data[1] == 'O'):
+			n = 3
+			// Sequences with parameters, e.g. Delete \x1b[3~
+			for n < len(data) && data[n-1] >= '0' && data[n-1] <= '9' {
+				n++
+			}
+		case data[0] == '\x1b' && len(data) >= 2:
+			n = 2
+		default:
+			_, n = utf8.DecodeRuneInString(data)
+		}
+		keys = append(keys, data[:n])
+		data = data[n:]
+	}
+	return keys
+}
+
+// showTerminalQR shows the QR code in the alternate screen of the terminal, until a key is pressed
+func showTerminalQR(code *qrCode, title string) error {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("the terminal menu needs a terminal: %v", err)
+	}
+	defer tty.Close()
+
+	saved, err := stty(tty, "-g")
+	if err == nil {
+		_, err = stty(tty, "-echo", "-icanon", "-isig", "min", "1", "time", "0")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set up the terminal: %v", err)
+	}
+	defer stty(tty, saved)
+	io.WriteString(tty, "\x1b[?1049h\x1b[H\x1b[2J")
+	defer io.WriteString(tty, "\x1b[?1049l")
+
+	fmt.Fprintf(tty, "%s\r\n", title)
+	for _, line := range strings.Split(code.String(), "\n") {
+		fmt.Fprintf(tty, "%s\r\n", line)
+	}
+	io.WriteString(tty, "Press any key to close")
+	_, err = tty.Read(make([]byte, 16))
+	return err
+}
+
+// stty runs stty on the terminal
+func stty(tty *os.File, args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = tty
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// terminalSize returns the rows and columns of the terminal, 24x80 if unknown
+func terminalSize(tty *os.File) (int, int) {
+	out, err := stty(tty, "size")
+	if err == nil {
+		var rows, cols int
+		if _, err := fmt.Sscan(out, &rows, &cols); err == nil && rows > 0 && cols > 0 {
+			return rows, cols
+		}
+	}
+	return 24, 80
+}
+
+// runTerminalPrompt runs a prompt of the built-in selector on the controlling terminal
+func runTerminalPrompt(args []string, input *strings.Reader) (string, ErrorPrompt) {
+	var errorPrompt ErrorPrompt
+	s := newTerminalSelector(parseTerminalOptions(args), readAllString(input))
+
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		errorPrompt.Cancelled = true
+		errorPrompt.Error = fmt.Errorf("the terminal menu needs a terminal: %v", err)
+		return "", errorPrompt
+	}
+	defer tty.Close()
+
+	// Read the keys as typed, without echo and signals, restoring the terminal afterwards
+	saved, err := stty(tty, "-g")
+	if err == nil {
+		_, err = stty(tty, "-echo", "-icanon", "-isig", "min", "1", "time", "0")
+	}
+	if err != nil {
+		errorPrompt.Cancelled = true
+		errorPrompt.Error = fmt.Errorf("failed to set up the terminal: %v", err)
+		return "", errorPrompt
+	}
+	defer stty(tty, saved)
+	if !s.options.password {
+		// Alternate screen, the terminal content is restored when leaving it
+		io.WriteString(tty, "\x1b[?1049h")
+		defer io.WriteString(tty, "\x1b[?1049l")
+	} else {
+		defer io.WriteString(tty, "\r\n")
+	}
+
+	// The reader stops once the prompt is done, closing the terminal ends its pending read
+	done := make(chan struct{})
+	defer close(done)
+	keys := readKeys(tty, done)
+	// The OTP countdown of the preview is refreshed every second
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	rows, cols := terminalSize(tty)
+	for {
+		s.render(tty, time.Now(), rows, cols)
+		select {
+		case data, ok := <-keys:
+			if !ok {
+				errorPrompt.Cancelled = true
+				return "", errorPrompt
+			}
+			for _, k := range splitKeys(data) {
+				if done, result, errorPrompt := s.key(k); done {
+					return result, errorPrompt
+				}
+			}
+		case <-ticker.C:
+			if !s.options.password {
+				rows, cols = terminalSize(tty)
+			}
+		}
+	}
+}
+
+// readKeys sends the keys read from r until r fails or done is closed, then closes the channel
+func readKeys(r io.Reader, done <-chan struct{}) <-chan string {
+	keys := make(chan string)
+	go func() {
+		defer close(keys)
+		buffer := make([]byte, 256)
+		for {
+			n, err := r.Read(buffer)
+			if err != nil {
+				return
+			}
+			select {
+			case keys <- string(buffer[:n]):
+			case <-done:
+				return
+			}
+		}
+	}()
+	return keys
+}
+
+// readAllString returns the remaining content of the reader, empty if nil
+func readAllString(input *strings.Reader) string {
+	if input == nil {
+		return ""
+	}
+	var content strings.Builder
+	input.WriteTo(&content)
+	return content.String()
+}
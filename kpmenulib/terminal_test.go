@@ -0,0 +1,136 @@
+package kpmenulib
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+func TestEntryPreview(t *testing.T) {
+	db := NewDatabase(DatabaseSource{Database: "test.kdbx"})
+	entry := newAuditEntry(db, "GitHub", "me", `https://github.com/a\b`, "secret")
+	entry.Group = "Root/Work"
+	entry.FullEntry.Values = append(entry.FullEntry.Values,
+		gokeepasslib.ValueData{Key: OTP, Value: gokeepasslib.V{Content: "otpauth://totp/GitHub:me?secret=JBSWY3DPEHPK3PXP&period=30"}})
+
+	line := entryPreview("Git\tHub", &entry)
+	if strings.Count(line, "\n") != 0 || strings.Count(line, "\t") != 2 {
+		t.Fatalf("expected a single line with 3 fields, got %q", line)
+	}
+	item := parseTerminalItem(line, true)
+	expected := "Group: Root/Work\nUserName: me\nURL: https://github.com/a\\b\nPassword: ****** (6 characters)"
+	if item.text != "Git Hub" || item.preview != expected || item.period != 30 {
+		t.Errorf("unexpected item %+v", item)
+	}
+}
+
+func TestTerminalSelector(t *testing.T) {
+	input := "GitHub\nGitLab\nMail server\n"
+	typed := func(s *terminalSelector, keys ...string) (bool, string, ErrorPrompt) {
+		for _, k := range keys {
+			if done, result, err := s.key(k); done {
+				return done, result, err
+			}
+		}
+		return false, "", ErrorPrompt{}
+	}
+
+	// Every word of the query must match, ignoring the case
+	s := newTerminalSelector(terminalOptions{label: "Entry"}, input)
+	typed(s, splitKeys("git lab")...)
+	if len(s.matches) != 1 || s.items[s.matches[0]].text != "GitLab" {
+		t.Errorf("expected GitLab to match, got %v", s.matches)
+	}
+	typed(s, "\x15", "g", "i", "t")
+	if _, result, _ := typed(s, "\x1b[B", "\r"); result != "GitLab" {
+		t.Errorf("expected GitLab, got %q", result)
+	}
+
+	// Free text when nothing matches, the index when requested
+	s = newTerminalSelector(terminalOptions{}, input)
+	if _, result, _ := typed(s, "n", "e", "w", "\r"); result != "new" {
+		t.Errorf("expected the query, got %q", result)
+	}
+	s = newTerminalSelector(terminalOptions{index: true}, input)
+	if _, result, _ := typed(s, splitKeys("mail\r")...); result != "2" {
+		t.Errorf("expected the index 2, got %q", result)
+	}
+
+	// Custom keys and cancel
+	s = newTerminalSelector(terminalOptions{}, input)
+	if _, result, err := typed(s, splitKeys("\x1b[B\x1b3")...); result != "GitLab" || err.CustomKey != 3 {
+		t.Errorf("expected GitLab with the custom key 3, got %q %+v", result, err)
+	}
+	if done, _, err := typed(s, "\x1b"); !done || !err.Cancelled {
+		t.Error("expected Esc to cancel")
+	}
+
+	// The password is never shown
+	s = newTerminalSelector(terminalOptions{label: "Password", password: true}, "")
+	var screen bytes.Buffer
+	typed(s, "p", "w")
+	s.render(&screen, time.Now(), 24, 80)
+	if strings.Contains(screen.String(), "pw") {
+		t.Errorf("the password is shown: %q", screen.String())
+	}
+	if _, result, _ := typed(s, "\r"); result != "pw" {
+		t.Errorf("expected the password, got %q", result)
+	}
+
+	menu := &Menu{Configuration: NewConfiguration()}
+	menu.Configuration.General.Menu = PromptTerminal
+	command, _ := getCommand(menu, PromptRequest{Label: "Password", Password: true})
+	if options := parseTerminalOptions(command[1:]); command[0] != terminalPromptCommand || !options.password || options.label != "Password" {
+		t.Errorf("expected the hidden input of the terminal, got %v", command)
+	}
+}
+
+func TestTerminalNotCached(t *testing.T) {
+	cfg := NewConfiguration()
+	cfg.Database.Database = "test.kdbx"
+	cfg.General.Menu = PromptTerminal
+	cfg.Flags.Daemon = true
+	if err := validateConfig(cfg); err == nil || !strings.Contains(err.Error(), "daemon") {
+		t.Errorf("expected the daemon to be refused, got %v", err)
+	}
+
+	// The prompts are in the terminal of this process
+	cfg.Flags.Daemon = false
+	validateConfig(cfg)
+	if !cfg.General.NoCache {
+		t.Error("expected the cache to be disabled")
+	}
+}
+
+func TestReadKeysStops(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	done := make(chan struct{})
+	keys := readKeys(r, done)
+	w.WriteString("a")
+	if key := <-keys; key != "a" {
+		t.Fatalf("expected key a, got %q", key)
+	}
+
+	// A key read after the prompt is done is dropped, then closing the file ends the pending read
+	w.WriteString("b")
+	time.Sleep(10 * time.Millisecond)
+	close(done)
+	time.Sleep(10 * time.Millisecond)
+	r.Close()
+	select {
+	case key, ok := <-keys:
+		if ok {
+			t.Errorf("expected the reader to stop, got key %q", key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the reader to stop")
+	}
+}
@@ -0,0 +1,76 @@
+package kpmenulib
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// watchDelay is the time without changes waited before reading a changed file
+const watchDelay = 500 * time.Millisecond
+
+// watchFile watches the directory of name with inotify, so that files replaced by
+// a rename (as done by sync tools and editors) are noticed too.
+// The path of the changed file is sent on the returned channel for every change of name,
+// or of the files of the same directory for which related returns true, until stop is called.
+func watchFile(name string, related func(base, name string) bool) (changes <-chan string, stop func(), err error) {
+	target, err := filepath.Abs(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resolved, err := filepath.EvalSymlinks(target); err == nil {
+		target = resolved
+	}
+	dir, base := filepath.Split(target)
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, nil, os.NewSyscallError("inotify_init1", err)
+	}
+	mask := uint32(syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_CREATE)
+	if _, err = syscall.InotifyAddWatch(fd, dir, mask); err != nil {
+		syscall.Close(fd)
+		return nil, nil, os.NewSyscallError("inotify_add_watch", err)
+	}
+
+	// Non-blocking, so that closing the file stops a pending read
+	file := os.NewFile(uintptr(fd), "inotify")
+	ch := make(chan string, 16)
+	go func() {
+		defer close(ch)
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := file.Read(buf)
+			if err != nil {
+				return
+			}
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				// struct inotify_event { int wd; uint32 mask, cookie, len; char name[]; }
+				length := int(binary.NativeEndian.Uint32(buf[offset+12:]))
+				start := offset + syscall.SizeofInotifyEvent
+				offset = start + length
+				if offset > n {
+					break
+				}
+				changed := strings.TrimRight(string(buf[start:offset]), "\x00")
+				switch {
+				case changed == base:
+					changed = name
+				case related != nil && related(base, changed):
+					changed = filepath.Join(dir, changed)
+				default:
+					continue
+				}
+				select {
+				case ch <- changed:
+				default:
+					// Changes are already pending
+				}
+			}
+		}
+	}()
+	return ch, func() { file.Close() }, nil
+}
@@ -0,0 +1,77 @@
+//go:build !linux
+
+package kpmenulib
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// watchDelay is the time without changes waited before reading a changed file
+const watchDelay = 500 * time.Millisecond
+
+// watchInterval is the polling interval used where inotify isn't available
+const watchInterval = 2 * time.Second
+
+// watchFile polls the modification time of name, and of the files of the same directory
+// for which related returns true.
+// The path of the changed file is sent on the returned channel for every change, until stop is called.
+func watchFile(name string, related func(base, name string) bool) (changes <-chan string, stop func(), err error) {
+	if _, err := os.Stat(name); err != nil {
+		return nil, nil, err
+	}
+	dir, base := filepath.Split(name)
+	if dir == "" {
+		dir = "."
+	}
+	// Files existing when the watch starts are not changes
+	last := make(map[string]time.Time)
+	poll := func(notify func(string)) {
+		paths := []string{name}
+		if related != nil {
+			if entries, err := os.ReadDir(dir); err == nil {
+				for _, e := range entries {
+					if related(base, e.Name()) {
+						paths = append(paths, filepath.Join(dir, e.Name()))
+					}
+				}
+			}
+		}
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			if t, ok := last[path]; !ok || !info.ModTime().Equal(t) {
+				last[path] = info.ModTime()
+				if ok || path != name {
+					notify(path)
+				}
+			}
+		}
+	}
+	poll(func(string) {})
+
+	ch := make(chan string, 16)
+	done := make(chan struct{})
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(watchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				poll(func(path string) {
+					select {
+					case ch <- path:
+					default:
+					}
+				})
+			}
+		}
+	}()
+	return ch, func() { close(done) }, nil
+}
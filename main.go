@@ -13,7 +13,13 @@ import (
 const Version = "1.5.0"
 
 func main() {
-	cc := kpmenulib.InitializeFlags(nil)
+	command, commandArgs, flags := kpmenulib.SplitCommand(os.Args[1:])
+	var cc *claptrap.CommandConfig
+	if command == "" {
+		cc = kpmenulib.InitializeFlags(nil)
+	} else {
+		cc = kpmenulib.InitializeFlags(flags)
+	}
 	if cc.Bool("version") {
 		fmt.Println(Version)
 		os.Exit(0)
@@ -28,17 +34,28 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Commands don't need the menu
+	if command != "" {
+		if err := kpmenulib.RunCommand(config, command, commandArgs); err != nil {
+			log.Fatalf("%s: %s", command, err)
+		}
+		os.Exit(0)
+	}
+
 	menu, err := kpmenulib.NewMenu(config)
 	if err != nil {
 		log.Fatalf("creating menu: %s", err)
 		os.Exit(1)
 	}
 	menu.ReloadConfig = func() error {
-		return kpmenulib.LoadConfig(cc, config)
+		err := kpmenulib.LoadConfig(cc, config)
+		// The menu took the password already, only its composite key is kept
+		config.Database.Password = ""
+		return err
 	}
 
-	// Start client
-	if err = kpmenulib.StartClient(); err != nil {
+	// Start client, the terminal menu prompts in the terminal of this process
+	if config.General.Menu == kpmenulib.PromptTerminal || kpmenulib.StartClient() != nil {
 		// Failed to comunicate with server - start server
 		err = kpmenulib.StartServer(menu)
 